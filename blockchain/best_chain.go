@@ -0,0 +1,224 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"tchain/storage"
+)
+
+// ConnectBestChain 把通过 AddBlock 保存的区块中最高的完整分支连接到链上
+// 分支上的每个区块都通过 ConnectBlock 验证，分支不是从 tip 延伸出来时先撤销当前链上分叉点之后的区块；
+// 出现无效的区块时把它从区块索引中删除，恢复原来的链，然后继续尝试其他分支
+func (bc *Blockchain) ConnectBestChain() error {
+	for {
+		disconnect, connect, err := bc.findBestBranch()
+		if err != nil {
+			return err
+		}
+		if connect == nil {
+			return nil
+		}
+
+		err = bc.switchBranch(disconnect, connect)
+		if err != nil && !errors.Is(err, ErrInvalidBlock) {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("Rejected branch: %s\n", err)
+		}
+	}
+}
+
+// findBestBranch 在比 tip 更高的已保存区块中找到最高的一个，并且从它到当前链之间的所有区块都已经保存
+// 返回切换到这个分支需要撤销和连接的区块，没有这样的分支时都返回 nil
+func (bc *Blockchain) findBestBranch() ([][]byte, [][]byte, error) {
+	tipHeader, err := bc.GetHeader(bc.tip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []*BlockHeader
+	err = bc.DB.View(func(tx storage.Tx) error {
+		index := tx.Bucket([]byte(BLOCK_INDEX_BUCKET))
+		if index == nil {
+			return nil
+		}
+
+		c := index.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			header, err := getHeader(tx, k)
+			if err == ErrHeaderNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if header.Height > tipHeader.Height {
+				candidates = append(candidates, header)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Height > candidates[j].Height
+	})
+
+	for _, candidate := range candidates {
+		disconnect, connect, err := bc.findFork(bc.tip, candidate.Hash)
+		if errors.Is(err, ErrHeaderNotFound) {
+			// 分支上有区块还没有收到
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		complete, err := bc.hasBlocks(connect)
+		if err != nil {
+			return nil, nil, err
+		}
+		if complete {
+			return disconnect, connect, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+func (bc *Blockchain) hasBlocks(hashes [][]byte) (bool, error) {
+	complete := true
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		for _, hash := range hashes {
+			if !hasBlock(tx, hash) {
+				complete = false
+				break
+			}
+		}
+
+		return nil
+	})
+
+	return complete, err
+}
+
+// switchBranch 撤销 disconnect 中的区块，再通过 ConnectBlock 按顺序连接 connect 中的区块
+// 失败时撤销已经连接的区块并重新连接原来的区块，无效的区块从区块索引中删除，之后不会再被选中
+func (bc *Blockchain) switchBranch(disconnect, connect [][]byte) error {
+	var disconnected []*Block
+	connected := 0
+
+	// restore 回到切换之前的链，原来的区块重新连接时仍然经过 ConnectBlock
+	restore := func(cause error) error {
+		for ; connected > 0; connected-- {
+			_, err := bc.disconnectTip()
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := len(disconnected) - 1; i >= 0; i-- {
+			err := bc.ConnectBlock(disconnected[i])
+			if err != nil {
+				return err
+			}
+		}
+
+		return cause
+	}
+
+	for range disconnect {
+		block, err := bc.disconnectTip()
+		if err != nil {
+			return restore(err)
+		}
+		disconnected = append(disconnected, block)
+	}
+
+	for _, hash := range connect {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return restore(err)
+		}
+
+		err = bc.ConnectBlock(&block)
+		if errors.Is(err, ErrInvalidBlock) {
+			forgetErr := bc.forgetBlock(hash)
+			if forgetErr != nil {
+				return forgetErr
+			}
+		}
+		if err != nil {
+			return restore(err)
+		}
+		connected++
+	}
+
+	return nil
+}
+
+// disconnectTip 把 tip 从链上撤销：UTXO 集恢复到前一个区块时的状态，tip 移动到前一个区块
+// 与 ConnectBlock 一样，chainstate 的修改和 tip 在同一个事务中写入，进程在任何时刻退出两者都保持一致
+// 区块仍然保存在区块文件中，之后可以重新连接
+func (bc *Blockchain) disconnectTip() (*Block, error) {
+	u := UTXOSet{Blockchain: bc}
+
+	// 例如缓存还没有写入时进程退出过，UTXO 集可能落后于 tip
+	utxoTip, err := u.Tip()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(utxoTip, bc.tip) {
+		err = u.SyncToTip()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block, err := bc.GetBlock(bc.tip)
+	if err != nil {
+		return nil, err
+	}
+
+	// 开启了缓存时先把缓存写入 chainstate，撤销直接在 chainstate 上进行
+	if cache := bc.utxoCache; cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+
+		err = cache.flushAndReset()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		err := disconnectBlock(tx, &block)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket([]byte(BLOCKS_BUCKET)).Put([]byte("l"), block.PrevBlockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bc.tip = append([]byte{}, block.PrevBlockHash...)
+
+	return &block, nil
+}
+
+// forgetBlock 把无效的区块从区块索引中删除，依赖它的区块因为缺少前一个区块而不会再被连接
+func (bc *Blockchain) forgetBlock(hash []byte) error {
+	return bc.DB.Update(func(tx storage.Tx) error {
+		return tx.Bucket([]byte(BLOCK_INDEX_BUCKET)).Delete(hash)
+	})
+}
@@ -3,6 +3,8 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"tchain/merkle"
 	"time"
@@ -19,6 +21,16 @@ type Block struct {
 	Height        int            // 块的高度k
 }
 
+func init() {
+	// gob 在类型第一次被编码时才为它分配进程内的类型编号，而编号会写入编码结果
+	// 交易 ID 和 Merkle 树根都依赖序列化结果，因此在任何其他类型被编码之前固定区块和交易相关类型的编号，
+	// 保证同一笔交易在不同进程中（例如挖矿节点和轻节点）序列化的结果一致
+	err := gob.NewEncoder(ioutil.Discard).Encode(Block{})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
 // Serialize 序列化区块
 func (b *Block) Serialize() []byte {
 	var result bytes.Buffer
@@ -33,18 +45,17 @@ func (b *Block) Serialize() []byte {
 	return result.Bytes()
 }
 
-// DeserializeBlock 反序列化区块
-func DeserializeBlock(d []byte) *Block {
+// DeserializeBlock 反序列化区块，数据来自其他节点时可能是无效的
+func DeserializeBlock(d []byte) (*Block, error) {
 	var block Block
 
 	decoder := gob.NewDecoder(bytes.NewBuffer(d))
 	err := decoder.Decode(&block)
-
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("Failed to decode block: %w", err)
 	}
 
-	return &block
+	return &block, nil
 }
 
 // HashTransactions 返回块中包含的交易的哈希
@@ -0,0 +1,57 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// BlockHeader 区块头，包含计算工作量证明所需的全部数据
+// 轻节点只同步和保存区块头，通过 MerkleRoot 验证交易是否被打包
+type BlockHeader struct {
+	Timestamp     int64  // 区块创建的时间
+	PrevBlockHash []byte // 前一个块的哈希
+	Hash          []byte // 当前块的哈希
+	MerkleRoot    []byte // 区块交易构成的 Merkle 树根
+	Nonce         int    // 随机数
+	Height        int    // 块的高度
+}
+
+// Header 返回区块的区块头
+func (b *Block) Header() *BlockHeader {
+	return &BlockHeader{
+		Timestamp:     b.Timestamp,
+		PrevBlockHash: b.PrevBlockHash,
+		Hash:          b.Hash,
+		MerkleRoot:    b.HashTransactions(),
+		Nonce:         b.Nonce,
+		Height:        b.Height,
+	}
+}
+
+// Serialize 序列化区块头
+func (h *BlockHeader) Serialize() []byte {
+	var result bytes.Buffer
+	encoder := gob.NewEncoder(&result)
+
+	err := encoder.Encode(h)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return result.Bytes()
+}
+
+// DeserializeBlockHeader 反序列化区块头
+func DeserializeBlockHeader(d []byte) (*BlockHeader, error) {
+	var header BlockHeader
+
+	decoder := gob.NewDecoder(bytes.NewBuffer(d))
+	err := decoder.Decode(&header)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode block header: %w", err)
+	}
+
+	return &header, nil
+}
@@ -0,0 +1,373 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"tchain/common"
+	"tchain/storage"
+)
+
+// 区块内容追加写入 blocks_<nodeID> 目录中的 blk*.dat 文件，单个文件超过 MAX_BLOCK_FILE_SIZE 后写入下一个文件
+// 数据库中只保存区块的索引和链的元数据
+const BLOCKS_DIR = "blocks_%s"
+const BLOCK_FILE_PREFIX = "blk"
+const MAX_BLOCK_FILE_SIZE = 16 << 20
+
+// 区块索引，key 为区块哈希，value 为区块在文件中的位置
+const BLOCK_INDEX_BUCKET = "blockindex"
+
+// 每个区块文件中区块的最大高度，裁剪时所有区块都低于裁剪高度的文件会被整体删除
+const BLOCK_FILES_BUCKET = "blockfiles"
+
+// openBlockFiles 打开节点的区块文件目录
+func openBlockFiles(nodeID string) (storage.FlatFiles, error) {
+	return storage.OpenFlatFiles(fmt.Sprintf(BLOCKS_DIR, nodeID), BLOCK_FILE_PREFIX, MAX_BLOCK_FILE_SIZE)
+}
+
+func blockFileKey(file int) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, uint32(file))
+
+	return key
+}
+
+// indexBlock 把区块的位置写入索引，并更新区块文件的最大高度
+func indexBlock(tx storage.Tx, hash []byte, height int, loc storage.Location) error {
+	index, err := tx.CreateBucketIfNotExists([]byte(BLOCK_INDEX_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	err = index.Put(hash, loc.Serialize())
+	if err != nil {
+		return err
+	}
+
+	files, err := tx.CreateBucketIfNotExists([]byte(BLOCK_FILES_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	key := blockFileKey(loc.File)
+	if data := files.Get(key); data != nil && int(common.HexToInt(data)) >= height {
+		return nil
+	}
+
+	return files.Put(key, common.IntToHex(int64(height)))
+}
+
+// putBlock 把区块追加到区块文件中并写入索引
+// 区块在事务提交之前已经写入文件，事务失败时文件中会留下没有索引的区块，它们不会被读取，重建索引时会被重新加入
+func (bc *Blockchain) putBlock(tx storage.Tx, block *Block) error {
+	loc, err := bc.blocks.Append(block.Serialize())
+	if err != nil {
+		return err
+	}
+
+	return indexBlock(tx, block.Hash, block.Height, loc)
+}
+
+// hasBlock 判断区块内容是否保存在本地
+func hasBlock(tx storage.Tx, hash []byte) bool {
+	index := tx.Bucket([]byte(BLOCK_INDEX_BUCKET))
+
+	return index != nil && index.Get(hash) != nil
+}
+
+// readBlock 通过索引从区块文件中读取区块，区块不在索引中时返回 nil
+func (bc *Blockchain) readBlock(tx storage.Tx, hash []byte) (*Block, error) {
+	index := tx.Bucket([]byte(BLOCK_INDEX_BUCKET))
+	if index == nil {
+		return nil, nil
+	}
+
+	data := index.Get(hash)
+	if data == nil {
+		return nil, nil
+	}
+
+	loc, err := storage.DeserializeLocation(data)
+	if err != nil {
+		return nil, err
+	}
+
+	blockData, err := bc.blocks.Read(loc)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read block %x: %v", hash, err)
+	}
+
+	block, err := DeserializeBlock(blockData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read block %x: %v", hash, err)
+	}
+
+	return block, nil
+}
+
+// pruneBlockFiles 在裁剪时找到所有区块都低于 pruneHeight 的区块文件，删除它们的记录以及指向它们的索引
+// 包括不在主链上的区块，返回需要在事务提交后删除的文件
+func pruneBlockFiles(tx storage.Tx, pruneHeight int) ([]int, error) {
+	files := tx.Bucket([]byte(BLOCK_FILES_BUCKET))
+	if files == nil {
+		return nil, nil
+	}
+
+	removed := make(map[int]bool)
+	var result []int
+
+	c := files.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if int(common.HexToInt(v)) >= pruneHeight {
+			continue
+		}
+
+		file := int(binary.BigEndian.Uint32(k))
+		removed[file] = true
+		result = append(result, file)
+
+		err := files.Delete(k)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	index := tx.Bucket([]byte(BLOCK_INDEX_BUCKET))
+	c = index.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		loc, err := storage.DeserializeLocation(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if removed[loc.File] {
+			err = index.Delete(k)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// moveBlocksToFiles 把旧版本保存在 blocks bucket 中的区块内容移动到区块文件中
+// 区块哈希是 32 字节的 SHA-256，tip 等元数据的 key 都是较短的名称
+func (bc *Blockchain) moveBlocksToFiles(tx storage.Tx) error {
+	b := tx.Bucket([]byte(BLOCKS_BUCKET))
+
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if len(k) != 32 {
+			continue
+		}
+
+		block, err := DeserializeBlock(v)
+		if err != nil {
+			return err
+		}
+
+		err = bc.putBlock(tx, block)
+		if err != nil {
+			return err
+		}
+
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RebuildBlockIndex 扫描节点的区块文件，重新生成区块索引，数据库不存在时创建一个新的
+func RebuildBlockIndex(nodeID string) (*Blockchain, int, error) {
+	db, err := storage.OpenBolt(fmt.Sprintf(DB_FILE, nodeID))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	files, err := openBlockFiles(nodeID)
+	if err != nil {
+		db.Close()
+		return nil, 0, err
+	}
+
+	bc, count, err := RebuildBlockIndexWithDB(db, files)
+	if err != nil {
+		db.Close()
+		return nil, 0, err
+	}
+
+	return bc, count, nil
+}
+
+// RebuildBlockIndexWithDB 扫描区块文件，重新生成区块索引、区块头和过滤器，返回找到的区块数量
+// 文件中的区块不一定有效，也不一定相连，所以 tip 由 findValidTip 从创世块开始沿着有效的区块选出
+func RebuildBlockIndexWithDB(db storage.DB, files storage.FlatFiles) (*Blockchain, int, error) {
+	bc := Blockchain{DB: db, blocks: files}
+	count := 0
+
+	fileNumbers, err := files.Files()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	err = db.Update(func(tx storage.Tx) error {
+		// 数据库丢失后重建时创建的是最新版本的数据库
+		if tx.Bucket([]byte(BLOCKS_BUCKET)) == nil {
+			err := putSchemaVersion(tx, SCHEMA_VERSION)
+			if err != nil {
+				return err
+			}
+		} else if version := getSchemaVersion(tx); version > SCHEMA_VERSION {
+			return schemaTooNewError(version)
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte(BLOCKS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{BLOCK_INDEX_BUCKET, BLOCK_FILES_BUCKET} {
+			err = tx.DeleteBucket([]byte(name))
+			if err != nil && err != storage.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		// 通过 checkBlock 的区块，无效的区块仍然写入索引，但不会成为链的一部分
+		checked := make(map[string]bool)
+
+		for _, file := range fileNumbers {
+			err = files.Scan(file, func(loc storage.Location, data []byte) error {
+				block, err := DeserializeBlock(data)
+				if err != nil {
+					return fmt.Errorf("Invalid block in file %d at offset %d: %w", loc.File, loc.Offset, err)
+				}
+
+				err = indexBlock(tx, block.Hash, block.Height, loc)
+				if err != nil {
+					return err
+				}
+
+				err = putHeader(tx, block)
+				if err != nil {
+					return err
+				}
+
+				err = putCFilter(tx, block)
+				if err != nil {
+					return err
+				}
+
+				err = checkBlock(block)
+				if err != nil {
+					fmt.Printf("Block at height %d is not used: %s\n", block.Height, err)
+				} else {
+					checked[string(block.Hash)] = true
+				}
+				count++
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		best, err := findValidTip(tx, checked, b.Get([]byte("l")))
+		if err != nil {
+			return err
+		}
+		if best == nil {
+			return errors.New("No valid chain found in the block files")
+		}
+
+		bc.tip = append([]byte{}, best.Hash...)
+
+		return b.Put([]byte("l"), best.Hash)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// 旧版本的数据库中还可能有需要迁移的数据
+	err = bc.migrate()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &bc, count, nil
+}
+
+// findValidTip 从创世块（从快照启动时还包括快照所在的区块）开始沿着相连的区块头向后查找，返回最高的区块
+// 每一步都要求高度紧接着前一个区块、区块头的工作量证明有效，并且区块通过了 checkBlock（在 checked 中）；
+// 与 VerifyChain 相同，区块文件中没有的区块只有在已经被裁剪或者从快照启动还没有下载时才可以只检查区块头
+// 高度相同时优先选择 preferred，也就是重建之前的 tip
+func findValidTip(tx storage.Tx, checked map[string]bool, preferred []byte) (*BlockHeader, error) {
+	headers := tx.Bucket([]byte(HEADERS_BUCKET))
+	if headers == nil {
+		return nil, nil
+	}
+
+	b := tx.Bucket([]byte(BLOCKS_BUCKET))
+	pruneHeight := getPruneValue(b, PRUNE_HEIGHT_KEY)
+	snapshotBase := b.Get([]byte(SNAPSHOT_BASE_KEY))
+
+	valid := func(header *BlockHeader) bool {
+		if !NewHeaderProofOfWork(header).Validate() {
+			return false
+		}
+		if checked[string(header.Hash)] {
+			return true
+		}
+
+		return !hasBlock(tx, header.Hash) && (header.Height < pruneHeight || snapshotBase != nil)
+	}
+
+	children := make(map[string][]*BlockHeader)
+	var stack []*BlockHeader
+
+	c := headers.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		header, err := DeserializeBlockHeader(v)
+		if err != nil {
+			return nil, err
+		}
+
+		isRoot := len(header.PrevBlockHash) == 0 && header.Height == 0
+		if isRoot || bytes.Equal(header.Hash, snapshotBase) {
+			if valid(header) {
+				stack = append(stack, header)
+			}
+			continue
+		}
+
+		children[string(header.PrevBlockHash)] = append(children[string(header.PrevBlockHash)], header)
+	}
+
+	var best *BlockHeader
+	for len(stack) > 0 {
+		header := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if best == nil || header.Height > best.Height || header.Height == best.Height && bytes.Equal(header.Hash, preferred) {
+			best = header
+		}
+
+		for _, child := range children[string(header.Hash)] {
+			if child.Height == header.Height+1 && valid(child) {
+				stack = append(stack, child)
+			}
+		}
+	}
+
+	return best, nil
+}
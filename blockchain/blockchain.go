@@ -6,20 +6,36 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"log"
 	"os"
-
-	"go.etcd.io/bbolt"
+	"tchain/storage"
+	"tchain/wallet"
 )
 
 const DB_FILE = "blockchain_%s.db"
 const BLOCKS_BUCKET = "blocks"
 const GENESIS_COINBASE_DATA = "Blockchain Research Group"
 
+// ErrChainNotFound 节点还没有创建区块链
+var ErrChainNotFound = errors.New("No existing blockchain found. Create one first.")
+
+// ErrChainExists 创建区块链时节点已经有区块链
+var ErrChainExists = errors.New("Blockchain already exists.")
+
+// ErrBlockNotFound 区块和区块头都不存在
+var ErrBlockNotFound = errors.New("Block is not found.")
+
+// ErrTxNotFound 链中没有找到交易
+var ErrTxNotFound = errors.New("Transaction is not found")
+
+// ErrInvalidTransaction 交易引用的输出不存在或者已被花费、金额不正确或者签名无效
+var ErrInvalidTransaction = errors.New("Invalid transaction")
+
 // Blockchain 保存一系列区块
 type Blockchain struct {
-	tip []byte
-	DB  *bbolt.DB
+	tip       []byte
+	DB        storage.DB
+	blocks    storage.FlatFiles // 区块内容保存在区块文件中，DB 中保存区块的索引
+	utxoCache *UTXOCache        // 为 nil 时 UTXO 集直接读写 chainstate
 }
 
 // dbExists 检查数据库是否存在
@@ -31,187 +47,256 @@ func dbExists(dbFile string) bool {
 	return true
 }
 
-// NewBlockchain 创建一个有创世块的区块链
-func NewBlockchain(nodeID string) *Blockchain {
+// NewBlockchain 打开节点已有的区块链，还没有创建时返回 ErrChainNotFound
+func NewBlockchain(nodeID string) (*Blockchain, error) {
 	dbFile := fmt.Sprintf(DB_FILE, nodeID)
 	if dbExists(dbFile) == false {
-		fmt.Println("No existing blockchain found. Create one first.")
-		os.Exit(1)
+		return nil, ErrChainNotFound
 	}
 
-	var tip []byte
-	db, err := bbolt.Open(dbFile, 0600, nil)
+	db, err := storage.OpenBolt(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := openBlockFiles(nodeID)
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
+	bc, err := NewBlockchainWithDB(db, files)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// NewBlockchainWithDB 使用已经打开的数据库和区块文件创建区块链，数据库中需要已经有区块链
+// 旧版本的数据库会先升级到当前版本，数据库版本比程序更新时返回 ErrSchemaTooNew
+func NewBlockchainWithDB(db storage.DB, files storage.FlatFiles) (*Blockchain, error) {
+	var tip []byte
+
+	err := db.View(func(tx storage.Tx) error {
 		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		tip = b.Get([]byte("l"))
+		if b == nil {
+			return ErrChainNotFound
+		}
+
+		// 数据库返回的值只在事务内有效，需要复制出来
+		tip = append([]byte{}, b.Get([]byte("l"))...)
 
 		return nil
 	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, DB: db, blocks: files}
 
-	return &bc
+	err = bc.migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &bc, nil
 }
 
-// AddBlock 将块保存到区块链中
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.DB.Update(func(tx *bbolt.Tx) error {
+// AddBlock 保存不连接在 tip 上的区块：同步时乱序到达的区块，或者其他分支上的区块
+// 区块只写入区块文件、索引、区块头和过滤器，不修改 tip，之后由 ConnectBestChain 验证并按顺序连接
+func (bc *Blockchain) AddBlock(block *Block) error {
+	err := checkBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return bc.DB.Update(func(tx storage.Tx) error {
 		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		blockInDB := b.Get(block.Hash)
 
-		if blockInDB != nil {
+		// 已被裁剪的区块不再重新保存
+		if hasBlock(tx, block.Hash) || block.Height < getPruneValue(b, PRUNE_HEIGHT_KEY) {
 			return nil
 		}
 
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
-		if err != nil {
-			log.Panic(err)
+		// 前一个区块还没有收到时无法检查高度，连接时 ConnectBlock 会再次检查
+		parent, err := getHeader(tx, block.PrevBlockHash)
+		if err != nil && err != ErrHeaderNotFound {
+			return err
+		}
+		if parent != nil && block.Height != parent.Height+1 {
+			return fmt.Errorf("%w: block %x has height %d, but its previous block has height %d", ErrInvalidBlock, block.Hash, block.Height, parent.Height)
 		}
 
-		lastHash := b.Get([]byte("l"))
-		lastBlockData := b.Get(lastHash)
-		lastBlock := DeserializeBlock(lastBlockData)
+		err = bc.putBlock(tx, block)
+		if err != nil {
+			return err
+		}
 
-		if block.Height > lastBlock.Height {
-			err = b.Put([]byte("l"), block.Hash)
-			if err != nil {
-				log.Panic(err)
-			}
-			bc.tip = block.Hash
+		err = putCFilter(tx, block)
+		if err != nil {
+			return err
 		}
 
-		return nil
+		return putHeader(tx, block)
 	})
-	if err != nil {
-		log.Panic(err)
-	}
 }
 
-// MineBlock 使用提供的交易挖掘一个新块
-func (bc *Blockchain) MineBlock(transactions []*Transaction) *Block {
+// MineBlock 使用提供的交易挖掘一个新块，并通过 ConnectBlock 把它连接到链上，调用方不需要再更新 UTXO 集
+// 快照验证失败后 chainstate 不可信，返回 ErrSnapshotInvalid
+func (bc *Blockchain) MineBlock(transactions []*Transaction) (*Block, error) {
 	var lastHash []byte
 	var lastHeight int
 
+	err := bc.CheckChainstate()
+	if err != nil {
+		return nil, err
+	}
+
 	// 在一笔交易被放入一个块之前进行验证：
 	for _, tx := range transactions {
-		if bc.VerifyTransaction(tx) != true {
-			log.Panic("ERROR: Invalid transaction")
+		err := bc.VerifyTransaction(tx)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// BboltDB 只读事务
+	// 数据库只读事务
 	// 从数据库中获取最后一个块的哈希，然后用它来挖出一个新的块的哈希
-	err := bc.DB.View(func(tx *bbolt.Tx) error {
+	err = bc.DB.View(func(tx storage.Tx) error {
 		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		lastHash = b.Get([]byte("l"))
+		lastHash = append([]byte{}, b.Get([]byte("l"))...)
 
-		blockData := b.Get(lastHash)
-		block := DeserializeBlock(blockData)
-
-		lastHeight = block.Height
+		lastHeader, err := getHeader(tx, lastHash)
+		if err != nil {
+			return err
+		}
+		lastHeight = lastHeader.Height
 
 		return nil
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	newBlock := NewBlock(transactions, lastHash, lastHeight+1)
 
-	// BboltDB 读写事物
-	// 向数据库写入最后一个块的哈希
-	err = bc.DB.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
-		if err != nil {
-			log.Panic(err)
-		}
-
-		err = b.Put([]byte("l"), newBlock.Hash)
-		if err != nil {
-			log.Panic(err)
-		}
-
-		bc.tip = newBlock.Hash
-
-		return nil
-	})
-
+	// 区块、tip 和 UTXO 集在同一个事务中写入
+	err = bc.ConnectBlock(newBlock)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	return newBlock
+	return newBlock, nil
 }
 
-// CreateBlockchain 获取一个地址，该地址将获得挖掘创世块的奖励
-func CreateBlockchain(address string, nodeID string) *Blockchain {
+// CreateBlockchain 获取一个地址，该地址将获得挖掘创世块的奖励，节点已经有区块链时返回 ErrChainExists
+func CreateBlockchain(address string, nodeID string) (*Blockchain, error) {
 	dbFile := fmt.Sprintf(DB_FILE, nodeID)
 	if dbExists(dbFile) {
-		fmt.Println("Blockchain already exists.")
-		os.Exit(1)
+		return nil, ErrChainExists
 	}
 
-	var tip []byte
-	db, err := bbolt.Open(dbFile, 0600, nil)
+	db, err := storage.OpenBolt(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := openBlockFiles(nodeID)
 	if err != nil {
-		log.Panic(err)
+		db.Close()
+		return nil, err
 	}
 
-	err = db.Update(func(tx *bbolt.Tx) error {
-		coinbaseTX := NewCoinbaseTX(address, GENESIS_COINBASE_DATA)
-		genesis := NewGenesisBlock(coinbaseTX)
+	bc, err := CreateBlockchainWithDB(db, files, address)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return bc, nil
+}
 
+// CreateBlockchainWithDB 在空的数据库中创建区块链，创世块的奖励发送到 address
+func CreateBlockchainWithDB(db storage.DB, files storage.FlatFiles, address string) (*Blockchain, error) {
+	if !wallet.ValidateAddress(address) {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, address)
+	}
+
+	bc := Blockchain{DB: db, blocks: files}
+	coinbaseTX := NewCoinbaseTX(address, GENESIS_COINBASE_DATA)
+	genesis := NewGenesisBlock(coinbaseTX)
+
+	err := db.Update(func(tx storage.Tx) error {
 		b, err := tx.CreateBucket([]byte(BLOCKS_BUCKET))
+		if err == storage.ErrBucketExists {
+			return ErrChainExists
+		}
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		err = b.Put(genesis.Hash, genesis.Serialize())
+		err = putSchemaVersion(tx, SCHEMA_VERSION)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
-		err = b.Put([]byte("l"), genesis.Hash)
+		err = bc.putBlock(tx, genesis)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		tip = genesis.Hash
 
-		return nil
-	})
+		err = putCFilter(tx, genesis)
+		if err != nil {
+			return err
+		}
 
+		err = putHeader(tx, genesis)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("l"), genesis.Hash)
+	})
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
-	bc := Blockchain{tip, db}
+	bc.tip = genesis.Hash
 
-	return &bc
+	return &bc, nil
 }
 
 // Iterator 迭代器
 func (blockchain *Blockchain) Iterator() *BlockchainIterator {
-	return &BlockchainIterator{blockchain.tip, blockchain.DB}
+	return &BlockchainIterator{blockchain.tip, blockchain}
 }
 
 // FindUTXO 找到所有未花费的交易输出
-func (blockchain *Blockchain) FindUTXO() map[string]TXOutputs {
+func (blockchain *Blockchain) FindUTXO() (map[string]TXOutputs, error) {
+	UTXO, _, err := blockchain.findUTXOFrom(blockchain.tip)
+
+	return UTXO, err
+}
+
+// findUTXOFrom 从 hash 对应的区块开始向前遍历，找到该区块时的所有未花费输出
+// 第二个返回值表示是否一直遍历到了创世块，区块被裁剪或者缺失时为 false
+func (blockchain *Blockchain) findUTXOFrom(hash []byte) (map[string]TXOutputs, bool, error) {
 	UTXO := make(map[string]TXOutputs)
 	spentTXOs := make(map[string][]int)
-	bci := blockchain.Iterator()
+	bci := &BlockchainIterator{hash, blockchain}
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return nil, false, err
+		}
+		// 区块已被裁剪
+		if block == nil {
+			break
+		}
+
 		// 对块内的交易进行遍历
 		for _, tx := range block.Transactions {
 			txID := hex.EncodeToString(tx.ID)
@@ -232,6 +317,7 @@ func (blockchain *Blockchain) FindUTXO() map[string]TXOutputs {
 
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIndex)
 				UTXO[txID] = outs
 			}
 
@@ -248,19 +334,25 @@ func (blockchain *Blockchain) FindUTXO() map[string]TXOutputs {
 		}
 		// 遍历到创始块则终止
 		if len(block.PrevBlockHash) == 0 {
-			break
+			return UTXO, true, nil
 		}
 	}
 
-	return UTXO
+	return UTXO, false, nil
 }
 
-// FindTransaction 根据交易 ID 查找并返回交易
+// FindTransaction 根据交易 ID 查找并返回交易，没有找到时返回 ErrTxNotFound
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return Transaction{}, err
+		}
+		if block == nil {
+			break
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
@@ -273,76 +365,114 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 		}
 	}
 
-	return Transaction{}, errors.New("Transaction is not found")
+	return Transaction{}, ErrTxNotFound
 }
 
-// SignTransaction 传入一笔交易，找到它引用的交易，然后对它进行签名
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
-	prevTXs := make(map[string]Transaction)
+// SignTransaction 传入一笔交易，找到它引用的输出，然后对它进行签名
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, _, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
+	}
 
+	return tx.Sign(privKey, prevTXs)
+}
+
+// VerifyTransaction 按区块中的交易同样的规则验证一笔还没有打包的交易：引用的输出在 UTXO 集中、属于输入的公钥、
+// 没有被同一笔交易重复花费，输出的总额不超过输入，并且签名有效。不满足时返回 ErrInvalidTransaction
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	prevTXs, inputs, err := bc.findPrevTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	spent := make(map[string]bool)
 	for _, vin := range tx.VIn {
-		prevTX, err := bc.FindTransaction(vin.TxID)
-		if err != nil {
-			log.Panic(err)
+		outpoint := fmt.Sprintf("%x:%d", vin.TxID, vin.VOut)
+		if spent[outpoint] {
+			return fmt.Errorf("%w: transaction %x spends %s twice", ErrInvalidTransaction, tx.ID, outpoint)
+		}
+		spent[outpoint] = true
+
+		out := prevTXs[hex.EncodeToString(vin.TxID)].VOut[vin.VOut]
+		if !out.IsLockedWithKey(wallet.HashPubKey(vin.PubKey)) {
+			return fmt.Errorf("%w: transaction %x spends %s with the wrong key", ErrInvalidTransaction, tx.ID, outpoint)
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
-}
+	for _, out := range tx.VOut {
+		if out.Value <= 0 {
+			return fmt.Errorf("%w: transaction %x has a non-positive output", ErrInvalidTransaction, tx.ID)
+		}
+	}
+	if sumOutputs(tx.VOut) > inputs {
+		return fmt.Errorf("%w: transaction %x spends more than its inputs", ErrInvalidTransaction, tx.ID)
+	}
 
-// VerifyTransaction 传入一笔交易，找到它引用的交易，然后对它进行验证
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	if tx.IsCoinbase() {
-		return true
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w: transaction %x has an invalid signature", ErrInvalidTransaction, tx.ID)
 	}
 
+	return nil
+}
+
+// findPrevTransactions 根据 UTXO 集找到交易的输入引用的输出，同时返回这些输出的总额
+// 只需要 UTXO 集而不需要区块历史，裁剪后或者从快照启动的节点也可以签名和验证花费旧输出的交易
+func (bc *Blockchain) findPrevTransactions(tx *Transaction) (map[string]Transaction, int, error) {
+	u := UTXOSet{Blockchain: bc}
 	prevTXs := make(map[string]Transaction)
+	inputs := 0
 
 	for _, vin := range tx.VIn {
-		prevTX, err := bc.FindTransaction(vin.TxID)
+		out, found, err := u.FindOutput(vin.TxID, vin.VOut)
 		if err != nil {
-			log.Panic(err)
+			return nil, 0, err
+		}
+		if !found {
+			return nil, 0, fmt.Errorf("%w: transaction %x spends missing or spent output %x:%d", ErrInvalidTransaction, tx.ID, vin.TxID, vin.VOut)
 		}
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+
+		addPrevOutput(prevTXs, vin, out)
+		inputs += out.Value
 	}
 
-	return tx.Verify(prevTXs)
+	return prevTXs, inputs, nil
 }
 
 // GetBestHeight 返回最后一个块的高度
-func (bc *Blockchain) GetBestHeight() int {
-	var lastBlock Block
-
-	err := bc.DB.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		lastHash := b.Get([]byte("l"))
-		blockData := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockData)
-
-		return nil
-	})
+func (bc *Blockchain) GetBestHeight() (int, error) {
+	header, err := bc.GetHeader(bc.tip)
 	if err != nil {
-		log.Panic(err)
+		return 0, err
 	}
 
-	return lastBlock.Height
+	return header.Height, nil
 }
 
 // GetBlock 通过 hash 找到块k
 func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
-	err := bc.DB.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(BLOCKS_BUCKET))
+	err := bc.DB.View(func(tx storage.Tx) error {
+		data, err := bc.readBlock(tx, blockHash)
+		if err != nil {
+			return err
+		}
 
-		blockData := b.Get(blockHash)
+		if data == nil {
+			// 区块头还在，说明区块内容已经被裁剪
+			if tx.Bucket([]byte(HEADERS_BUCKET)).Get(blockHash) != nil {
+				return ErrBlockPruned
+			}
 
-		if blockData == nil {
-			return errors.New("Block is not found.")
+			return ErrBlockNotFound
 		}
 
-		block = *DeserializeBlock(blockData)
+		block = *data
 
 		return nil
 	})
@@ -353,13 +483,19 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	return block, nil
 }
 
-// GetBlockHashes 返回链中所有块的哈希列表
-func (bc *Blockchain) GetBlockHashes() [][]byte {
+// GetBlockHashes 返回链中所有块的哈希列表，被裁剪的区块不会被包含
+func (bc *Blockchain) GetBlockHashes() ([][]byte, error) {
 	var blocks [][]byte
 	bci := bc.Iterator()
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			break
+		}
 
 		blocks = append(blocks, block.Hash)
 
@@ -368,5 +504,37 @@ func (bc *Blockchain) GetBlockHashes() [][]byte {
 		}
 	}
 
-	return blocks
+	return blocks, nil
+}
+
+// GetHeadersAfter 返回主链上位于 locator 之后的区块头，按高度从低到高排列，最多返回 limit 个
+// 如果 locator 不在主链上，则从创世块开始返回
+func (bc *Blockchain) GetHeadersAfter(locator []byte, limit int) ([]*BlockHeader, error) {
+	var headers []*BlockHeader
+	hash := bc.tip
+
+	for len(hash) > 0 {
+		if len(locator) > 0 && bytes.Equal(hash, locator) {
+			break
+		}
+
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, header)
+		hash = header.PrevBlockHash
+	}
+
+	// 从 tip 开始向前遍历，需要反转成从低到高的顺序
+	for i, j := 0, len(headers)-1; i < j; i, j = i+1, j-1 {
+		headers[i], headers[j] = headers[j], headers[i]
+	}
+
+	if len(headers) > limit {
+		headers = headers[:limit]
+	}
+
+	return headers, nil
 }
@@ -1,34 +1,34 @@
 package blockchain
 
 import (
-	"log"
-
-	"go.etcd.io/bbolt"
+	"tchain/storage"
 )
 
 // BlockchainIterator 用于迭代区块链块
 type BlockchainIterator struct {
 	currentHash []byte
-	db          *bbolt.DB
+	bc          *Blockchain
 }
 
-// Next 从 tip 开始返回链中的下一个块
-func (i *BlockchainIterator) Next() *Block {
+// Next 从 tip 开始返回链中的下一个块，遇到已被裁剪的区块时返回 nil
+func (i *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
 
-	err := i.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(BLOCKS_BUCKET))
-		encodedBlock := b.Get(i.currentHash)
-		block = DeserializeBlock(encodedBlock)
+	err := i.bc.DB.View(func(tx storage.Tx) error {
+		var err error
+		block, err = i.bc.readBlock(tx, i.currentHash)
 
-		return nil
+		return err
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return nil, err
+	}
+
+	if block == nil {
+		return nil, nil
 	}
 
 	i.currentHash = block.PrevBlockHash
 
-	return block
+	return block, nil
 }
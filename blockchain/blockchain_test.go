@@ -0,0 +1,699 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"tchain/storage"
+	"tchain/wallet"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// 测试中只需要工作量证明有效，不需要真实的难度
+	targetBits = 8
+
+	os.Exit(m.Run())
+}
+
+type testChain struct {
+	bc      *Blockchain
+	utxoSet UTXOSet
+	miner   *wallet.Wallet
+}
+
+func newWallet(t *testing.T) *wallet.Wallet {
+	w, err := wallet.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return w
+}
+
+// newTestChain 在内存数据库中创建区块链，创世块的奖励发送给 miner
+func newTestChain(t *testing.T) *testChain {
+	miner := newWallet(t)
+
+	bc, err := CreateBlockchainWithDB(storage.NewMemory(), storage.NewMemoryFlatFiles(MAX_BLOCK_FILE_SIZE), string(miner.GetAddress()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.DB.Close() })
+
+	utxoSet := UTXOSet{Blockchain: bc}
+	err = utxoSet.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testChain{bc, utxoSet, miner}
+}
+
+// mine 挖出包含 txs 和一个给 miner 的 coinbase 的区块
+func (c *testChain) mine(t *testing.T, txs ...*Transaction) *Block {
+	txs = append(txs, NewCoinbaseTX(string(c.miner.GetAddress()), ""))
+
+	block, err := c.bc.MineBlock(txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return block
+}
+
+// block 构造连接在 prev 上的区块，但不连接到链上
+func (c *testChain) block(prev *Block, txs ...*Transaction) *Block {
+	txs = append(txs, NewCoinbaseTX(string(c.miner.GetAddress()), ""))
+
+	return NewBlock(txs, prev.Hash, prev.Height+1)
+}
+
+func (c *testChain) tip(t *testing.T) *Block {
+	block, err := c.bc.GetBlock(c.bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &block
+}
+
+func (c *testChain) add(t *testing.T, blocks ...*Block) {
+	for _, block := range blocks {
+		err := c.bc.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func (c *testChain) connectBest(t *testing.T) {
+	err := c.bc.ConnectBestChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *testChain) send(t *testing.T, from *wallet.Wallet, to *wallet.Wallet, amount int) *Transaction {
+	tx, err := NewUTXOTransaction(from, string(to.GetAddress()), amount, &c.utxoSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tx
+}
+
+func (c *testChain) balance(t *testing.T, w *wallet.Wallet) int {
+	UTXOs, err := c.utxoSet.FindUTXO(wallet.HashPubKey(w.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balance := 0
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	return balance
+}
+
+func (c *testChain) height(t *testing.T) int {
+	height, err := c.bc.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return height
+}
+
+func TestMineAndSend(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+
+	if got := c.balance(t, c.miner); got != subsidy {
+		t.Fatalf("miner balance %d, want %d", got, subsidy)
+	}
+
+	c.mine(t, c.send(t, c.miner, alice, 3))
+
+	if got := c.height(t); got != 1 {
+		t.Fatalf("height %d, want 1", got)
+	}
+	if got := c.balance(t, alice); got != 3 {
+		t.Fatalf("alice balance %d, want 3", got)
+	}
+	if got := c.balance(t, c.miner); got != 2*subsidy-3 {
+		t.Fatalf("miner balance %d, want %d", got, 2*subsidy-3)
+	}
+
+	_, err := NewUTXOTransaction(alice, string(c.miner.GetAddress()), 4, &c.utxoSet)
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("overspend: %v, want ErrInsufficientFunds", err)
+	}
+}
+
+func TestConnectBlockRejectsDoubleSpend(t *testing.T) {
+	c := newTestChain(t)
+	alice, bob := newWallet(t), newWallet(t)
+
+	first := c.send(t, c.miner, alice, subsidy)
+	second := c.send(t, c.miner, bob, subsidy)
+
+	tip := c.bc.Tip()
+	block := NewBlock([]*Transaction{first, second, NewCoinbaseTX(string(c.miner.GetAddress()), "")}, tip, 1)
+
+	err := c.bc.ConnectBlock(block)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("double spend: %v, want ErrInvalidBlock", err)
+	}
+
+	// 无效的区块不能留下任何修改
+	if got := c.height(t); got != 0 {
+		t.Fatalf("height %d after an invalid block", got)
+	}
+	if _, err := c.bc.GetBlock(block.Hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("invalid block was stored: %v", err)
+	}
+	if got := c.balance(t, c.miner); got != subsidy {
+		t.Fatalf("miner balance %d after an invalid block, want %d", got, subsidy)
+	}
+}
+
+func TestConnectBlockRejectsBadProofOfWork(t *testing.T) {
+	c := newTestChain(t)
+
+	block := NewBlock([]*Transaction{NewCoinbaseTX(string(c.miner.GetAddress()), "")}, c.bc.Tip(), 1)
+	block.Nonce++
+
+	err := c.bc.ConnectBlock(block)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("bad proof of work: %v, want ErrInvalidBlock", err)
+	}
+}
+
+func TestReindexMatchesIncrementalUpdates(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+
+	for i := 0; i < 3; i++ {
+		c.mine(t, c.send(t, c.miner, alice, 2))
+	}
+
+	before, err := c.utxoSet.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.utxoSet.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := c.utxoSet.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(before.Hash(), after.Hash()) || before.Transactions != after.Transactions || before.Outputs != after.Outputs || before.Size != after.Size {
+		t.Fatalf("stats after reindex %+v, before %+v", after, before)
+	}
+	if got := c.balance(t, alice); got != 6 {
+		t.Fatalf("alice balance %d, want 6", got)
+	}
+}
+
+func TestUTXOStatsHashCommitsToOutputIndex(t *testing.T) {
+	txID := []byte("transaction")
+	out := TXOutput{5, []byte("owner")}
+
+	first := newUTXOStats()
+	first.addOutputs(txID, TXOutputs{[]TXOutput{out}, []int{0}})
+
+	second := newUTXOStats()
+	second.addOutputs(txID, TXOutputs{[]TXOutput{out}, []int{1}})
+
+	if bytes.Equal(first.Hash(), second.Hash()) {
+		t.Fatal("outputs at different positions hash the same")
+	}
+
+	second.removeOutputs(txID, TXOutputs{[]TXOutput{out}, []int{1}})
+	second.addOutputs(txID, TXOutputs{[]TXOutput{out}, []int{0}})
+	if !bytes.Equal(first.Hash(), second.Hash()) {
+		t.Fatal("the same output set hashes differently")
+	}
+}
+
+func TestUTXOStatsSizeIsDeterministic(t *testing.T) {
+	txID := []byte("transaction")
+	outs := []TXOutput{{5, []byte("owner")}, {7, []byte("another owner")}}
+
+	// 两种编码的 gob 长度不同，但表示同样的输出
+	withoutIndexes := TXOutputs{Outputs: outs}.Serialize()
+	withIndexes := TXOutputs{outs, []int{0, 1}}.Serialize()
+	if len(withoutIndexes) == len(withIndexes) {
+		t.Fatal("test encodings have the same length")
+	}
+
+	first := newUTXOStats()
+	second := newUTXOStats()
+	for _, s := range []struct {
+		stats *UTXOStats
+		value []byte
+	}{{first, withoutIndexes}, {second, withIndexes}} {
+		err := s.stats.addEntry(txID, s.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := len(coinElement(txID, 0, outs[0])) + len(coinElement(txID, 1, outs[1]))
+	if first.Size != want || second.Size != want {
+		t.Fatalf("sizes %d and %d, want %d", first.Size, second.Size, want)
+	}
+
+	err := second.removeEntry(txID, withIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Size != 0 {
+		t.Fatalf("size %d after removing every entry, want 0", second.Size)
+	}
+}
+
+func TestOwnerQueriesWithUTXOCache(t *testing.T) {
+	c := newTestChain(t)
+	c.bc.EnableUTXOCache(DEFAULT_UTXO_CACHE_SIZE, 100)
+	alice := newWallet(t)
+
+	stored, err := c.utxoSet.storedTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.mine(t, c.send(t, c.miner, alice, 3))
+	c.mine(t, c.send(t, alice, c.miner, 1))
+
+	if got := c.balance(t, alice); got != 2 {
+		t.Fatalf("alice balance %d, want 2", got)
+	}
+	if got := c.balance(t, c.miner); got != 3*subsidy-2 {
+		t.Fatalf("miner balance %d, want %d", got, 3*subsidy-2)
+	}
+
+	// 查询不能把缓存写入 chainstate
+	tip, err := c.utxoSet.storedTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tip, stored) {
+		t.Fatal("owner queries flushed the UTXO cache")
+	}
+
+	err = c.bc.FlushUTXOCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.balance(t, alice); got != 2 {
+		t.Fatalf("alice balance %d after flush, want 2", got)
+	}
+}
+
+func TestHashUTXOsCommitsToOutputIndex(t *testing.T) {
+	out := TXOutput{5, []byte("owner")}
+
+	first := HashUTXOs(map[string]TXOutputs{"00": {[]TXOutput{out}, []int{0}}})
+	second := HashUTXOs(map[string]TXOutputs{"00": {[]TXOutput{out}, []int{1}}})
+
+	if bytes.Equal(first, second) {
+		t.Fatal("outputs at different positions hash the same")
+	}
+}
+
+func TestRebuildBlockIndexSkipsInvalidBlocks(t *testing.T) {
+	c := newTestChain(t)
+	c.mine(t)
+	tip := c.mine(t)
+
+	coinbase := func() *Transaction {
+		return NewCoinbaseTX(string(c.miner.GetAddress()), "")
+	}
+
+	// 高度不接着前一个区块
+	wrongHeight := NewBlock([]*Transaction{coinbase()}, tip.Hash, tip.Height+5)
+	// 违反 checkBlock 的区块
+	twoCoinbases := NewBlock([]*Transaction{coinbase(), coinbase()}, tip.Hash, tip.Height+1)
+	// 工作量证明无效
+	badProofOfWork := NewBlock([]*Transaction{coinbase()}, tip.Hash, tip.Height+1)
+	badProofOfWork.Nonce++
+	// 前一个区块不存在
+	orphan := NewBlock([]*Transaction{coinbase()}, []byte("missing"), tip.Height+3)
+
+	for _, block := range []*Block{wrongHeight, twoCoinbases, badProofOfWork, orphan} {
+		_, err := c.bc.blocks.Append(block.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bc, count, err := RebuildBlockIndexWithDB(storage.NewMemory(), c.bc.blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.DB.Close()
+
+	if count != 7 {
+		t.Fatalf("%d blocks found, want 7", count)
+	}
+	if !bytes.Equal(bc.Tip(), tip.Hash) {
+		t.Fatalf("tip %x after rebuilding, want %x", bc.Tip(), tip.Hash)
+	}
+
+	// 有效的区块仍然可以连接在 tip 上
+	valid := NewBlock([]*Transaction{coinbase()}, tip.Hash, tip.Height+1)
+	_, err = c.bc.blocks.Append(valid.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilt, _, err := RebuildBlockIndexWithDB(storage.NewMemory(), c.bc.blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rebuilt.DB.Close()
+
+	if !bytes.Equal(rebuilt.Tip(), valid.Hash) {
+		t.Fatalf("tip %x after rebuilding, want %x", rebuilt.Tip(), valid.Hash)
+	}
+}
+
+func TestOutOfOrderBlocksAreConnectedInOrder(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+
+	first := c.block(c.tip(t), c.send(t, c.miner, alice, 4))
+	second := c.block(first)
+	third := c.block(second)
+
+	c.add(t, third, second)
+	if got := c.height(t); got != 0 {
+		t.Fatalf("height %d after adding blocks without their parent", got)
+	}
+
+	c.add(t, first)
+	if got := c.height(t); got != 0 {
+		t.Fatalf("AddBlock moved the tip to height %d", got)
+	}
+
+	c.connectBest(t)
+	if !bytes.Equal(c.bc.Tip(), third.Hash) {
+		t.Fatalf("tip %x, want %x", c.bc.Tip(), third.Hash)
+	}
+	if got := c.balance(t, alice); got != 4 {
+		t.Fatalf("alice balance %d, want 4", got)
+	}
+}
+
+func TestInvalidOutOfOrderBlockIsNotConnected(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+
+	spend := c.send(t, c.miner, alice, subsidy)
+	first := c.block(c.tip(t))
+	doubleSpend := c.block(first, spend, spend)
+	after := c.block(doubleSpend)
+
+	c.add(t, after, doubleSpend, first)
+	c.connectBest(t)
+
+	if !bytes.Equal(c.bc.Tip(), first.Hash) {
+		t.Fatalf("tip %x, want %x", c.bc.Tip(), first.Hash)
+	}
+	if got := c.balance(t, alice); got != 0 {
+		t.Fatalf("alice balance %d after an invalid block, want 0", got)
+	}
+
+	// 无效的区块不会再被选中
+	c.connectBest(t)
+	if !bytes.Equal(c.bc.Tip(), first.Hash) {
+		t.Fatalf("tip %x after retrying, want %x", c.bc.Tip(), first.Hash)
+	}
+
+	err := c.bc.AddBlock(c.block(first, NewCoinbaseTX(string(alice.GetAddress()), "")))
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("block with two coinbases: %v, want ErrInvalidBlock", err)
+	}
+}
+
+func TestReorganizeToLongerBranch(t *testing.T) {
+	c := newTestChain(t)
+	alice, bob := newWallet(t), newWallet(t)
+	genesis := c.tip(t)
+
+	// 两笔交易花费同一个 coinbase，分别进入两个分支
+	toBob := c.send(t, c.miner, bob, 5)
+	toAlice := c.send(t, c.miner, alice, 3)
+	c.mine(t, toAlice)
+
+	side := c.block(genesis, toBob)
+	longer := c.block(side)
+
+	c.add(t, side, longer)
+	c.connectBest(t)
+
+	if !bytes.Equal(c.bc.Tip(), longer.Hash) {
+		t.Fatalf("tip %x, want %x", c.bc.Tip(), longer.Hash)
+	}
+	if got := c.balance(t, alice); got != 0 {
+		t.Fatalf("alice balance %d after the reorganization, want 0", got)
+	}
+	if got := c.balance(t, bob); got != 5 {
+		t.Fatalf("bob balance %d after the reorganization, want 5", got)
+	}
+}
+
+func TestInvalidBranchRestoresChain(t *testing.T) {
+	c := newTestChain(t)
+	alice, bob := newWallet(t), newWallet(t)
+	genesis := c.tip(t)
+
+	toBob := c.send(t, c.miner, bob, 5)
+	toAlice := c.send(t, c.miner, alice, 3)
+	tip := c.mine(t, toAlice)
+
+	// 分支更长，但第二个区块再次花费了 toBob 已经花费的输出
+	side := c.block(genesis, toBob)
+	invalid := c.block(side, toBob)
+
+	c.add(t, side, invalid)
+	c.connectBest(t)
+
+	if !bytes.Equal(c.bc.Tip(), tip.Hash) {
+		t.Fatalf("tip %x, want the original tip %x", c.bc.Tip(), tip.Hash)
+	}
+	if got := c.balance(t, alice); got != 3 {
+		t.Fatalf("alice balance %d after the failed reorganization, want 3", got)
+	}
+	if got := c.balance(t, bob); got != 0 {
+		t.Fatalf("bob balance %d after the failed reorganization, want 0", got)
+	}
+
+	stats, err := c.utxoSet.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.utxoSet.Reindex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reindexed, err := c.utxoSet.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stats.Hash(), reindexed.Hash()) {
+		t.Fatal("UTXO set after the failed reorganization does not match a reindex")
+	}
+}
+
+func TestSpendPrunedOutput(t *testing.T) {
+	c := newTestChain(t)
+	alice, bob := newWallet(t), newWallet(t)
+
+	funding := c.mine(t, c.send(t, c.miner, alice, 5))
+	for i := 0; i < MIN_PRUNE_DEPTH+2; i++ {
+		c.mine(t)
+	}
+
+	err := c.bc.SetPruneDepth(MIN_PRUNE_DEPTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.bc.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.bc.GetBlock(funding.Hash); !errors.Is(err, ErrBlockPruned) {
+		t.Fatalf("funding block: %v, want ErrBlockPruned", err)
+	}
+
+	// 被花费的输出所在的区块已经被裁剪，签名和验证只依赖 UTXO 集
+	tx := c.send(t, alice, bob, 5)
+	err = c.bc.VerifyTransaction(tx)
+	if err != nil {
+		t.Fatalf("spend of a pruned output: %v", err)
+	}
+
+	c.mine(t, tx)
+	if got := c.balance(t, bob); got != 5 {
+		t.Fatalf("bob balance %d, want 5", got)
+	}
+
+	// 输出被花费之后不能再次花费
+	err = c.bc.VerifyTransaction(tx)
+	if !errors.Is(err, ErrInvalidTransaction) {
+		t.Fatalf("spend of a spent output: %v, want ErrInvalidTransaction", err)
+	}
+}
+
+// loadSnapshot 把 c 的 UTXO 集作为快照加载到新的内存数据库中，hash 不为 nil 时替换快照记录的哈希
+func loadSnapshot(t *testing.T, c *testChain, hash []byte) *Blockchain {
+	snapshot, err := c.utxoSet.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != nil {
+		snapshot.Hash = hash
+	}
+
+	bc, err := LoadUTXOSnapshotWithDB(storage.NewMemory(), storage.NewMemoryFlatFiles(MAX_BLOCK_FILE_SIZE), snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bc.DB.Close() })
+
+	return bc
+}
+
+// addHistory 把 c 中从创世块到 tip 的区块保存到 bc 中
+func addHistory(t *testing.T, c *testChain, bc *Blockchain) {
+	hashes, err := c.bc.GetBlockHashes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := c.bc.GetBlock(hashes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bc.AddBlock(&block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSpendSnapshotOutput(t *testing.T) {
+	c := newTestChain(t)
+	alice, bob := newWallet(t), newWallet(t)
+	c.mine(t, c.send(t, c.miner, alice, 5))
+
+	// 快照之前的区块都还没有下载，签名和验证只依赖 UTXO 集
+	bc := loadSnapshot(t, c, nil)
+	utxoSet := UTXOSet{Blockchain: bc}
+
+	tx, err := NewUTXOTransaction(alice, string(bob.GetAddress()), 5, &utxoSet)
+	if err != nil {
+		t.Fatalf("spend of a snapshot output: %v", err)
+	}
+	err = bc.VerifyTransaction(tx)
+	if err != nil {
+		t.Fatalf("spend of a snapshot output: %v", err)
+	}
+
+	_, err = bc.MineBlock([]*Transaction{tx, NewCoinbaseTX(string(c.miner.GetAddress()), "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+	c.mine(t, c.send(t, c.miner, alice, 5))
+	c.mine(t)
+
+	bc := loadSnapshot(t, c, nil)
+
+	// 历史区块还没有下载
+	validated, err := bc.ValidateSnapshot()
+	if err != nil || validated {
+		t.Fatalf("validated %v, %v without history", validated, err)
+	}
+
+	addHistory(t, c, bc)
+
+	validated, err = bc.ValidateSnapshot()
+	if err != nil || !validated {
+		t.Fatalf("validated %v, %v with history", validated, err)
+	}
+	if base, err := bc.SnapshotBase(); err != nil || base != nil {
+		t.Fatalf("snapshot base %x, %v after validation", base, err)
+	}
+}
+
+func TestInvalidSnapshotIsRejected(t *testing.T) {
+	c := newTestChain(t)
+	c.mine(t)
+
+	bc := loadSnapshot(t, c, make([]byte, 32))
+	addHistory(t, c, bc)
+
+	_, err := bc.ValidateSnapshot()
+	if !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("mismatching snapshot: %v, want ErrSnapshotInvalid", err)
+	}
+
+	// chainstate 被标记为无效，之后不能再用它挖矿
+	if err := bc.CheckChainstate(); !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("chainstate after a failed validation: %v, want ErrSnapshotInvalid", err)
+	}
+	_, err = bc.MineBlock([]*Transaction{NewCoinbaseTX(string(c.miner.GetAddress()), "")})
+	if !errors.Is(err, ErrSnapshotInvalid) {
+		t.Fatalf("mining on an invalid chainstate: %v, want ErrSnapshotInvalid", err)
+	}
+}
+
+func TestDisconnectTipWritesTipWithChainstate(t *testing.T) {
+	c := newTestChain(t)
+	c.bc.EnableUTXOCache(DEFAULT_UTXO_CACHE_SIZE, 100)
+	alice := newWallet(t)
+
+	first := c.mine(t, c.send(t, c.miner, alice, 3))
+	c.mine(t, c.send(t, alice, c.miner, 1))
+
+	_, err := c.bc.disconnectTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开数据库时 tip 和 chainstate 都停留在 first
+	reopened, err := NewBlockchainWithDB(c.bc.DB, c.bc.blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reopened.Tip(), first.Hash) {
+		t.Fatalf("stored tip %x, want %x", reopened.Tip(), first.Hash)
+	}
+	utxoTip, err := UTXOSet{Blockchain: reopened}.storedTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(utxoTip, first.Hash) {
+		t.Fatalf("chainstate is at %x, want %x", utxoTip, first.Hash)
+	}
+
+	if got := c.balance(t, alice); got != 3 {
+		t.Fatalf("alice balance %d after disconnecting, want 3", got)
+	}
+}
@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"tchain/bloom"
+	"tchain/merkle"
+)
+
+// OutpointKey 由交易 ID 和输出索引组成的唯一标识一个交易输出的字节序列
+func OutpointKey(txID []byte, vout int) []byte {
+	key := make([]byte, len(txID)+4)
+	copy(key, txID)
+	binary.BigEndian.PutUint32(key[len(txID):], uint32(vout))
+
+	return key
+}
+
+// MatchesFilter 检查交易是否与布隆过滤器匹配
+// 交易 ID、输出的公钥哈希、输入引用的 outpoint 以及输入的公钥都会被检查，
+// 当过滤器的更新方式为 UPDATE_ALL 时，匹配的输出的 outpoint 会被加入过滤器，以便匹配之后花费它的交易
+func (tx *Transaction) MatchesFilter(filter *bloom.Filter) bool {
+	matched := filter.Matches(tx.ID)
+
+	for outIdx, out := range tx.VOut {
+		if filter.Matches(out.PubKeyHash) {
+			matched = true
+
+			if filter.Flags == bloom.UPDATE_ALL {
+				filter.Add(OutpointKey(tx.ID, outIdx))
+			}
+		}
+	}
+
+	if matched || tx.IsCoinbase() {
+		return matched
+	}
+
+	for _, in := range tx.VIn {
+		if filter.Matches(OutpointKey(in.TxID, in.VOut)) || filter.Matches(in.PubKey) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FilterBlock 返回区块中与布隆过滤器匹配的交易，以及证明这些交易被打包的部分 Merkle 树
+func (b *Block) FilterBlock(filter *bloom.Filter) (*merkle.PartialMerkleTree, []*Transaction) {
+	var leafHashes [][]byte
+	var matched []*Transaction
+	var matches []bool
+
+	for _, tx := range b.Transactions {
+		leafHashes = append(leafHashes, merkle.LeafHash(tx.Serialize()))
+
+		isMatch := tx.MatchesFilter(filter)
+		matches = append(matches, isMatch)
+		if isMatch {
+			matched = append(matched, tx)
+		}
+	}
+
+	return merkle.NewPartialMerkleTree(leafHashes, matches), matched
+}
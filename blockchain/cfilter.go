@@ -0,0 +1,173 @@
+package blockchain
+
+import (
+	"errors"
+	"tchain/gcs"
+	"tchain/storage"
+)
+
+const CFILTERS_BUCKET = "cfilters"
+const CFHEADERS_BUCKET = "cfheaders"
+
+// 单个 getCFilters 请求最多返回的过滤器数量
+const MAX_CFILTERS = 1000
+
+// CFilterElements 返回区块过滤器包含的元素：所有输出的公钥哈希，以及所有被花费的 outpoint
+func CFilterElements(block *Block) [][]byte {
+	var items [][]byte
+
+	for _, tx := range block.Transactions {
+		for _, out := range tx.VOut {
+			items = append(items, out.PubKeyHash)
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.VIn {
+			items = append(items, OutpointKey(in.TxID, in.VOut))
+		}
+	}
+
+	return items
+}
+
+// BuildCFilter 为区块构建 Golomb 编码的紧凑过滤器，使用区块哈希的前 16 字节作为密钥
+func BuildCFilter(block *Block) (*gcs.Filter, error) {
+	return gcs.NewFilter(block.Hash, CFilterElements(block))
+}
+
+// putCFilter 在写事务中保存区块的过滤器
+func putCFilter(tx storage.Tx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(CFILTERS_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	filter, err := BuildCFilter(block)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(block.Hash, filter.Bytes())
+}
+
+// GetCFilter 返回区块的过滤器，没有保存过滤器的旧区块会在第一次请求时生成
+func (bc *Blockchain) GetCFilter(blockHash []byte) (*gcs.Filter, error) {
+	var data []byte
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(CFILTERS_BUCKET))
+		if b != nil {
+			data = b.Get(blockHash)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if data != nil {
+		return gcs.FromBytes(data)
+	}
+
+	block, err := bc.GetBlock(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		return putCFilter(tx, &block)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return BuildCFilter(&block)
+}
+
+// GetCFilterHeader 返回区块的过滤器头
+// 区块同步时可能先收到子区块，因此过滤器头在请求时沿着链计算，并缓存到数据库中
+func (bc *Blockchain) GetCFilterHeader(blockHash []byte) ([]byte, error) {
+	var header []byte
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(CFHEADERS_BUCKET))
+		if b != nil {
+			header = b.Get(blockHash)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if header != nil {
+		return header, nil
+	}
+
+	blockHeader, err := bc.GetHeader(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var prevHeader []byte
+	if len(blockHeader.PrevBlockHash) > 0 {
+		prevHeader, err = bc.GetCFilterHeader(blockHeader.PrevBlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter, err := bc.GetCFilter(blockHash)
+	if err != nil {
+		return nil, err
+	}
+
+	header = gcs.FilterHeader(filter.Hash(), prevHeader)
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(CFHEADERS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		return b.Put(blockHash, header)
+	})
+
+	return header, err
+}
+
+// GetBlockHashesRange 返回主链上从 startHeight 到 stopHash 的区块哈希，按高度从低到高排列
+func (bc *Blockchain) GetBlockHashesRange(startHeight int, stopHash []byte) ([][]byte, error) {
+	var hashes [][]byte
+
+	stop, err := bc.GetHeader(stopHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if startHeight < 0 || startHeight > stop.Height || stop.Height-startHeight >= MAX_CFILTERS {
+		return nil, errors.New("Invalid filter range")
+	}
+
+	hash := stop.Hash
+	for height := stop.Height; height >= startHeight; height-- {
+		hashes = append(hashes, hash)
+
+		header, err := bc.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		hash = header.PrevBlockHash
+	}
+
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+
+	return hashes, nil
+}
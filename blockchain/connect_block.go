@@ -0,0 +1,393 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"tchain/storage"
+	"tchain/wallet"
+)
+
+// ErrInvalidBlock 区块或其中的交易违反了共识规则，这样的区块无论连接在哪里都是无效的
+var ErrInvalidBlock = errors.New("Invalid block")
+
+// ConnectBlock 验证连接在 tip 上的新区块，并在同一个事务中写入区块、索引、过滤器、tip 和 UTXO 集的修改
+// 进程在任何时刻退出，数据库要么停留在连接之前，要么包含完整的区块和对应的 UTXO 集
+// 开启了缓存时 UTXO 集的修改在提交之后才进入缓存，由缓存和 utxotip 保证 chainstate 的一致
+func (bc *Blockchain) ConnectBlock(block *Block) error {
+	err := checkBlock(block)
+	if err != nil {
+		return err
+	}
+
+	// UTXO 集落后于 tip 时先更新，之后才能根据它验证交易
+	u := UTXOSet{Blockchain: bc}
+	utxoTip, err := u.Tip()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(utxoTip, bc.tip) {
+		err = u.SyncToTip()
+		if err != nil {
+			return err
+		}
+	}
+
+	cache := bc.utxoCache
+	var staged *stagedView
+	var stats *UTXOStats
+
+	if cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+
+		err = cache.load()
+		if err != nil {
+			return err
+		}
+
+		// 事务失败时缓存中的统计信息不能被修改
+		stats, err = cache.stats.clone()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(BLOCKS_BUCKET))
+		tip := b.Get([]byte("l"))
+		tipHeader, err := getHeader(tx, tip)
+		if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(block.PrevBlockHash, tip) {
+			return fmt.Errorf("Block %x does not extend the tip %x", block.Hash, tip)
+		}
+		if block.Height != tipHeader.Height+1 {
+			return fmt.Errorf("%w: block %x has height %d, expected %d", ErrInvalidBlock, block.Hash, block.Height, tipHeader.Height+1)
+		}
+
+		var view utxoView
+		if cache != nil {
+			if !bytes.Equal(cache.tip, tip) {
+				return fmt.Errorf("UTXO set is at block %x, but the tip is %x", cache.tip, tip)
+			}
+
+			staged = newStagedView(cacheTxView{cache, tx})
+			view = staged
+		} else {
+			if utxoTip := getUTXOTip(tx); utxoTip != nil && !bytes.Equal(utxoTip, tip) {
+				return fmt.Errorf("UTXO set is at block %x, but the tip is %x", utxoTip, tip)
+			}
+
+			view = bucketView{tx}
+			stats, err = getUTXOStats(tx)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = checkBlockInputs(view, block)
+		if err != nil {
+			return err
+		}
+
+		// 通过 AddBlock 提前保存过的区块不再重复写入
+		if !hasBlock(tx, block.Hash) {
+			err = bc.putBlock(tx, block)
+			if err != nil {
+				return err
+			}
+
+			err = putCFilter(tx, block)
+			if err != nil {
+				return err
+			}
+
+			err = putHeader(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.Put([]byte("l"), block.Hash)
+		if err != nil {
+			return err
+		}
+
+		undo, err := applyBlock(view, stats, block)
+		if err != nil {
+			return err
+		}
+
+		err = putUndo(tx, block.Hash, undo)
+		if err != nil {
+			return err
+		}
+
+		// 使用缓存时 utxotip 和统计信息在缓存写入 chainstate 时一起保存
+		if cache != nil {
+			return nil
+		}
+
+		err = putUTXOTip(tx, block.Hash)
+		if err != nil {
+			return err
+		}
+
+		if stats == nil {
+			return nil
+		}
+
+		return putUTXOStats(tx, stats)
+	})
+	if err != nil {
+		return err
+	}
+
+	bc.tip = append([]byte{}, block.Hash...)
+
+	if cache != nil {
+		// 区块已经提交，缓存无法更新时丢弃缓存，之后从 chainstate 和撤销数据恢复
+		err = staged.commit()
+		if err != nil {
+			cache.reset()
+			return err
+		}
+		cache.stats = stats
+		cache.tip = bc.tip
+		cache.pending++
+
+		if cache.pending >= cache.flushInterval || cache.size > cache.maxSize {
+			return cache.flush()
+		}
+	}
+
+	return nil
+}
+
+// checkBlock 检查不依赖链状态的区块规则：工作量证明（同时覆盖 Merkle 树根）、交易 ID 和 coinbase
+func checkBlock(block *Block) error {
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w: block %x has no transactions", ErrInvalidBlock, block.Hash)
+	}
+
+	if !NewProofOfWork(block).Validate() {
+		return fmt.Errorf("%w: block %x has invalid proof of work", ErrInvalidBlock, block.Hash)
+	}
+
+	coinbases := 0
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+			return fmt.Errorf("%w: transaction %x in block %x has an invalid ID", ErrInvalidBlock, tx.ID, block.Hash)
+		}
+
+		for _, out := range tx.VOut {
+			if out.Value <= 0 {
+				return fmt.Errorf("%w: transaction %x in block %x has a non-positive output", ErrInvalidBlock, tx.ID, block.Hash)
+			}
+		}
+
+		if tx.IsCoinbase() {
+			coinbases++
+
+			if sumOutputs(tx.VOut) > subsidy {
+				return fmt.Errorf("%w: coinbase %x in block %x pays more than the subsidy", ErrInvalidBlock, tx.ID, block.Hash)
+			}
+		}
+	}
+
+	if coinbases != 1 {
+		return fmt.Errorf("%w: block %x has %d coinbase transactions", ErrInvalidBlock, block.Hash, coinbases)
+	}
+
+	return nil
+}
+
+func sumOutputs(outs []TXOutput) int {
+	sum := 0
+	for _, out := range outs {
+		sum += out.Value
+	}
+
+	return sum
+}
+
+// checkBlockInputs 按顺序检查区块中的交易：输入引用的输出存在且没有被花费、属于输入的公钥、签名有效，
+// 并且输出的总额不超过输入。交易可以花费同一个区块中前面的交易的输出
+func checkBlockInputs(view utxoView, block *Block) error {
+	created := make(map[string]TXOutputs)
+	spent := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		id := string(tx.ID)
+		existing, err := view.get(tx.ID)
+		if err != nil {
+			return err
+		}
+		if _, ok := created[id]; ok || existing != nil {
+			return fmt.Errorf("%w: transaction %x in block %x already exists", ErrInvalidBlock, tx.ID, block.Hash)
+		}
+
+		outputs := TXOutputs{Outputs: tx.VOut}
+		for i := range tx.VOut {
+			outputs.Indexes = append(outputs.Indexes, i)
+		}
+
+		if tx.IsCoinbase() {
+			created[id] = outputs
+			continue
+		}
+
+		// 根据 UTXO 集构造 Verify 使用的被引用的输出
+		prevTXs := make(map[string]Transaction)
+		inputs := 0
+
+		for _, vin := range tx.VIn {
+			outpoint := fmt.Sprintf("%x:%d", vin.TxID, vin.VOut)
+			if spent[outpoint] {
+				return fmt.Errorf("%w: transaction %x in block %x double spends %s", ErrInvalidBlock, tx.ID, block.Hash, outpoint)
+			}
+			spent[outpoint] = true
+
+			outs, ok := created[string(vin.TxID)]
+			if !ok {
+				data, err := view.get(vin.TxID)
+				if err != nil {
+					return err
+				}
+				if data == nil {
+					return fmt.Errorf("%w: transaction %x in block %x spends missing output %s", ErrInvalidBlock, tx.ID, block.Hash, outpoint)
+				}
+
+				outs, err = DeserializeOutputs(data)
+				if err != nil {
+					return err
+				}
+			}
+
+			out, found := findOutput(outs, vin.VOut)
+			if !found {
+				return fmt.Errorf("%w: transaction %x in block %x spends missing output %s", ErrInvalidBlock, tx.ID, block.Hash, outpoint)
+			}
+
+			if !out.IsLockedWithKey(wallet.HashPubKey(vin.PubKey)) {
+				return fmt.Errorf("%w: transaction %x in block %x spends %s with the wrong key", ErrInvalidBlock, tx.ID, block.Hash, outpoint)
+			}
+
+			addPrevOutput(prevTXs, vin, out)
+			inputs += out.Value
+		}
+
+		if sumOutputs(tx.VOut) > inputs {
+			return fmt.Errorf("%w: transaction %x in block %x spends more than its inputs", ErrInvalidBlock, tx.ID, block.Hash)
+		}
+
+		if !tx.Verify(prevTXs) {
+			return fmt.Errorf("%w: transaction %x in block %x has an invalid signature", ErrInvalidBlock, tx.ID, block.Hash)
+		}
+
+		created[id] = outputs
+	}
+
+	return nil
+}
+
+// addPrevOutput 把输入引用的输出放到 prevTXs 中
+// Sign 和 Verify 只使用被引用的交易的 ID 和被花费的输出，所以不需要完整的交易，只根据 UTXO 集就可以构造
+func addPrevOutput(prevTXs map[string]Transaction, vin TXInput, out TXOutput) {
+	key := hex.EncodeToString(vin.TxID)
+	prevTX := prevTXs[key]
+	prevTX.ID = vin.TxID
+	for len(prevTX.VOut) <= vin.VOut {
+		prevTX.VOut = append(prevTX.VOut, TXOutput{})
+	}
+	prevTX.VOut[vin.VOut] = out
+	prevTXs[key] = prevTX
+}
+
+// findOutput 找到原交易中位置为 vout 的未花费输出
+func findOutput(outs TXOutputs, vout int) (TXOutput, bool) {
+	for i, out := range outs.Outputs {
+		if outs.Index(i) == vout {
+			return out, true
+		}
+	}
+
+	return TXOutput{}, false
+}
+
+// cacheTxView 在数据库事务中读取缓存，缓存中没有的记录从事务中读取，而不是另外打开一个事务
+type cacheTxView struct {
+	c  *UTXOCache
+	tx storage.Tx
+}
+
+func (v cacheTxView) get(txID []byte) ([]byte, error) {
+	if entry, ok := v.c.entries[string(txID)]; ok {
+		return entry.value, nil
+	}
+
+	var value []byte
+	if data := v.tx.Bucket([]byte(UTXO_BUCKET)).Get(txID); data != nil {
+		value = append([]byte{}, data...)
+	}
+
+	return value, v.c.set(txID, value, false)
+}
+
+func (v cacheTxView) put(txID, value []byte) error {
+	return v.c.put(txID, value)
+}
+
+func (v cacheTxView) delete(txID []byte) error {
+	return v.c.delete(txID)
+}
+
+// stagedView 暂存对 base 的修改，调用 commit 后才写入 base
+type stagedView struct {
+	base    utxoView
+	changes map[string][]byte
+}
+
+func newStagedView(base utxoView) *stagedView {
+	return &stagedView{base: base, changes: make(map[string][]byte)}
+}
+
+func (v *stagedView) get(txID []byte) ([]byte, error) {
+	if value, ok := v.changes[string(txID)]; ok {
+		return value, nil
+	}
+
+	return v.base.get(txID)
+}
+
+func (v *stagedView) put(txID, value []byte) error {
+	v.changes[string(txID)] = value
+
+	return nil
+}
+
+func (v *stagedView) delete(txID []byte) error {
+	v.changes[string(txID)] = nil
+
+	return nil
+}
+
+func (v *stagedView) commit() error {
+	for key, value := range v.changes {
+		var err error
+		if value == nil {
+			err = v.base.delete([]byte(key))
+		} else {
+			err = v.base.put([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,533 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"tchain/merkle"
+	"tchain/storage"
+)
+
+const HEADERS_DB_FILE = "headers_%s.db"
+const HEADERS_BUCKET = "headers"
+const WALLET_TXS_BUCKET = "wallettxs"
+
+// HeaderChain 轻节点使用的只包含区块头的链
+// 轻节点不保存完整区块和 chainstate，只保存区块头以及经过 Merkle 路径验证的钱包交易
+type HeaderChain struct {
+	tip []byte
+	DB  storage.DB
+}
+
+// NewHeaderChain 打开轻节点的区块头数据库，不存在时创建一个空的
+func NewHeaderChain(nodeID string) (*HeaderChain, error) {
+	dbFile := fmt.Sprintf(HEADERS_DB_FILE, nodeID)
+
+	db, err := storage.OpenBolt(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hc, err := NewHeaderChainWithDB(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return hc, nil
+}
+
+// NewHeaderChainWithDB 使用已经打开的数据库创建轻节点的区块头链
+func NewHeaderChainWithDB(db storage.DB) (*HeaderChain, error) {
+	var tip []byte
+
+	err := db.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(HEADERS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(WALLET_TXS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		// 数据库返回的值只在事务内有效，需要复制出来
+		if l := b.Get([]byte("l")); l != nil {
+			tip = append([]byte{}, l...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hc := HeaderChain{tip, db}
+
+	return &hc, nil
+}
+
+// Tip 返回最后一个区块头的哈希，没有任何区块头时返回 nil
+func (hc *HeaderChain) Tip() []byte {
+	return hc.tip
+}
+
+// GetBestHeight 返回最后一个区块头的高度，没有任何区块头时返回 -1
+func (hc *HeaderChain) GetBestHeight() (int, error) {
+	if hc.tip == nil {
+		return -1, nil
+	}
+
+	header, err := hc.GetHeader(hc.tip)
+	if err != nil {
+		return 0, err
+	}
+
+	return header.Height, nil
+}
+
+// GetHeader 通过 hash 找到区块头
+func (hc *HeaderChain) GetHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := hc.DB.View(func(tx storage.Tx) error {
+		var err error
+		header, err = getHeader(tx, hash)
+
+		return err
+	})
+
+	return header, err
+}
+
+// AddHeader 验证区块头的工作量证明以及与前一个区块头的链接关系，然后保存
+// 返回值表示是否是新保存的区块头
+func (hc *HeaderChain) AddHeader(header *BlockHeader) (bool, error) {
+	if !NewHeaderProofOfWork(header).Validate() {
+		return false, fmt.Errorf("%w: header %x has invalid proof of work", ErrInvalidBlock, header.Hash)
+	}
+
+	added := false
+
+	err := hc.DB.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(HEADERS_BUCKET))
+
+		if b.Get(header.Hash) != nil {
+			return nil
+		}
+
+		// 空链只接受创世块，其余区块头必须链接到已知的区块头上
+		if len(header.PrevBlockHash) == 0 {
+			if header.Height != 0 || hc.tip != nil {
+				return errors.New("Unexpected genesis header")
+			}
+		} else {
+			prev, err := getHeader(tx, header.PrevBlockHash)
+			if err == ErrHeaderNotFound {
+				return errors.New("Previous header is not found")
+			}
+			if err != nil {
+				return err
+			}
+
+			if header.Height != prev.Height+1 {
+				return fmt.Errorf("%w: header %x height does not follow its parent", ErrInvalidBlock, header.Hash)
+			}
+		}
+
+		err := b.Put(header.Hash, header.Serialize())
+		if err != nil {
+			return err
+		}
+		added = true
+
+		// 只有更高的区块头才会成为新的 tip
+		higher := hc.tip == nil
+		if !higher {
+			tipHeader, err := getHeader(tx, hc.tip)
+			if err != nil {
+				return err
+			}
+			higher = header.Height > tipHeader.Height
+		}
+
+		if higher {
+			err = b.Put([]byte("l"), header.Hash)
+			if err != nil {
+				return err
+			}
+			hc.tip = header.Hash
+		}
+
+		return nil
+	})
+
+	return added, err
+}
+
+// walletTransaction 轻节点保存的钱包交易以及交易所在的区块
+type walletTransaction struct {
+	BlockHash   []byte
+	Transaction []byte
+}
+
+// deserializeWalletTransaction 反序列化钱包交易记录以及其中的交易
+func deserializeWalletTransaction(data []byte) (walletTransaction, Transaction, error) {
+	var record walletTransaction
+
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record)
+	if err != nil {
+		return record, Transaction{}, fmt.Errorf("Failed to decode wallet transaction: %w", err)
+	}
+
+	tx, err := DeserializeTransaction(record.Transaction)
+
+	return record, tx, err
+}
+
+func (wtx walletTransaction) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(wtx)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// AddMerkleBlock 使用已保存的区块头验证部分 Merkle 树，验证通过后保存树中匹配的交易
+// 返回保存的交易数量
+func (hc *HeaderChain) AddMerkleBlock(blockHash []byte, tree *merkle.PartialMerkleTree, transactions [][]byte) (int, error) {
+	header, err := hc.GetHeader(blockHash)
+	if err != nil {
+		return 0, err
+	}
+
+	root, matched, _, err := tree.ExtractMatches()
+	if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(root, header.MerkleRoot) {
+		return 0, errors.New("Merkle root does not match the header")
+	}
+
+	matchedLeaves := make(map[string]bool)
+	for _, leaf := range matched {
+		matchedLeaves[hex.EncodeToString(leaf)] = true
+	}
+
+	// 只有叶子哈希出现在部分 Merkle 树中的交易才是被证明打包的
+	for _, txData := range transactions {
+		if !matchedLeaves[hex.EncodeToString(merkle.LeafHash(txData))] {
+			return 0, errors.New("Transaction is not proven by the merkle tree")
+		}
+	}
+
+	err = hc.DB.Update(func(dbTx storage.Tx) error {
+		b := dbTx.Bucket([]byte(WALLET_TXS_BUCKET))
+
+		for _, txData := range transactions {
+			tx, err := DeserializeTransaction(txData)
+			if err != nil {
+				return err
+			}
+
+			err = b.Put(tx.ID, walletTransaction{blockHash, txData}.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return len(transactions), err
+}
+
+// mainChain 返回从 tip 到创世块的所有区块头哈希
+func (hc *HeaderChain) mainChain() (map[string]bool, error) {
+	chain := make(map[string]bool)
+	hash := hc.tip
+
+	err := hc.DB.View(func(tx storage.Tx) error {
+		for len(hash) > 0 {
+			header, err := getHeader(tx, hash)
+			if err == ErrHeaderNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			chain[hex.EncodeToString(hash)] = true
+			hash = header.PrevBlockHash
+		}
+
+		return nil
+	})
+
+	return chain, err
+}
+
+// FindUTXO 根据已验证的钱包交易计算公钥哈希的 UTXO
+// 只有主链上的交易会被计入，分叉链上的交易会被忽略
+func (hc *HeaderChain) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
+	var UTXOs []TXOutput
+	var txs []Transaction
+	spentTXOs := make(map[string][]int)
+
+	chain, err := hc.mainChain()
+	if err != nil {
+		return nil, err
+	}
+
+	err = hc.DB.View(func(dbTx storage.Tx) error {
+		b := dbTx.Bucket([]byte(WALLET_TXS_BUCKET))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			record, tx, err := deserializeWalletTransaction(v)
+			if err != nil {
+				return err
+			}
+
+			if !chain[hex.EncodeToString(record.BlockHash)] {
+				continue
+			}
+
+			txs = append(txs, tx)
+
+			if tx.IsCoinbase() {
+				continue
+			}
+
+			for _, in := range tx.VIn {
+				inTxID := hex.EncodeToString(in.TxID)
+				spentTXOs[inTxID] = append(spentTXOs[inTxID], in.VOut)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range txs {
+		txID := hex.EncodeToString(tx.ID)
+
+	Outputs:
+		for outIdx, out := range tx.VOut {
+			for _, spentOut := range spentTXOs[txID] {
+				if spentOut == outIdx {
+					continue Outputs
+				}
+			}
+
+			if out.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, out)
+			}
+		}
+	}
+
+	return UTXOs, nil
+}
+
+// GetMainChainHash 返回主链上指定高度的区块头哈希，不存在时返回 nil
+func (hc *HeaderChain) GetMainChainHash(height int) ([]byte, error) {
+	var result []byte
+	hash := hc.tip
+
+	err := hc.DB.View(func(tx storage.Tx) error {
+		for len(hash) > 0 {
+			header, err := getHeader(tx, hash)
+			if err == ErrHeaderNotFound {
+				break
+			}
+			if err != nil {
+				return err
+			}
+
+			if header.Height == height {
+				result = header.Hash
+				break
+			}
+			if header.Height < height {
+				break
+			}
+
+			hash = header.PrevBlockHash
+		}
+
+		return nil
+	})
+
+	return result, err
+}
+
+// PutCFilter 保存从全节点收到的紧凑过滤器，以及全节点声明的过滤器头
+func (hc *HeaderChain) PutCFilter(blockHash []byte, filter []byte, filterHeader []byte) error {
+	return hc.DB.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(CFILTERS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		err = b.Put(blockHash, filter)
+		if err != nil {
+			return err
+		}
+
+		b, err = tx.CreateBucketIfNotExists([]byte(CFHEADERS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		return b.Put(blockHash, filterHeader)
+	})
+}
+
+// GetCFilter 返回保存的紧凑过滤器和过滤器头，不存在时返回 nil
+func (hc *HeaderChain) GetCFilter(blockHash []byte) ([]byte, []byte, error) {
+	var filter, filterHeader []byte
+
+	err := hc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(CFILTERS_BUCKET))
+		if b != nil {
+			if data := b.Get(blockHash); data != nil {
+				filter = append([]byte{}, data...)
+			}
+		}
+
+		b = tx.Bucket([]byte(CFHEADERS_BUCKET))
+		if b != nil {
+			if data := b.Get(blockHash); data != nil {
+				filterHeader = append([]byte{}, data...)
+			}
+		}
+
+		return nil
+	})
+
+	return filter, filterHeader, err
+}
+
+// GetCFilterTip 返回最后一个已验证并匹配过的过滤器对应的区块哈希
+func (hc *HeaderChain) GetCFilterTip() ([]byte, error) {
+	var hash []byte
+
+	err := hc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(HEADERS_BUCKET))
+		if data := b.Get([]byte("cf")); data != nil {
+			hash = append([]byte{}, data...)
+		}
+
+		return nil
+	})
+
+	return hash, err
+}
+
+// SetCFilterTip 记录最后一个已验证并匹配过的过滤器对应的区块哈希
+func (hc *HeaderChain) SetCFilterTip(blockHash []byte) error {
+	return hc.DB.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(HEADERS_BUCKET))
+
+		return b.Put([]byte("cf"), blockHash)
+	})
+}
+
+// AddWalletBlock 验证完整区块与本地区块头一致后，保存其中与公钥哈希相关的交易
+// 返回保存的交易数量
+func (hc *HeaderChain) AddWalletBlock(block *Block, pubKeyHashes [][]byte) (int, error) {
+	header, err := hc.GetHeader(block.Hash)
+	if err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(block.HashTransactions(), header.MerkleRoot) {
+		return 0, errors.New("Block transactions do not match the header")
+	}
+
+	count := 0
+
+	err = hc.DB.Update(func(dbTx storage.Tx) error {
+		b := dbTx.Bucket([]byte(WALLET_TXS_BUCKET))
+
+		for _, tx := range block.Transactions {
+			if !involvesKeys(tx, pubKeyHashes) {
+				continue
+			}
+
+			err := b.Put(tx.ID, walletTransaction{block.Hash, tx.Serialize()}.Serialize())
+			if err != nil {
+				return err
+			}
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// WalletOutpoints 返回已保存的钱包交易中锁定到给定公钥哈希的所有 outpoint，用于匹配花费它们的交易
+func (hc *HeaderChain) WalletOutpoints(pubKeyHashes [][]byte) ([][]byte, error) {
+	var outpoints [][]byte
+
+	err := hc.DB.View(func(dbTx storage.Tx) error {
+		b := dbTx.Bucket([]byte(WALLET_TXS_BUCKET))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			_, tx, err := deserializeWalletTransaction(v)
+			if err != nil {
+				return err
+			}
+
+			for outIdx, out := range tx.VOut {
+				for _, pubKeyHash := range pubKeyHashes {
+					if out.IsLockedWithKey(pubKeyHash) {
+						outpoints = append(outpoints, OutpointKey(tx.ID, outIdx))
+						break
+					}
+				}
+			}
+		}
+
+		return nil
+	})
+
+	return outpoints, err
+}
+
+// involvesKeys 检查交易的输出是否锁定到给定的公钥哈希，或者交易的输入是否使用了给定的公钥
+func involvesKeys(tx *Transaction, pubKeyHashes [][]byte) bool {
+	for _, pubKeyHash := range pubKeyHashes {
+		for _, out := range tx.VOut {
+			if out.IsLockedWithKey(pubKeyHash) {
+				return true
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.VIn {
+			if in.UsesKey(pubKeyHash) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"tchain/common"
+	"tchain/storage"
+)
+
+// 数据库的元数据，目前只有 schema 版本
+const META_BUCKET = "meta"
+const SCHEMA_VERSION_KEY = "version"
+
+// ErrSchemaTooNew 数据库由更新版本的程序创建，当前程序无法读取
+var ErrSchemaTooNew = errors.New("Database schema is newer than this binary supports")
+
+// migration 把数据库升级到下一个版本
+type migration struct {
+	description string
+	migrate     func(bc *Blockchain, tx storage.Tx) error
+}
+
+// migrations 按顺序排列的迁移，第 i 个迁移把数据库从版本 i 升级到版本 i+1
+// 修改 bucket 的结构或者序列化格式时在末尾追加新的迁移，已经发布的迁移不能修改、删除或者调整顺序
+// 没有版本标记的数据库为版本 0，它可能来自任意一个旧版本，所以这些迁移需要能够处理已经完成的部分
+var migrations = []migration{
+	{"Move block contents into block files", (*Blockchain).moveBlocksToFiles},
+	{"Store block headers separately", (*Blockchain).putAllHeaders},
+	{"Build the per-owner UTXO index", func(bc *Blockchain, tx storage.Tx) error {
+		return migrateOwnerIndex(tx)
+	}},
+	{"Recompute UTXO set statistics with deterministic sizes", func(bc *Blockchain, tx storage.Tx) error {
+		// 删除后下次读取统计信息时重新计算
+		err := tx.DeleteBucket([]byte(UTXO_STATS_BUCKET))
+		if err == storage.ErrBucketNotFound {
+			return nil
+		}
+
+		return err
+	}},
+}
+
+// SCHEMA_VERSION 当前程序使用的数据库版本
+var SCHEMA_VERSION = len(migrations)
+
+func getSchemaVersion(tx storage.Tx) int {
+	b := tx.Bucket([]byte(META_BUCKET))
+	if b == nil {
+		return 0
+	}
+
+	data := b.Get([]byte(SCHEMA_VERSION_KEY))
+	if data == nil {
+		return 0
+	}
+
+	return int(common.HexToInt(data))
+}
+
+func putSchemaVersion(tx storage.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(META_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(SCHEMA_VERSION_KEY), common.IntToHex(int64(version)))
+}
+
+func schemaTooNewError(version int) error {
+	return fmt.Errorf("%w: database version %d, supported version %d. Please upgrade tchain.", ErrSchemaTooNew, version, SCHEMA_VERSION)
+}
+
+// migrate 依次执行数据库还没有执行过的迁移，每个迁移和更新后的版本在同一个事务中提交，
+// 中途失败时数据库停留在上一个完成的版本，下次打开时从那里继续
+func (bc *Blockchain) migrate() error {
+	var version int
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		version = getSchemaVersion(tx)
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if version > SCHEMA_VERSION {
+		return schemaTooNewError(version)
+	}
+
+	for ; version < SCHEMA_VERSION; version++ {
+		m := migrations[version]
+		fmt.Printf("Upgrading database to version %d: %s\n", version+1, m.description)
+
+		err = bc.DB.Update(func(tx storage.Tx) error {
+			err := m.migrate(bc, tx)
+			if err != nil {
+				return err
+			}
+
+			return putSchemaVersion(tx, version+1)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to upgrade database to version %d: %w", version+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"tchain/storage"
+	"testing"
+)
+
+// baselineDB 按最早版本的布局创建内存数据库：没有 meta bucket，区块内容保存在 blocks bucket 中，
+// chainstate 中只有未花费输出，没有区块头、区块索引和地址索引
+func baselineDB(t *testing.T, c *testChain) storage.DB {
+	utxos, err := c.bc.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blocks []*Block
+	bci := c.bc.Iterator()
+	for {
+		block, err := bci.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+	}
+
+	db := storage.NewMemory()
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucket([]byte(BLOCKS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		for _, block := range blocks {
+			err = b.Put(block.Hash, block.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.Put([]byte("l"), c.bc.Tip())
+		if err != nil {
+			return err
+		}
+
+		chainstate, err := tx.CreateBucket([]byte(UTXO_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		for txID, outs := range utxos {
+			key, err := hex.DecodeString(txID)
+			if err != nil {
+				return err
+			}
+
+			err = chainstate.Put(key, outs.Serialize())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+	c.mine(t, c.send(t, c.miner, alice, 3))
+	c.mine(t, c.send(t, alice, c.miner, 1))
+
+	db := baselineDB(t, c)
+	bc, err := NewBlockchainWithDB(db, storage.NewMemoryFlatFiles(MAX_BLOCK_FILE_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx storage.Tx) error {
+		if version := getSchemaVersion(tx); version != SCHEMA_VERSION {
+			t.Fatalf("schema version %d after migrating, want %d", version, SCHEMA_VERSION)
+		}
+
+		// 区块内容已经移到区块文件中
+		c := tx.Bucket([]byte(BLOCKS_BUCKET)).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) == 32 {
+				t.Fatalf("block %x is still in the blocks bucket", k)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrated := &testChain{bc, UTXOSet{Blockchain: bc}, c.miner}
+	if !bytes.Equal(bc.Tip(), c.bc.Tip()) {
+		t.Fatalf("tip %x after migrating, want %x", bc.Tip(), c.bc.Tip())
+	}
+	if got := migrated.height(t); got != 2 {
+		t.Fatalf("height %d after migrating, want 2", got)
+	}
+
+	// 区块、区块头和 UTXO 集都与升级之前的链一致
+	result, err := bc.VerifyChain(0, VERIFY_LEVEL_UTXO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Issues) > 0 || !result.UTXOChecked {
+		t.Fatalf("migrated chain has issues %v", result.Issues)
+	}
+
+	// 地址索引已经建立
+	if got := migrated.balance(t, alice); got != 2 {
+		t.Fatalf("alice balance %d after migrating, want 2", got)
+	}
+	if got, want := migrated.balance(t, c.miner), c.balance(t, c.miner); got != want {
+		t.Fatalf("miner balance %d after migrating, want %d", got, want)
+	}
+
+	// 升级后的链可以继续挖矿
+	migrated.mine(t, migrated.send(t, alice, c.miner, 1))
+	if got := migrated.balance(t, alice); got != 1 {
+		t.Fatalf("alice balance %d after spending, want 1", got)
+	}
+}
+
+func TestSchemaTooNewIsRejected(t *testing.T) {
+	c := newTestChain(t)
+
+	err := c.bc.DB.Update(func(tx storage.Tx) error {
+		return putSchemaVersion(tx, SCHEMA_VERSION+1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewBlockchainWithDB(c.bc.DB, c.bc.blocks)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("opening a newer database returned %v, want ErrSchemaTooNew", err)
+	}
+
+	// 数据库没有被降级
+	err = c.bc.DB.View(func(tx storage.Tx) error {
+		if version := getSchemaVersion(tx); version != SCHEMA_VERSION+1 {
+			t.Fatalf("schema version %d after opening, want %d", version, SCHEMA_VERSION+1)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -10,23 +10,30 @@ import (
 )
 
 // 难度值，表示哈希的前 24 位必须是 0
-const targetBits = 24
+// 不是常量，测试中可以降低难度以便快速挖矿
+var targetBits = 24
 
 // 最大块
 const maxNonce = math.MaxInt64
 
 type ProofOfWork struct {
-	block  *Block
+	header *BlockHeader
 	target *big.Int
 }
 
-// NewProofOfWork 将 target 初始化为 1 的大整数，然后左移 256 - targetBits 位，返回 ProofOfWork
+// NewProofOfWork 返回区块的 ProofOfWork
 func NewProofOfWork(b *Block) *ProofOfWork {
+	return NewHeaderProofOfWork(b.Header())
+}
+
+// NewHeaderProofOfWork 将 target 初始化为 1 的大整数，然后左移 256 - targetBits 位，返回 ProofOfWork
+// 工作量证明只依赖区块头，因此轻节点不需要完整的区块也能验证
+func NewHeaderProofOfWork(h *BlockHeader) *ProofOfWork {
 	target := big.NewInt(1)
 	target.Lsh(target, uint(256-targetBits))
 
 	pow := &ProofOfWork{
-		block:  b,
+		header: h,
 		target: target,
 	}
 
@@ -37,9 +44,9 @@ func NewProofOfWork(b *Block) *ProofOfWork {
 func (pow *ProofOfWork) prepareData(nonce int) []byte {
 	data := bytes.Join(
 		[][]byte{
-			pow.block.PrevBlockHash,
-			pow.block.HashTransactions(),
-			common.IntToHex(pow.block.Timestamp),
+			pow.header.PrevBlockHash,
+			pow.header.MerkleRoot,
+			common.IntToHex(pow.header.Timestamp),
 			common.IntToHex(int64(targetBits)),
 			common.IntToHex(int64(nonce)),
 		},
@@ -80,15 +87,15 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 	return nonce, hash[:]
 }
 
-// Validate 验证哈希是否为小于目标的有效哈希
+// Validate 验证哈希是否为小于目标的有效哈希，并且与区块头中记录的哈希一致
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.block.Nonce)
+	data := pow.prepareData(pow.header.Nonce)
 	hash := sha256.Sum256(data)
 	hashInt.SetBytes(hash[:])
 
-	isValid := hashInt.Cmp(pow.target) == -1
+	isValid := hashInt.Cmp(pow.target) == -1 && bytes.Equal(hash[:], pow.header.Hash)
 
 	return isValid
 }
@@ -0,0 +1,226 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"tchain/common"
+	"tchain/storage"
+)
+
+// 裁剪模式下至少保留的区块数量
+const MIN_PRUNE_DEPTH = 10
+
+// 裁剪深度和已裁剪高度保存在 blocks bucket 中，与 tip 的 "l" 放在一起
+const PRUNE_DEPTH_KEY = "prunedepth"
+const PRUNE_HEIGHT_KEY = "pruneheight"
+
+// ErrBlockPruned 区块头存在，但区块内容已经被裁剪
+var ErrBlockPruned = errors.New("Block is pruned.")
+
+// ErrHeaderNotFound 区块头不存在
+var ErrHeaderNotFound = errors.New("Header is not found.")
+
+// putHeader 单独保存区块头，区块内容被裁剪后仍然可以通过区块头遍历整条链
+func putHeader(tx storage.Tx, block *Block) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(HEADERS_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(block.Hash, block.Header().Serialize())
+}
+
+// putAllHeaders 为旧版本创建的数据库补全区块头
+func (bc *Blockchain) putAllHeaders(tx storage.Tx) error {
+	if tx.Bucket([]byte(HEADERS_BUCKET)) != nil {
+		return nil
+	}
+
+	hash := bc.tip
+
+	for len(hash) > 0 {
+		block, err := bc.readBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		err = putHeader(tx, block)
+		if err != nil {
+			return err
+		}
+
+		hash = block.PrevBlockHash
+	}
+
+	return nil
+}
+
+// getHeader 在事务中读取区块头，不存在时返回 ErrHeaderNotFound
+func getHeader(tx storage.Tx, hash []byte) (*BlockHeader, error) {
+	data := tx.Bucket([]byte(HEADERS_BUCKET)).Get(hash)
+	if data == nil {
+		return nil, ErrHeaderNotFound
+	}
+
+	return DeserializeBlockHeader(data)
+}
+
+// Tip 返回最后一个块的哈希
+func (bc *Blockchain) Tip() []byte {
+	return bc.tip
+}
+
+// GetHeader 通过 hash 找到区块头，区块被裁剪后区块头仍然保留
+func (bc *Blockchain) GetHeader(hash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		var err error
+		header, err = getHeader(tx, hash)
+
+		return err
+	})
+
+	return header, err
+}
+
+// PruneDepth 返回配置的裁剪深度，0 表示不裁剪
+func (bc *Blockchain) PruneDepth() (int, error) {
+	return bc.getPruneValue(PRUNE_DEPTH_KEY)
+}
+
+// PruneHeight 返回本地保存了完整区块的最低高度，低于该高度的区块内容已经被裁剪
+func (bc *Blockchain) PruneHeight() (int, error) {
+	return bc.getPruneValue(PRUNE_HEIGHT_KEY)
+}
+
+func (bc *Blockchain) getPruneValue(key string) (int, error) {
+	value := 0
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		value = getPruneValue(tx.Bucket([]byte(BLOCKS_BUCKET)), key)
+
+		return nil
+	})
+
+	return value, err
+}
+
+func getPruneValue(b storage.Bucket, key string) int {
+	data := b.Get([]byte(key))
+	if data == nil {
+		return 0
+	}
+
+	return int(common.HexToInt(data))
+}
+
+// SetPruneDepth 开启裁剪模式，只保留最近 depth 个区块的完整内容
+// 裁剪过的区块无法恢复，所以裁剪模式开启后不能关闭
+func (bc *Blockchain) SetPruneDepth(depth int) error {
+	if depth < MIN_PRUNE_DEPTH {
+		return fmt.Errorf("Prune depth must be at least %d", MIN_PRUNE_DEPTH)
+	}
+
+	return bc.DB.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(BLOCKS_BUCKET))
+
+		return b.Put([]byte(PRUNE_DEPTH_KEY), common.IntToHex(int64(depth)))
+	})
+}
+
+// Prune 删除主链上超过裁剪深度的区块内容和撤销数据，区块头、过滤器和 chainstate 都会保留
+// 只从 tip 向前遍历到上次裁剪的高度，开销与新增的区块数量有关，而与链的长度无关
+// 区块文件中的所有区块都被裁剪后删除整个文件，返回本次删除的区块数量
+func (bc *Blockchain) Prune() (int, error) {
+	var depth, bestHeight, prunedHeight int
+	var snapshotBase []byte
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(BLOCKS_BUCKET))
+		depth = getPruneValue(b, PRUNE_DEPTH_KEY)
+		prunedHeight = getPruneValue(b, PRUNE_HEIGHT_KEY)
+		snapshotBase = b.Get([]byte(SNAPSHOT_BASE_KEY))
+
+		tipHeader, err := getHeader(tx, bc.tip)
+		if err != nil {
+			return err
+		}
+		bestHeight = tipHeader.Height
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 快照还没有验证时需要保留历史区块
+	if depth == 0 || snapshotBase != nil {
+		return 0, nil
+	}
+
+	pruneHeight := bestHeight - depth + 1
+	if pruneHeight <= prunedHeight {
+		return 0, nil
+	}
+
+	pruned := 0
+	var removedFiles []int
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		blocks := tx.Bucket([]byte(BLOCKS_BUCKET))
+		index := tx.Bucket([]byte(BLOCK_INDEX_BUCKET))
+		undos := tx.Bucket([]byte(UNDO_BUCKET))
+		hash := bc.tip
+
+		for len(hash) > 0 {
+			header, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+
+			// 更低的区块在之前的裁剪中已经删除
+			if header.Height < prunedHeight {
+				break
+			}
+
+			if header.Height < pruneHeight && hasBlock(tx, hash) {
+				err := index.Delete(hash)
+				if err != nil {
+					return err
+				}
+				pruned++
+			}
+
+			if header.Height < pruneHeight && undos != nil {
+				err := undos.Delete(hash)
+				if err != nil {
+					return err
+				}
+			}
+
+			hash = header.PrevBlockHash
+		}
+
+		var err error
+		removedFiles, err = pruneBlockFiles(tx, pruneHeight)
+		if err != nil {
+			return err
+		}
+
+		return blocks.Put([]byte(PRUNE_HEIGHT_KEY), common.IntToHex(int64(pruneHeight)))
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 索引提交之后再删除文件，事务失败时文件仍然可用
+	for _, file := range removedFiles {
+		err = bc.blocks.Remove(file)
+		if err != nil {
+			return pruned, err
+		}
+	}
+
+	return pruned, nil
+}
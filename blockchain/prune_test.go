@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSetPruneDepthRejectsShallowDepth(t *testing.T) {
+	c := newTestChain(t)
+
+	err := c.bc.SetPruneDepth(MIN_PRUNE_DEPTH - 1)
+	if err == nil {
+		t.Fatalf("prune depth %d was accepted", MIN_PRUNE_DEPTH-1)
+	}
+
+	depth, err := c.bc.PruneDepth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth != 0 {
+		t.Fatalf("prune depth %d after the rejected setting, want 0", depth)
+	}
+}
+
+func TestPruneKeepsRecentBlocks(t *testing.T) {
+	c := newTestChain(t)
+	blocks := []*Block{c.tip(t)}
+	for i := 0; i < MIN_PRUNE_DEPTH+2; i++ {
+		blocks = append(blocks, c.mine(t))
+	}
+
+	// 没有开启裁剪模式时不删除任何区块
+	pruned, err := c.bc.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 0 {
+		t.Fatalf("%d blocks pruned without a prune depth", pruned)
+	}
+
+	full, err := c.bc.HasFullHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full {
+		t.Fatal("chain without pruning has no full history")
+	}
+
+	err = c.bc.SetPruneDepth(MIN_PRUNE_DEPTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 高度 0 到 12 共 13 个区块，保留最近的 10 个
+	pruned, err = c.bc.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Fatalf("%d blocks pruned, want 3", pruned)
+	}
+
+	pruneHeight, err := c.bc.PruneHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruneHeight != 3 {
+		t.Fatalf("prune height %d, want 3", pruneHeight)
+	}
+
+	for _, block := range blocks {
+		_, err := c.bc.GetBlock(block.Hash)
+		if block.Height < pruneHeight && !errors.Is(err, ErrBlockPruned) {
+			t.Fatalf("reading pruned block at height %d returned %v, want ErrBlockPruned", block.Height, err)
+		}
+		if block.Height >= pruneHeight && err != nil {
+			t.Fatalf("reading block at height %d returned %v", block.Height, err)
+		}
+
+		// 区块头仍然保留
+		_, err = c.bc.GetHeader(block.Hash)
+		if err != nil {
+			t.Fatalf("header at height %d: %v", block.Height, err)
+		}
+	}
+
+	full, err = c.bc.HasFullHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full {
+		t.Fatal("pruned chain reports a full history")
+	}
+
+	// 链没有增长时不再裁剪
+	pruned, err = c.bc.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 0 {
+		t.Fatalf("%d blocks pruned again without new blocks", pruned)
+	}
+
+	// 每个新区块只让一个旧区块超过裁剪深度
+	c.mine(t)
+	c.mine(t)
+	pruned, err = c.bc.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Fatalf("%d blocks pruned after two new blocks, want 2", pruned)
+	}
+
+	pruneHeight, err = c.bc.PruneHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruneHeight != 5 {
+		t.Fatalf("prune height %d, want 5", pruneHeight)
+	}
+
+	// 裁剪后的链不能重建 UTXO 集
+	err = c.utxoSet.Reindex()
+	if !errors.Is(err, ErrIncompleteHistory) {
+		t.Fatalf("reindexing a pruned chain returned %v, want ErrIncompleteHistory", err)
+	}
+}
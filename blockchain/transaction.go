@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -17,6 +18,9 @@ import (
 // 奖励金额
 const subsidy = 10
 
+// ErrInsufficientFunds 钱包的未花费输出不足以支付转账金额
+var ErrInsufficientFunds = errors.New("Not enough funds")
+
 // Transaction 交易ID、输入、输出构成一笔交易
 type Transaction struct {
 	ID   []byte
@@ -65,24 +69,31 @@ func (tx *Transaction) Hash() []byte {
 	return hash[:]
 }
 
-// NewUTXOTransaction 创建交易
-func NewUTXOTransaction(wlt *wallet.Wallet, to string, amount int, UTXOSet *UTXOSet) *Transaction {
+// NewUTXOTransaction 创建交易，余额不足时返回 ErrInsufficientFunds
+func NewUTXOTransaction(wlt *wallet.Wallet, to string, amount int, UTXOSet *UTXOSet) (*Transaction, error) {
 	var inputs []TXInput
 	var outputs []TXOutput
 
+	if !wallet.ValidateAddress(to) {
+		return nil, fmt.Errorf("%w: %s", wallet.ErrInvalidAddress, to)
+	}
+
 	pubKeyHash := wallet.HashPubKey(wlt.PublicKey)
 
 	// 找到足够的未花费输出
-	accumulation, validOutputs := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	accumulation, validOutputs, err := UTXOSet.FindSpendableOutputs(pubKeyHash, amount)
+	if err != nil {
+		return nil, err
+	}
 
 	if accumulation < amount {
-		log.Panic("ERROR: Not enough funds")
+		return nil, fmt.Errorf("%w: balance is %d, need %d", ErrInsufficientFunds, accumulation, amount)
 	}
 
 	for txID, outs := range validOutputs {
 		id, err := hex.DecodeString(txID)
 		if err != nil {
-			log.Panic(err)
+			return nil, err
 		}
 
 		for _, out := range outs {
@@ -110,9 +121,13 @@ func NewUTXOTransaction(wlt *wallet.Wallet, to string, amount int, UTXOSet *UTXO
 
 	tx := Transaction{nil, inputs, outputs}
 	tx.ID = tx.Hash()
-	UTXOSet.Blockchain.SignTransaction(&tx, wlt.PrivateKey)
 
-	return &tx
+	err = UTXOSet.Blockchain.SignTransaction(&tx, wlt.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tx, nil
 }
 
 // NewCoinbaseTX 创建一个 coinbase 交易
@@ -158,18 +173,28 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 	return txCopy
 }
 
+// hasPrevOutputs 检查 prevTXs 中是否包含交易的每个输入引用的输出
+func (tx *Transaction) hasPrevOutputs(prevTXs map[string]Transaction) bool {
+	for _, vin := range tx.VIn {
+		prevTx := prevTXs[hex.EncodeToString(vin.TxID)]
+		if prevTx.ID == nil || vin.VOut < 0 || vin.VOut >= len(prevTx.VOut) {
+			return false
+		}
+	}
+
+	return true
+}
+
 // Sign 对每一个交易输入进行签名
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	// Coinbase 交易没有真实的 TXI，因此这笔交易不进行签名
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	// 对交易进行签名时，需要获取该交易所有 TXI 引用的 TXO 列表，因此需要存储这些 TXO 对应的交易
-	for _, vin := range tx.VIn {
-		if prevTXs[hex.EncodeToString(vin.TxID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
-		}
+	if !tx.hasPrevOutputs(prevTXs) {
+		return fmt.Errorf("%w: previous transaction of %x is not correct", ErrInvalidTransaction, tx.ID)
 	}
 
 	txCopy := tx.TrimmedCopy()
@@ -185,28 +210,31 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 		dataToSign := fmt.Sprintf("%x\n", txCopy)
 
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
-
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
-		// 一个 ECDSA 签名就是一对数字，将这对数字连接起来，并存储在输入的 Signature 字段
-		signature := append(r.Bytes(), s.Bytes()...)
+		// 一个 ECDSA 签名就是一对数字，将这对数字按曲线的长度补齐后连接起来，并存储在输入的 Signature 字段
+		// 不补齐时以 0 开头的数字会变短，验证时从中间拆分就会得到错误的 r 和 s
+		size := (privKey.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
 
 		tx.VIn[inID].Signature = signature
 		txCopy.VIn[inID].PubKey = nil
 	}
+
+	return nil
 }
 
-// Verify 对交易的签名进行验证
+// Verify 对交易的签名进行验证，prevTXs 中缺少引用的输出时验证失败
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
 	}
 
-	for _, vin := range tx.VIn {
-		if prevTXs[hex.EncodeToString(vin.TxID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
-		}
+	if !tx.hasPrevOutputs(prevTXs) {
+		return false
 	}
 
 	txCopy := tx.TrimmedCopy()
@@ -238,7 +266,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		dataToVerify := fmt.Sprintf("%x\n", txCopy)
 
 		// 从输入提取的公钥创建一个 ecdsa.PublicKey
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 
 		// 通过传入输入中提取的签名执行 ecdsa.Verify
 		// 如果所有的输入都被验证，返回 true
@@ -253,14 +281,14 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 }
 
 // DeserializeTransaction deserializes a transaction
-func DeserializeTransaction(data []byte) Transaction {
+func DeserializeTransaction(data []byte) (Transaction, error) {
 	var transaction Transaction
 
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&transaction)
 	if err != nil {
-		log.Panic(err)
+		return transaction, fmt.Errorf("Failed to decode transaction: %w", err)
 	}
 
-	return transaction
+	return transaction, nil
 }
@@ -3,6 +3,7 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"log"
 	"tchain/common"
 )
@@ -16,6 +17,16 @@ type TXOutput struct {
 // TXOutputs collects TXOutput
 type TXOutputs struct {
 	Outputs []TXOutput
+	Indexes []int // 每个输出在原交易中的位置，部分输出被花费后 Outputs 中的位置不再等于输出的位置
+}
+
+// Index 返回第 i 个输出在原交易中的位置，旧版本的 chainstate 没有记录位置时使用 i
+func (outs TXOutputs) Index(i int) int {
+	if i < len(outs.Indexes) {
+		return outs.Indexes[i]
+	}
+
+	return i
 }
 
 // Serialize serializes TXOutputs
@@ -32,16 +43,16 @@ func (outs TXOutputs) Serialize() []byte {
 }
 
 // DeserializeOutputs deserializes TXOutputs
-func DeserializeOutputs(data []byte) TXOutputs {
+func DeserializeOutputs(data []byte) (TXOutputs, error) {
 	var outputs TXOutputs
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	err := dec.Decode(&outputs)
 	if err != nil {
-		log.Panic(err)
+		return outputs, fmt.Errorf("Failed to decode outputs: %w", err)
 	}
 
-	return outputs
+	return outputs, nil
 }
 
 // Lock 对 TXO 进行加锁，从地址中从解码出哈希后的公钥，将其保存到PubKeyHash中
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"tchain/merkle"
+)
+
+// TransactionProof 交易包含在某个区块中的证明
+// 轻节点只需要可信的区块 Merkle 树根，就可以离线验证交易确实被打包
+type TransactionProof struct {
+	BlockHash   []byte             // 交易所在区块的哈希
+	Transaction []byte             // 序列化的交易，也就是 Merkle 树的叶子数据
+	Proof       merkle.MerkleProof // 交易到树根的 Merkle 路径
+}
+
+// Serialize 序列化交易证明
+func (p TransactionProof) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(p)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// DeserializeTransactionProof 反序列化交易证明
+func DeserializeTransactionProof(data []byte) (*TransactionProof, error) {
+	var proof TransactionProof
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&proof)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
+
+// Verify 验证证明中的交易是否包含在树根为 merkleRoot 的区块中
+func (p *TransactionProof) Verify(merkleRoot []byte) bool {
+	return merkle.VerifyProof(merkleRoot, p.Transaction, &p.Proof)
+}
+
+// MerkleProof 返回交易在区块 Merkle 树中的路径
+func (b *Block) MerkleProof(txID []byte) (*merkle.MerkleProof, error) {
+	var transactions [][]byte
+	index := -1
+
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		transactions = append(transactions, tx.Serialize())
+	}
+
+	if index < 0 {
+		return nil, errors.New("Transaction is not in the block")
+	}
+
+	return merkle.NewMerkleTree(transactions).Proof(index)
+}
+
+// FindTransactionProof 在链中查找交易，并返回它包含在区块中的证明
+func (bc *Blockchain) FindTransactionProof(txID []byte) (*TransactionProof, error) {
+	bci := bc.Iterator()
+
+	for {
+		block, err := bci.Next()
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, txID) {
+				proof, err := block.MerkleProof(txID)
+				if err != nil {
+					return nil, err
+				}
+
+				return &TransactionProof{block.Hash, tx.Serialize(), *proof}, nil
+			}
+		}
+
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	return nil, ErrTxNotFound
+}
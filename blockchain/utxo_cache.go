@@ -0,0 +1,240 @@
+package blockchain
+
+import (
+	"bytes"
+	"sync"
+	"tchain/storage"
+)
+
+// 缓存默认的内存上限和写入间隔
+const DEFAULT_UTXO_CACHE_SIZE = 16 << 20
+const DEFAULT_UTXO_FLUSH_INTERVAL = 10
+
+// 每条缓存记录除了键和值以外的大致内存开销
+const cacheEntryOverhead = 96
+
+// cacheEntry 缓存中的一条 chainstate 记录，value 为 nil 表示该记录不存在或者已被删除
+type cacheEntry struct {
+	value   []byte
+	outputs TXOutputs // 解码后的 value，避免重复解码
+	dirty   bool      // 是否还没有写入 chainstate
+}
+
+// UTXOCache chainstate 前面的内存缓存
+// 区块对 UTXO 集的修改先写入缓存，每隔 flushInterval 个区块或者超过内存上限时再一次性写入 chainstate，
+// 写入在同一个数据库事务中完成，包括统计信息和 UTXO 集对应的区块（utxotip），所以 chainstate 总是处于某个区块时的一致状态。
+// 进程在写入之前退出时，utxotip 会落后于区块链的 tip，重新启动后通过 RecoverUTXOSet 重新应用这些区块即可恢复
+type UTXOCache struct {
+	bc            *Blockchain
+	entries       map[string]*cacheEntry
+	stats         *UTXOStats
+	tip           []byte // 缓存中的 UTXO 集对应的区块
+	size          int
+	maxSize       int
+	flushInterval int
+	pending       int // 上次写入后应用的区块数量
+	lock          sync.Mutex
+}
+
+// EnableUTXOCache 为 UTXO 集开启内存缓存，maxSize 为内存上限（字节），flushInterval 为写入 chainstate 的区块间隔
+func (bc *Blockchain) EnableUTXOCache(maxSize, flushInterval int) {
+	cache := &UTXOCache{
+		bc:            bc,
+		maxSize:       maxSize,
+		flushInterval: flushInterval,
+	}
+	cache.reset()
+
+	bc.utxoCache = cache
+}
+
+// FlushUTXOCache 把缓存中的修改写入 chainstate，没有开启缓存时什么都不做
+func (bc *Blockchain) FlushUTXOCache() error {
+	if bc.utxoCache == nil {
+		return nil
+	}
+
+	bc.utxoCache.lock.Lock()
+	defer bc.utxoCache.lock.Unlock()
+
+	return bc.utxoCache.flush()
+}
+
+// reset 丢弃缓存中的所有记录，之后从 chainstate 重新读取
+func (c *UTXOCache) reset() {
+	c.entries = make(map[string]*cacheEntry)
+	c.stats = nil
+	c.tip = nil
+	c.size = 0
+	c.pending = 0
+}
+
+// get 返回记录的值，缓存中没有时从 chainstate 读取并加入缓存
+func (c *UTXOCache) get(txID []byte) ([]byte, error) {
+	if entry, ok := c.entries[string(txID)]; ok {
+		return entry.value, nil
+	}
+
+	var value []byte
+	err := c.bc.DB.View(func(tx storage.Tx) error {
+		if v := tx.Bucket([]byte(UTXO_BUCKET)).Get(txID); v != nil {
+			value = append([]byte{}, v...)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return value, c.set(txID, value, false)
+}
+
+func (c *UTXOCache) put(txID, value []byte) error {
+	return c.set(txID, value, true)
+}
+
+func (c *UTXOCache) delete(txID []byte) error {
+	return c.set(txID, nil, true)
+}
+
+func (c *UTXOCache) set(txID, value []byte, dirty bool) error {
+	entry := cacheEntry{value: value, dirty: dirty}
+	if value != nil {
+		outs, err := DeserializeOutputs(value)
+		if err != nil {
+			return err
+		}
+		entry.outputs = outs
+	}
+
+	key := string(txID)
+	if old, ok := c.entries[key]; ok {
+		c.size -= len(key) + len(old.value) + cacheEntryOverhead
+	}
+
+	c.entries[key] = &entry
+	c.size += len(key) + len(value) + cacheEntryOverhead
+
+	return nil
+}
+
+// load 第一次使用缓存时读取统计信息和 utxotip
+func (c *UTXOCache) load() error {
+	if c.tip != nil {
+		return nil
+	}
+
+	u := UTXOSet{Blockchain: c.bc}
+
+	stats, err := u.storedStats()
+	if err != nil {
+		return err
+	}
+
+	tip, err := u.storedTip()
+	if err != nil {
+		return err
+	}
+
+	c.stats = stats
+	c.tip = tip
+
+	return nil
+}
+
+// connect 把区块应用到缓存中，撤销数据直接写入数据库
+// 失败时缓存可能只应用了区块的一部分，所以丢弃缓存中的所有记录，之后从 chainstate 重新读取
+func (c *UTXOCache) connect(block *Block) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	err := c.load()
+	if err != nil {
+		return err
+	}
+
+	undo, err := applyBlock(c, c.stats, block)
+	if err == nil {
+		err = c.bc.DB.Update(func(tx storage.Tx) error {
+			return putUndo(tx, block.Hash, undo)
+		})
+	}
+	if err != nil {
+		c.reset()
+		return err
+	}
+
+	c.tip = block.Hash
+	c.pending++
+
+	if c.pending >= c.flushInterval || c.size > c.maxSize {
+		return c.flush()
+	}
+
+	return nil
+}
+
+// flush 在一个事务中把所有修改写入 chainstate，超过内存上限时清空缓存
+func (c *UTXOCache) flush() error {
+	if c.tip == nil {
+		return nil
+	}
+
+	err := c.bc.DB.Update(func(tx storage.Tx) error {
+		for key, entry := range c.entries {
+			if !entry.dirty {
+				continue
+			}
+
+			err := putUTXOEntry(tx, []byte(key), entry.value)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := putUTXOStats(tx, c.stats)
+		if err != nil {
+			return err
+		}
+
+		return putUTXOTip(tx, c.tip)
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.size > c.maxSize {
+		c.reset()
+		return nil
+	}
+
+	for key, entry := range c.entries {
+		// 已删除的记录不再需要保留
+		if entry.value == nil {
+			c.size -= len(key) + cacheEntryOverhead
+			delete(c.entries, key)
+			continue
+		}
+		entry.dirty = false
+	}
+	c.pending = 0
+
+	return nil
+}
+
+// RecoverUTXOSet 检查 chainstate 是否落后于区块链，例如上次退出时缓存还没有写入，
+// 落后时重新应用缺少的区块，返回 chainstate 是否需要恢复
+func (bc *Blockchain) RecoverUTXOSet() (bool, error) {
+	u := UTXOSet{Blockchain: bc}
+
+	tip, err := u.Tip()
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(tip, bc.tip) {
+		return false, nil
+	}
+
+	return true, u.SyncToTip()
+}
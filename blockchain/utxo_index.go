@@ -0,0 +1,192 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"tchain/common"
+	"tchain/storage"
+)
+
+// 按公钥哈希索引未花费输出，key 为 公钥哈希 + 交易 ID + 4 字节的输出位置，value 为输出的金额
+// 查询某个地址的 UTXO 时只需要遍历以该公钥哈希为前缀的记录，而不需要解码整个 chainstate
+const OWNER_INDEX_BUCKET = "owners"
+
+func ownerKey(pubKeyHash, txID []byte, vout int) []byte {
+	position := make([]byte, 4)
+	binary.BigEndian.PutUint32(position, uint32(vout))
+
+	key := make([]byte, 0, len(pubKeyHash)+len(txID)+len(position))
+	key = append(key, pubKeyHash...)
+	key = append(key, txID...)
+
+	return append(key, position...)
+}
+
+// putUTXOEntry 写入 chainstate 中的一条记录并同步更新索引，value 为 nil 时删除该记录
+// 所有对 chainstate 的修改都需要通过这个函数，才能保证索引与 chainstate 一致
+func putUTXOEntry(tx storage.Tx, txID, value []byte) error {
+	b := tx.Bucket([]byte(UTXO_BUCKET))
+	index, err := tx.CreateBucketIfNotExists([]byte(OWNER_INDEX_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	if old := b.Get(txID); old != nil {
+		outs, err := DeserializeOutputs(old)
+		if err != nil {
+			return err
+		}
+
+		for i, out := range outs.Outputs {
+			err = index.Delete(ownerKey(out.PubKeyHash, txID, outs.Index(i)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if value == nil {
+		return b.Delete(txID)
+	}
+
+	outs, err := DeserializeOutputs(value)
+	if err != nil {
+		return err
+	}
+
+	for i, out := range outs.Outputs {
+		err = index.Put(ownerKey(out.PubKeyHash, txID, outs.Index(i)), common.IntToHex(int64(out.Value)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.Put(txID, value)
+}
+
+// buildOwnerIndex 根据 chainstate 重新生成索引
+func buildOwnerIndex(tx storage.Tx) error {
+	err := tx.DeleteBucket([]byte(OWNER_INDEX_BUCKET))
+	if err != nil && err != storage.ErrBucketNotFound {
+		return err
+	}
+
+	index, err := tx.CreateBucket([]byte(OWNER_INDEX_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	c := tx.Bucket([]byte(UTXO_BUCKET)).Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		outs, err := DeserializeOutputs(v)
+		if err != nil {
+			return err
+		}
+
+		for i, out := range outs.Outputs {
+			err = index.Put(ownerKey(out.PubKeyHash, k, outs.Index(i)), common.IntToHex(int64(out.Value)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateOwnerIndex 为旧版本创建的数据库生成索引
+func migrateOwnerIndex(tx storage.Tx) error {
+	if tx.Bucket([]byte(UTXO_BUCKET)) == nil || tx.Bucket([]byte(OWNER_INDEX_BUCKET)) != nil {
+		return nil
+	}
+
+	return buildOwnerIndex(tx)
+}
+
+// forEachOwned 遍历公钥哈希拥有的所有未花费输出
+// 索引只反映 chainstate 中的内容，开启了缓存时跳过缓存中修改过的交易，再从缓存中补充这些交易当前的输出
+func (u UTXOSet) forEachOwned(pubKeyHash []byte, fn func(txID []byte, vout int, value int) bool) error {
+	cache := u.Blockchain.utxoCache
+	if cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+	}
+
+	stopped := false
+	err := u.Blockchain.DB.View(func(tx storage.Tx) error {
+		index := tx.Bucket([]byte(OWNER_INDEX_BUCKET))
+		if index == nil {
+			return nil
+		}
+
+		c := index.Cursor()
+		for k, v := c.Seek(pubKeyHash); k != nil && bytes.HasPrefix(k, pubKeyHash); k, v = c.Next() {
+			txID := k[len(pubKeyHash) : len(k)-4]
+			vout := int(binary.BigEndian.Uint32(k[len(k)-4:]))
+
+			if cache != nil {
+				if entry, ok := cache.entries[string(txID)]; ok && entry.dirty {
+					continue
+				}
+			}
+
+			if !fn(txID, vout, int(common.HexToInt(v))) {
+				stopped = true
+				break
+			}
+		}
+
+		return nil
+	})
+	if err != nil || stopped || cache == nil {
+		return err
+	}
+
+	for key, entry := range cache.entries {
+		if !entry.dirty {
+			continue
+		}
+
+		for i, out := range entry.outputs.Outputs {
+			if !out.IsLockedWithKey(pubKeyHash) {
+				continue
+			}
+
+			if !fn([]byte(key), entry.outputs.Index(i), out.Value) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// FindSpendableOutputs 查找并返回 UTXO 在输入中的引用
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+
+	err := u.forEachOwned(pubKeyHash, func(txID []byte, vout int, value int) bool {
+		id := hex.EncodeToString(txID)
+		accumulated += value
+		unspentOutputs[id] = append(unspentOutputs[id], vout)
+
+		return accumulated < amount
+	})
+
+	return accumulated, unspentOutputs, err
+}
+
+// FindUTXO 为公钥哈希找到 UTXO
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TXOutput, error) {
+	var UTXOs []TXOutput
+
+	err := u.forEachOwned(pubKeyHash, func(txID []byte, vout int, value int) bool {
+		UTXOs = append(UTXOs, TXOutput{Value: value, PubKeyHash: pubKeyHash})
+
+		return true
+	})
+
+	return UTXOs, err
+}
@@ -2,198 +2,368 @@ package blockchain
 
 import (
 	"encoding/hex"
-	"log"
-
-	"go.etcd.io/bbolt"
+	"errors"
+	"fmt"
+	"tchain/storage"
 )
 
 const UTXO_BUCKET = "chainstate"
 
+// ErrIncompleteHistory 裁剪后或者从快照启动的区块链缺少旧区块的内容
+var ErrIncompleteHistory = errors.New("Cannot rebuild the UTXO set without the full block history")
+
 // UTXOSet UTXO 集合
 type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-// FindSpendableOutputs 查找并返回 UTXO 在输入中的引用
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	accumulated := 0
-	db := u.Blockchain.DB
+// forEach 遍历 UTXO 集中的每一条记录，开启了缓存时缓存中的修改优先于 chainstate 中的值
+func (u UTXOSet) forEach(fn func(txID []byte, outs TXOutputs)) error {
+	cache := u.Blockchain.utxoCache
+	if cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+	}
 
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(UTXO_BUCKET))
-		c := b.Cursor()
+	err := u.Blockchain.DB.View(func(tx storage.Tx) error {
+		c := tx.Bucket([]byte(UTXO_BUCKET)).Cursor()
 
 		for k, v := c.First(); k != nil; k, v = c.Next() {
-			txID := hex.EncodeToString(k)
-			outs := DeserializeOutputs(v)
-
-			for outIdx, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-					accumulated += out.Value
-					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+			if cache != nil {
+				if entry, ok := cache.entries[string(k)]; ok {
+					if entry.value != nil {
+						fn(k, entry.outputs)
+					}
+					continue
 				}
 			}
+
+			outs, err := DeserializeOutputs(v)
+			if err != nil {
+				return err
+			}
+
+			fn(k, outs)
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
+	if err != nil || cache == nil {
+		return err
 	}
 
-	return accumulated, unspentOutputs
-}
-
-// FindUTXO 为公钥哈希找到 UTXO
-func (u UTXOSet) FindUTXO(pubKeyHash []byte) []TXOutput {
-	var UTXOs []TXOutput
-	db := u.Blockchain.DB
-
-	err := db.View(func(tx *bbolt.Tx) error {
+	// 只存在于缓存中、还没有写入 chainstate 的记录
+	return u.Blockchain.DB.View(func(tx storage.Tx) error {
 		b := tx.Bucket([]byte(UTXO_BUCKET))
-		c := b.Cursor()
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			outs := DeserializeOutputs(v)
-
-			for _, out := range outs.Outputs {
-				if out.IsLockedWithKey(pubKeyHash) {
-					UTXOs = append(UTXOs, out)
-				}
+		for key, entry := range cache.entries {
+			if entry.value != nil && b.Get([]byte(key)) == nil {
+				fn([]byte(key), entry.outputs)
 			}
 		}
 
 		return nil
 	})
-	if err != nil {
-		log.Panic(err)
-	}
-
-	return UTXOs
 }
 
 // Reindex 初始化 UTXO 集
-func (u UTXOSet) Reindex() {
+// 裁剪后或者从快照启动的区块链缺少旧区块的内容，无法重建 UTXO 集，返回 ErrIncompleteHistory
+func (u UTXOSet) Reindex() error {
+	fullHistory, err := u.Blockchain.HasFullHistory()
+	if err != nil {
+		return err
+	}
+	if !fullHistory {
+		return ErrIncompleteHistory
+	}
+
 	db := u.Blockchain.DB
 	bucketName := []byte(UTXO_BUCKET)
 
+	// 缓存中的修改会被重建的结果覆盖
+	if cache := u.Blockchain.utxoCache; cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		cache.reset()
+	}
+
 	// 如果 bucket 存在就先移除
-	err := db.Update(func(tx *bbolt.Tx) error {
+	err = db.Update(func(tx storage.Tx) error {
 		err := tx.DeleteBucket(bucketName)
-		if err != nil && err != bbolt.ErrBucketNotFound {
-			log.Panic(err)
+		if err != nil && err != storage.ErrBucketNotFound {
+			return err
 		}
 
 		_, err = tx.CreateBucket(bucketName)
-		if err != nil {
-			log.Panic(err)
-		}
 
-		return nil
+		return err
 	})
-
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	// 然后从区块链中获取所有的未花费输出
-	UTXO := u.Blockchain.FindUTXO()
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
 
-	// 最终将输出保存到 bucket 中
-	err = db.Update(func(tx *bbolt.Tx) error {
+	// 最终将输出保存到 bucket 中，并重新计算统计信息
+	return db.Update(func(tx storage.Tx) error {
 		b := tx.Bucket(bucketName)
 
+		err := buildOwnerIndex(tx)
+		if err != nil {
+			return err
+		}
+
 		for txID, outs := range UTXO {
 			key, err := hex.DecodeString(txID)
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
 
-			err = b.Put(key, outs.Serialize())
+			err = putUTXOEntry(tx, key, outs.Serialize())
 			if err != nil {
-				log.Panic(err)
+				return err
 			}
 		}
 
-		return nil
-	})
+		err = putUTXOTip(tx, u.Blockchain.tip)
+		if err != nil {
+			return err
+		}
 
+		stats, err := computeUTXOStats(b)
+		if err != nil {
+			return err
+		}
+
+		return putUTXOStats(tx, stats)
+	})
 }
 
 // Update 当挖出一个新块时，更新 UTXO 集，使其保持 UTXO 集处于最新状态，并且存储最新交易的输出
-func (u UTXOSet) Update(block *Block) {
+// 开启了缓存时修改只写入缓存，由缓存批量写入 chainstate
+func (u UTXOSet) Update(block *Block) error {
+	if cache := u.Blockchain.utxoCache; cache != nil {
+		return cache.connect(block)
+	}
+
 	db := u.Blockchain.DB
 
-	err := db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(UTXO_BUCKET))
+	return db.Update(func(dbTx storage.Tx) error {
+		// 统计信息不存在时不做增量更新，之后调用 Stats 时会重新计算
+		stats, err := getUTXOStats(dbTx)
+		if err != nil {
+			return err
+		}
 
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, vin := range tx.VIn {
-					updatedOuts := TXOutputs{}
-					outsBytes := b.Get(vin.TxID)
-					outs := DeserializeOutputs(outsBytes)
-
-					// 从新挖出来的交易中加入 UTXO
-					for outIdx, out := range outs.Outputs {
-						if outIdx != vin.VOut {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
+		undo, err := applyBlock(bucketView{dbTx}, stats, block)
+		if err != nil {
+			return err
+		}
+
+		err = putUndo(dbTx, block.Hash, undo)
+		if err != nil {
+			return err
+		}
+
+		err = putUTXOTip(dbTx, block.Hash)
+		if err != nil {
+			return err
+		}
+
+		if stats == nil {
+			return nil
+		}
+
+		return putUTXOStats(dbTx, stats)
+	})
+}
+
+// utxoView chainstate 的读写接口，由 chainstate bucket 或者缓存实现
+type utxoView interface {
+	get(txID []byte) ([]byte, error)
+	put(txID, value []byte) error
+	delete(txID []byte) error
+}
+
+type bucketView struct {
+	tx storage.Tx
+}
+
+func (v bucketView) get(txID []byte) ([]byte, error) {
+	return v.tx.Bucket([]byte(UTXO_BUCKET)).Get(txID), nil
+}
+
+func (v bucketView) put(txID, value []byte) error {
+	return putUTXOEntry(v.tx, txID, value)
+}
+
+func (v bucketView) delete(txID []byte) error {
+	return putUTXOEntry(v.tx, txID, nil)
+}
+
+// applyBlock 把区块中的交易应用到 view 上，返回撤销这个区块所需的数据
+func applyBlock(view utxoView, stats *UTXOStats, block *Block) (blockUndo, error) {
+	// 记录每条记录第一次被修改之前的值，用于撤销这个区块
+	undo := blockUndo{}
+	touched := make(map[string]bool)
+	record := func(key []byte) error {
+		if touched[string(key)] {
+			return nil
+		}
+
+		value, err := view.get(key)
+		if err != nil {
+			return err
+		}
+
+		touched[string(key)] = true
+		undo.Entries = append(undo.Entries, undoEntry{key, append([]byte(nil), value...)})
+
+		return nil
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, vin := range tx.VIn {
+				err := record(vin.TxID)
+				if err != nil {
+					return undo, err
+				}
+
+				updatedOuts := TXOutputs{}
+				outsBytes, err := view.get(vin.TxID)
+				if err != nil {
+					return undo, err
+				}
+				if outsBytes == nil {
+					return undo, fmt.Errorf("Transaction %x spends missing transaction %x", tx.ID, vin.TxID)
+				}
+
+				outs, err := DeserializeOutputs(outsBytes)
+				if err != nil {
+					return undo, err
+				}
+				if stats != nil {
+					err = stats.removeEntry(vin.TxID, outsBytes)
+					if err != nil {
+						return undo, err
+					}
+				}
+
+				// 移除被花费的输出，输入引用的是输出在原交易中的位置
+				for i, out := range outs.Outputs {
+					if outs.Index(i) != vin.VOut {
+						updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+						updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Index(i))
 					}
+				}
 
-					// 如果一笔交易的输出被移除，并且不再包含任何输出，那么这笔交易也应该被移除。
-					if len(updatedOuts.Outputs) == 0 {
-						err := b.Delete(vin.TxID)
-						if err != nil {
-							log.Panic(err)
-						}
-					} else {
-						err := b.Put(vin.TxID, updatedOuts.Serialize())
+				// 如果一笔交易的输出被移除，并且不再包含任何输出，那么这笔交易也应该被移除。
+				if len(updatedOuts.Outputs) == 0 {
+					err = view.delete(vin.TxID)
+					if err != nil {
+						return undo, err
+					}
+				} else {
+					updatedBytes := updatedOuts.Serialize()
+					err = view.put(vin.TxID, updatedBytes)
+					if err != nil {
+						return undo, err
+					}
+					if stats != nil {
+						err = stats.addEntry(vin.TxID, updatedBytes)
 						if err != nil {
-							log.Panic(err)
+							return undo, err
 						}
 					}
-
 				}
-			}
 
-			newOutputs := TXOutputs{}
-			for _, out := range tx.VOut {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
 			}
+		}
 
-			err := b.Put(tx.ID, newOutputs.Serialize())
+		newOutputs := TXOutputs{}
+		for outIdx, out := range tx.VOut {
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+
+		err := record(tx.ID)
+		if err != nil {
+			return undo, err
+		}
+
+		newBytes := newOutputs.Serialize()
+		err = view.put(tx.ID, newBytes)
+		if err != nil {
+			return undo, err
+		}
+		if stats != nil {
+			err = stats.addEntry(tx.ID, newBytes)
 			if err != nil {
-				log.Panic(err)
+				return undo, err
 			}
 		}
-
-		return nil
-	})
-	if err != nil {
-		log.Panic(err)
 	}
+
+	return undo, nil
 }
 
 // CountTransactions 返回 UTXO 集中的交易数量
-func (u UTXOSet) CountTransactions() int {
-	db := u.Blockchain.DB
+func (u UTXOSet) CountTransactions() (int, error) {
 	counter := 0
 
-	err := db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(UTXO_BUCKET))
-		c := b.Cursor()
+	err := u.forEach(func(k []byte, outs TXOutputs) {
+		counter++
+	})
 
-		for k, _ := c.First(); k != nil; k, _ = c.Next() {
-			counter++
+	return counter, err
+}
+
+// FindOutput 在 UTXO 集中查找交易 txID 位置为 vout 的未花费输出，开启了缓存时缓存中的修改优先于 chainstate 中的值
+// 输出不存在或者已经被花费时第二个返回值为 false
+func (u UTXOSet) FindOutput(txID []byte, vout int) (TXOutput, bool, error) {
+	var data []byte
+
+	if cache := u.Blockchain.utxoCache; cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+
+		value, err := cache.get(txID)
+		if err != nil {
+			return TXOutput{}, false, err
 		}
+		data = value
+	} else {
+		err := u.Blockchain.DB.View(func(tx storage.Tx) error {
+			b := tx.Bucket([]byte(UTXO_BUCKET))
+			if b == nil {
+				return nil
+			}
+			if v := b.Get(txID); v != nil {
+				data = append([]byte{}, v...)
+			}
 
-		return nil
-	})
+			return nil
+		})
+		if err != nil {
+			return TXOutput{}, false, err
+		}
+	}
+
+	if data == nil {
+		return TXOutput{}, false, nil
+	}
+
+	outs, err := DeserializeOutputs(data)
 	if err != nil {
-		log.Panic(err)
+		return TXOutput{}, false, err
 	}
 
-	return counter
+	out, found := findOutput(outs, vout)
+
+	return out, found, nil
 }
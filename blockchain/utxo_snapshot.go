@@ -0,0 +1,377 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"tchain/storage"
+)
+
+// 从快照启动的节点在 blocks bucket 中记录快照所在的区块和快照的内容哈希，历史区块验证完成后删除
+const SNAPSHOT_BASE_KEY = "snapshot"
+const SNAPSHOT_HASH_KEY = "snapshothash"
+
+// 快照与历史区块不一致时在 blocks bucket 中记录根据历史区块计算出的哈希，之后不再使用这个 chainstate
+const SNAPSHOT_INVALID_KEY = "snapshotinvalid"
+
+// ErrSnapshotInvalid 根据历史区块计算的 UTXO 集与加载的快照不一致，chainstate 不可信，需要重新同步
+var ErrSnapshotInvalid = errors.New("UTXO snapshot does not match the block history")
+
+// UTXOSnapshot chainstate 在某个区块时的快照
+type UTXOSnapshot struct {
+	BlockHash []byte
+	Height    int
+	Header    []byte // 快照所在区块的区块头，加载快照的节点以它作为链的起点
+	Hash      []byte // 快照内容的哈希，见 HashUTXOs
+	Entries   []UTXOSnapshotEntry
+}
+
+// UTXOSnapshotEntry chainstate 中的一条记录
+type UTXOSnapshotEntry struct {
+	TxID    []byte
+	Outputs []byte // 序列化后的 TXOutputs，与 chainstate 中保存的值相同
+}
+
+// HashUTXOs 计算 UTXO 集的内容哈希，每个输出包括它在原交易中的位置、金额和公钥哈希
+// gob 编码的结果与进程中类型注册的顺序有关，所以这里对输出使用固定的编码，而不是直接哈希 chainstate 中的值
+func HashUTXOs(utxos map[string]TXOutputs) []byte {
+	txIDs := make([]string, 0, len(utxos))
+	for txID := range utxos {
+		txIDs = append(txIDs, txID)
+	}
+	sort.Strings(txIDs)
+
+	hasher := sha256.New()
+	buf := make([]byte, 8)
+
+	for _, txID := range txIDs {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			log.Panic(err)
+		}
+		hasher.Write(key)
+
+		outs := utxos[txID]
+		binary.BigEndian.PutUint64(buf, uint64(len(outs.Outputs)))
+		hasher.Write(buf)
+
+		for i, out := range outs.Outputs {
+			binary.BigEndian.PutUint64(buf, uint64(outs.Index(i)))
+			hasher.Write(buf)
+			binary.BigEndian.PutUint64(buf, uint64(out.Value))
+			hasher.Write(buf)
+			binary.BigEndian.PutUint64(buf, uint64(len(out.PubKeyHash)))
+			hasher.Write(buf)
+			hasher.Write(out.PubKeyHash)
+		}
+	}
+
+	return hasher.Sum(nil)
+}
+
+// Outputs 把快照中的记录解码为 UTXO 集
+func (s *UTXOSnapshot) Outputs() (map[string]TXOutputs, error) {
+	utxos := make(map[string]TXOutputs)
+
+	for _, entry := range s.Entries {
+		outs, err := DeserializeOutputs(entry.Outputs)
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot entry %x is invalid: %w", entry.TxID, err)
+		}
+
+		utxos[hex.EncodeToString(entry.TxID)] = outs
+	}
+
+	return utxos, nil
+}
+
+// Serialize 序列化快照
+func (s *UTXOSnapshot) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(s)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// DeserializeUTXOSnapshot 反序列化快照
+func DeserializeUTXOSnapshot(data []byte) (*UTXOSnapshot, error) {
+	var snapshot UTXOSnapshot
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// Snapshot 导出当前 tip 的 chainstate
+func (u UTXOSet) Snapshot() (*UTXOSnapshot, error) {
+	snapshot := UTXOSnapshot{}
+
+	err := u.Blockchain.FlushUTXOCache()
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.Blockchain.DB.View(func(tx storage.Tx) error {
+		tip := tx.Bucket([]byte(BLOCKS_BUCKET)).Get([]byte("l"))
+
+		header, err := getHeader(tx, tip)
+		if err != nil {
+			return err
+		}
+
+		snapshot.BlockHash = append([]byte{}, tip...)
+		snapshot.Header = header.Serialize()
+		snapshot.Height = header.Height
+
+		c := tx.Bucket([]byte(UTXO_BUCKET)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			entry := UTXOSnapshotEntry{
+				TxID:    append([]byte{}, k...),
+				Outputs: append([]byte{}, v...),
+			}
+			snapshot.Entries = append(snapshot.Entries, entry)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	utxos, err := snapshot.Outputs()
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Hash = HashUTXOs(utxos)
+
+	return &snapshot, nil
+}
+
+// Validate 检查快照的区块头和内容哈希，trustedHash 是从可信来源得到的快照哈希
+func (s *UTXOSnapshot) Validate(trustedHash []byte) error {
+	header, err := DeserializeBlockHeader(s.Header)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header.Hash, s.BlockHash) || header.Height != s.Height {
+		return errors.New("Snapshot header does not match its block")
+	}
+
+	if !NewHeaderProofOfWork(header).Validate() {
+		return errors.New("Snapshot header has invalid proof of work")
+	}
+
+	utxos, err := s.Outputs()
+	if err != nil {
+		return err
+	}
+
+	hash := HashUTXOs(utxos)
+	if !bytes.Equal(hash, s.Hash) {
+		return errors.New("Snapshot content does not match its hash")
+	}
+
+	if !bytes.Equal(hash, trustedHash) {
+		return fmt.Errorf("Snapshot hash %x is not the trusted hash %x", hash, trustedHash)
+	}
+
+	return nil
+}
+
+// LoadUTXOSnapshot 使用快照创建一个新的区块链数据库，链从快照所在的区块开始
+// 快照之前的区块会在同步时下载，全部下载后通过 ValidateSnapshot 验证快照，节点已经有区块链时返回 ErrChainExists
+func LoadUTXOSnapshot(nodeID string, snapshot *UTXOSnapshot) (*Blockchain, error) {
+	dbFile := fmt.Sprintf(DB_FILE, nodeID)
+	if dbExists(dbFile) {
+		return nil, ErrChainExists
+	}
+
+	db, err := storage.OpenBolt(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := openBlockFiles(nodeID)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	bc, err := LoadUTXOSnapshotWithDB(db, files, snapshot)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// LoadUTXOSnapshotWithDB 在空的数据库中加载快照
+func LoadUTXOSnapshotWithDB(db storage.DB, files storage.FlatFiles, snapshot *UTXOSnapshot) (*Blockchain, error) {
+	err := db.Update(func(tx storage.Tx) error {
+		b, err := tx.CreateBucket([]byte(BLOCKS_BUCKET))
+		if err == storage.ErrBucketExists {
+			return ErrChainExists
+		}
+		if err != nil {
+			return err
+		}
+
+		err = putSchemaVersion(tx, SCHEMA_VERSION)
+		if err != nil {
+			return err
+		}
+
+		headers, err := tx.CreateBucket([]byte(HEADERS_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucket([]byte(UTXO_BUCKET))
+		if err != nil {
+			return err
+		}
+
+		err = headers.Put(snapshot.BlockHash, snapshot.Header)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range snapshot.Entries {
+			err = putUTXOEntry(tx, entry.TxID, entry.Outputs)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = b.Put([]byte(SNAPSHOT_BASE_KEY), snapshot.BlockHash)
+		if err != nil {
+			return err
+		}
+
+		err = b.Put([]byte(SNAPSHOT_HASH_KEY), snapshot.Hash)
+		if err != nil {
+			return err
+		}
+
+		err = putUTXOTip(tx, snapshot.BlockHash)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("l"), snapshot.BlockHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bc := Blockchain{tip: append([]byte{}, snapshot.BlockHash...), DB: db, blocks: files}
+
+	return &bc, nil
+}
+
+// SnapshotBase 返回还没有验证的快照所在区块的哈希，没有快照时返回 nil
+func (bc *Blockchain) SnapshotBase() ([]byte, error) {
+	var base []byte
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		if data := tx.Bucket([]byte(BLOCKS_BUCKET)).Get([]byte(SNAPSHOT_BASE_KEY)); data != nil {
+			base = append([]byte{}, data...)
+		}
+
+		return nil
+	})
+
+	return base, err
+}
+
+// HasFullHistory 判断本地是否保存了从创世块开始的所有区块，只有这样才能重建 UTXO 集
+func (bc *Blockchain) HasFullHistory() (bool, error) {
+	pruneHeight, err := bc.PruneHeight()
+	if err != nil {
+		return false, err
+	}
+
+	base, err := bc.SnapshotBase()
+	if err != nil {
+		return false, err
+	}
+
+	return pruneHeight == 0 && base == nil, nil
+}
+
+// CheckChainstate 检查 chainstate 是否可用，快照验证失败后返回 ErrSnapshotInvalid
+func (bc *Blockchain) CheckChainstate() error {
+	return bc.DB.View(func(tx storage.Tx) error {
+		if hash := tx.Bucket([]byte(BLOCKS_BUCKET)).Get([]byte(SNAPSHOT_INVALID_KEY)); hash != nil {
+			return fmt.Errorf("%w: history gives %x", ErrSnapshotInvalid, hash)
+		}
+
+		return nil
+	})
+}
+
+// ValidateSnapshot 使用下载的历史区块重新计算快照所在区块的 UTXO 集，并与快照的哈希比较
+// 历史区块还没有下载完时返回 false，验证通过后删除快照标记；
+// 不一致时把 chainstate 标记为无效并返回 ErrSnapshotInvalid，之后 CheckChainstate 和 MineBlock 都会返回这个错误
+func (bc *Blockchain) ValidateSnapshot() (bool, error) {
+	base, err := bc.SnapshotBase()
+	if err != nil {
+		return false, err
+	}
+	if base == nil {
+		return true, nil
+	}
+
+	utxos, complete, err := bc.findUTXOFrom(base)
+	if err != nil {
+		return false, err
+	}
+	if !complete {
+		return false, nil
+	}
+
+	hash := HashUTXOs(utxos)
+	var expected []byte
+
+	err = bc.DB.Update(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(BLOCKS_BUCKET))
+
+		expected = append([]byte{}, b.Get([]byte(SNAPSHOT_HASH_KEY))...)
+		if !bytes.Equal(hash, expected) {
+			return b.Put([]byte(SNAPSHOT_INVALID_KEY), hash)
+		}
+
+		err := b.Delete([]byte(SNAPSHOT_BASE_KEY))
+		if err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(SNAPSHOT_HASH_KEY))
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if !bytes.Equal(hash, expected) {
+		return false, fmt.Errorf("%w: UTXO set at snapshot block %x is %x, but the snapshot is %x", ErrSnapshotInvalid, base, hash, expected)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"tchain/muhash"
+	"tchain/storage"
+)
+
+const UTXO_STATS_BUCKET = "utxostats"
+const UTXO_STATS_KEY = "stats"
+
+// UTXOStats UTXO 集的统计信息和集合哈希，随 UTXO 集一起增量更新
+// 两个节点在同一个区块上的集合哈希相同，说明它们的 UTXO 集一致
+type UTXOStats struct {
+	Transactions int    // 包含未花费输出的交易数量
+	Outputs      int    // 未花费输出的数量
+	Amount       int    // 未花费输出的总金额
+	Size         int    // 未花费输出按 coinElement 的固定格式序列化后的总字节数，与 gob 编码的结果无关
+	State        []byte // MuHash 的中间状态
+
+	hash *muhash.MuHash
+}
+
+// coinElement 返回未花费输出在集合哈希中的元素：交易 ID、输出在原交易中的位置、金额和公钥哈希
+func coinElement(txID []byte, vout int, out TXOutput) []byte {
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, uint32(vout))
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(out.Value))
+
+	element := make([]byte, 0, len(txID)+len(index)+len(value)+len(out.PubKeyHash))
+	element = append(element, txID...)
+	element = append(element, index...)
+	element = append(element, value...)
+	element = append(element, out.PubKeyHash...)
+
+	return element
+}
+
+func newUTXOStats() *UTXOStats {
+	return &UTXOStats{hash: muhash.New()}
+}
+
+// clone 返回统计信息的副本，修改副本不会影响原来的统计信息
+func (s *UTXOStats) clone() (*UTXOStats, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	hash, err := muhash.Deserialize(s.hash.Serialize())
+	if err != nil {
+		return nil, err
+	}
+
+	c := *s
+	c.State = append([]byte{}, s.State...)
+	c.hash = hash
+
+	return &c, nil
+}
+
+// Hash 返回 UTXO 集的集合哈希
+func (s *UTXOStats) Hash() []byte {
+	return s.hash.Digest()
+}
+
+// addEntry 记录 chainstate 中新加入的一条记录
+func (s *UTXOStats) addEntry(txID []byte, value []byte) error {
+	outs, err := DeserializeOutputs(value)
+	if err != nil {
+		return err
+	}
+
+	s.Transactions++
+	s.addOutputs(txID, outs)
+
+	return nil
+}
+
+// removeEntry 记录从 chainstate 中删除的一条记录
+func (s *UTXOStats) removeEntry(txID []byte, value []byte) error {
+	outs, err := DeserializeOutputs(value)
+	if err != nil {
+		return err
+	}
+
+	s.Transactions--
+	s.removeOutputs(txID, outs)
+
+	return nil
+}
+
+func (s *UTXOStats) addOutputs(txID []byte, outs TXOutputs) {
+	for i, out := range outs.Outputs {
+		element := coinElement(txID, outs.Index(i), out)
+		s.Outputs++
+		s.Amount += out.Value
+		s.Size += len(element)
+		s.hash.Add(element)
+	}
+}
+
+func (s *UTXOStats) removeOutputs(txID []byte, outs TXOutputs) {
+	for i, out := range outs.Outputs {
+		element := coinElement(txID, outs.Index(i), out)
+		s.Outputs--
+		s.Amount -= out.Value
+		s.Size -= len(element)
+		s.hash.Remove(element)
+	}
+}
+
+// computeUTXOStats 遍历 chainstate 计算统计信息
+func computeUTXOStats(b storage.Bucket) (*UTXOStats, error) {
+	stats := newUTXOStats()
+	c := b.Cursor()
+
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		err := stats.addEntry(k, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return stats, nil
+}
+
+// getUTXOStats 读取保存的统计信息，没有保存过时返回 nil
+func getUTXOStats(tx storage.Tx) (*UTXOStats, error) {
+	b := tx.Bucket([]byte(UTXO_STATS_BUCKET))
+	if b == nil {
+		return nil, nil
+	}
+
+	data := b.Get([]byte(UTXO_STATS_KEY))
+	if data == nil {
+		return nil, nil
+	}
+
+	var stats UTXOStats
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&stats)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode UTXO set statistics: %w", err)
+	}
+
+	stats.hash, err = muhash.Deserialize(stats.State)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// putUTXOStats 保存统计信息
+func putUTXOStats(tx storage.Tx, stats *UTXOStats) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(UTXO_STATS_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	stats.State = stats.hash.Serialize()
+
+	var encoded bytes.Buffer
+	err = gob.NewEncoder(&encoded).Encode(stats)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(UTXO_STATS_KEY), encoded.Bytes())
+}
+
+// Stats 返回 UTXO 集的统计信息，旧版本的数据库没有保存统计信息时会遍历 chainstate 计算一次
+func (u UTXOSet) Stats() (*UTXOStats, error) {
+	err := u.Blockchain.FlushUTXOCache()
+	if err != nil {
+		return nil, err
+	}
+
+	return u.storedStats()
+}
+
+// storedStats 返回 chainstate 中保存的统计信息
+func (u UTXOSet) storedStats() (*UTXOStats, error) {
+	var stats *UTXOStats
+
+	err := u.Blockchain.DB.Update(func(tx storage.Tx) error {
+		var err error
+		stats, err = getUTXOStats(tx)
+		if err != nil || stats != nil {
+			return err
+		}
+
+		stats, err = computeUTXOStats(tx.Bucket([]byte(UTXO_BUCKET)))
+		if err != nil {
+			return err
+		}
+
+		return putUTXOStats(tx, stats)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
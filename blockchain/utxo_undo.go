@@ -0,0 +1,284 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"tchain/storage"
+)
+
+// 每个区块的撤销数据，用于在链重组时把区块从 UTXO 集中撤销
+const UNDO_BUCKET = "undo"
+
+// UTXO 集对应的区块保存在 blocks bucket 中
+const UTXO_TIP_KEY = "utxotip"
+
+// undoEntry 区块修改 chainstate 中某条记录之前的值，Outputs 为空表示修改之前该记录不存在
+type undoEntry struct {
+	TxID    []byte
+	Outputs []byte
+}
+
+// blockUndo 撤销一个区块所需的数据
+type blockUndo struct {
+	Entries []undoEntry
+}
+
+// Serialize 序列化撤销数据
+func (u blockUndo) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(u)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// deserializeBlockUndo 反序列化撤销数据
+func deserializeBlockUndo(data []byte) (blockUndo, error) {
+	var undo blockUndo
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+	if err != nil {
+		return undo, fmt.Errorf("Failed to decode undo data: %w", err)
+	}
+
+	return undo, nil
+}
+
+func putUndo(tx storage.Tx, blockHash []byte, undo blockUndo) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(UNDO_BUCKET))
+	if err != nil {
+		return err
+	}
+
+	return b.Put(blockHash, undo.Serialize())
+}
+
+func getUTXOTip(tx storage.Tx) []byte {
+	tip := tx.Bucket([]byte(BLOCKS_BUCKET)).Get([]byte(UTXO_TIP_KEY))
+	if tip == nil {
+		return nil
+	}
+
+	return append([]byte{}, tip...)
+}
+
+func putUTXOTip(tx storage.Tx, hash []byte) error {
+	return tx.Bucket([]byte(BLOCKS_BUCKET)).Put([]byte(UTXO_TIP_KEY), hash)
+}
+
+// Tip 返回 UTXO 集对应的区块，旧版本的数据库没有记录时认为与区块链的 tip 一致
+func (u UTXOSet) Tip() ([]byte, error) {
+	if cache := u.Blockchain.utxoCache; cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+
+		if cache.tip != nil {
+			return cache.tip, nil
+		}
+	}
+
+	return u.storedTip()
+}
+
+// storedTip 返回 chainstate 对应的区块
+func (u UTXOSet) storedTip() ([]byte, error) {
+	var tip []byte
+
+	err := u.Blockchain.DB.View(func(tx storage.Tx) error {
+		tip = getUTXOTip(tx)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tip == nil {
+		return u.Blockchain.tip, nil
+	}
+
+	return tip, nil
+}
+
+// Disconnect 把 UTXO 集的最后一个区块撤销，恢复到前一个区块时的状态
+// 开启了缓存时先把缓存写入 chainstate，再直接在 chainstate 上撤销
+func (u UTXOSet) Disconnect(block *Block) error {
+	if cache := u.Blockchain.utxoCache; cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+
+		err := cache.flushAndReset()
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.Blockchain.DB.Update(func(tx storage.Tx) error {
+		return disconnectBlock(tx, block)
+	})
+}
+
+// flushAndReset 把缓存写入 chainstate 并清空缓存，之后直接修改 chainstate 时缓存中不会留下旧的记录，调用者需要持有 lock
+func (c *UTXOCache) flushAndReset() error {
+	err := c.flush()
+	if err != nil {
+		return err
+	}
+	c.reset()
+
+	return nil
+}
+
+// disconnectBlock 在事务中根据撤销数据把 chainstate 从 block 恢复到前一个区块时的状态
+func disconnectBlock(tx storage.Tx, block *Block) error {
+	if tip := getUTXOTip(tx); tip != nil && !bytes.Equal(tip, block.Hash) {
+		return errors.New("Block is not the tip of the UTXO set")
+	}
+
+	var undoData []byte
+	if undos := tx.Bucket([]byte(UNDO_BUCKET)); undos != nil {
+		undoData = undos.Get(block.Hash)
+	}
+	if undoData == nil {
+		return errors.New("Undo data of the block is not found")
+	}
+	undo, err := deserializeBlockUndo(undoData)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(UTXO_BUCKET))
+	stats, err := getUTXOStats(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range undo.Entries {
+		if current := b.Get(entry.TxID); current != nil && stats != nil {
+			err = stats.removeEntry(entry.TxID, current)
+			if err != nil {
+				return err
+			}
+		}
+
+		var value []byte
+		if len(entry.Outputs) > 0 {
+			value = entry.Outputs
+			if stats != nil {
+				err = stats.addEntry(entry.TxID, value)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = putUTXOEntry(tx, entry.TxID, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stats != nil {
+		err := putUTXOStats(tx, stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Bucket([]byte(UNDO_BUCKET)).Delete(block.Hash)
+	if err != nil {
+		return err
+	}
+
+	return putUTXOTip(tx, block.PrevBlockHash)
+}
+
+// SyncToTip 把 UTXO 集从它对应的区块更新到区块链的 tip
+// 如果中间发生了链重组，先撤销旧分支上的区块，再按顺序应用新分支上的区块，开销只与变化的区块数量有关
+func (u UTXOSet) SyncToTip() error {
+	bc := u.Blockchain
+
+	tip, err := u.Tip()
+	if err != nil {
+		return err
+	}
+
+	disconnect, connect, err := bc.findFork(tip, bc.tip)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range disconnect {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+
+		err = u.Disconnect(&block)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, hash := range connect {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			return err
+		}
+
+		err = u.Update(&block)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findFork 找到从 from 切换到 to 需要撤销和应用的区块
+// 撤销的区块从 from 开始向前排列，应用的区块按高度从低到高排列
+func (bc *Blockchain) findFork(from, to []byte) ([][]byte, [][]byte, error) {
+	var disconnect, connect [][]byte
+
+	fromHeader, err := bc.GetHeader(from)
+	if err != nil {
+		return nil, nil, err
+	}
+	toHeader, err := bc.GetHeader(to)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for !bytes.Equal(fromHeader.Hash, toHeader.Hash) {
+		// 先回退较高的一侧，高度相同时两侧一起回退，直到找到共同的祖先
+		if fromHeader.Height >= toHeader.Height {
+			disconnect = append(disconnect, fromHeader.Hash)
+			fromHeader, err = bc.GetHeader(fromHeader.PrevBlockHash)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if toHeader.Height > fromHeader.Height || (toHeader.Height == fromHeader.Height && !bytes.Equal(fromHeader.Hash, toHeader.Hash)) {
+			connect = append(connect, toHeader.Hash)
+			toHeader, err = bc.GetHeader(toHeader.PrevBlockHash)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	for i, j := 0, len(connect)-1; i < j; i, j = i+1, j-1 {
+		connect[i], connect[j] = connect[j], connect[i]
+	}
+
+	return disconnect, connect, nil
+}
@@ -0,0 +1,457 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"tchain/storage"
+)
+
+// verifychain 的检查级别，每一级都包含前面所有级别的检查
+const (
+	VERIFY_LEVEL_LINKAGE    = 0 // 区块头的链接和高度，区块内容与区块头一致
+	VERIFY_LEVEL_BLOCKS     = 1 // 工作量证明、Merkle 树根和交易 ID
+	VERIFY_LEVEL_SIGNATURES = 2 // 交易签名
+	VERIFY_LEVEL_UTXO       = 3 // 撤销数据与区块一致，在内存中重建 UTXO 集并与 chainstate 比较
+)
+
+const DEFAULT_VERIFY_DEPTH = 6
+const DEFAULT_VERIFY_LEVEL = VERIFY_LEVEL_UTXO
+
+// ChainIssue 检查中发现的一个问题以及相关的区块
+type ChainIssue struct {
+	BlockHash []byte
+	Problem   string
+}
+
+// ChainVerification 检查的结果
+type ChainVerification struct {
+	Blocks      int  // 检查过的区块数量
+	UTXOChecked bool // 是否比较了 UTXO 集
+	Issues      []ChainIssue
+}
+
+func (v *ChainVerification) report(hash []byte, format string, args ...interface{}) {
+	v.Issues = append(v.Issues, ChainIssue{BlockHash: hash, Problem: fmt.Sprintf(format, args...)})
+}
+
+// VerifyChain 从 tip 开始向前检查 depth 个区块，depth 不大于 0 时检查整条链
+// 检查只读取数据，第 3 级的 UTXO 集也在内存中重建，不会写入数据库或者缓存；
+// 发现的问题全部记录在结果中，而不会在第一个问题处停止，只有数据库无法读取时才返回错误
+func (bc *Blockchain) VerifyChain(depth, level int) (*ChainVerification, error) {
+	result := &ChainVerification{}
+
+	pruneHeight, err := bc.PruneHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotBase, err := bc.SnapshotBase()
+	if err != nil {
+		return nil, err
+	}
+	snapshotPending := snapshotBase != nil
+
+	header, err := bc.GetHeader(bc.tip)
+	if err != nil {
+		result.report(bc.tip, "Header of the tip is missing")
+		return result, nil
+	}
+
+	for depth <= 0 || result.Blocks < depth {
+		hash := header.Hash
+		result.Blocks++
+
+		block, err := bc.GetBlock(hash)
+		switch {
+		case err == nil:
+			bc.verifyBlock(result, header, &block, level)
+
+			if level >= VERIFY_LEVEL_UTXO {
+				err = bc.verifyUndo(result, &block)
+				if err != nil {
+					return nil, err
+				}
+			}
+		case err == ErrBlockPruned && (header.Height < pruneHeight || snapshotPending):
+			// 被裁剪或者还没有下载的区块只检查区块头
+		default:
+			result.report(hash, "Block at height %d cannot be read: %v", header.Height, err)
+		}
+
+		if len(header.PrevBlockHash) == 0 {
+			if header.Height != 0 {
+				result.report(hash, "Block without a previous block has height %d", header.Height)
+			}
+			break
+		}
+
+		prev, err := bc.GetHeader(header.PrevBlockHash)
+		if err != nil {
+			// 从快照启动的节点还没有快照之前的区块头
+			if !snapshotPending {
+				result.report(hash, "Previous block %x is missing", header.PrevBlockHash)
+			}
+			break
+		}
+
+		if prev.Height != header.Height-1 {
+			result.report(hash, "Height %d does not follow the previous block height %d", header.Height, prev.Height)
+		}
+
+		header = prev
+	}
+
+	if level >= VERIFY_LEVEL_UTXO {
+		fullHistory := pruneHeight == 0 && !snapshotPending
+		if fullHistory {
+			err = bc.verifyUTXOSet(result)
+			if err != nil {
+				return nil, err
+			}
+			result.UTXOChecked = true
+		} else {
+			fmt.Println("The UTXO set is not checked because the block history is pruned or incomplete.")
+		}
+	}
+
+	return result, nil
+}
+
+// verifyBlock 检查区块内容与区块头是否一致，以及区块本身是否有效
+func (bc *Blockchain) verifyBlock(result *ChainVerification, header *BlockHeader, block *Block, level int) {
+	hash := header.Hash
+
+	if !bytes.Equal(block.Hash, hash) || !bytes.Equal(block.PrevBlockHash, header.PrevBlockHash) || block.Height != header.Height {
+		result.report(hash, "Block content does not match its header")
+	}
+
+	if level < VERIFY_LEVEL_BLOCKS {
+		return
+	}
+
+	if !NewProofOfWork(block).Validate() {
+		result.report(hash, "Invalid proof of work")
+	}
+
+	if len(block.Transactions) == 0 {
+		result.report(hash, "Block has no transactions")
+		return
+	}
+
+	if !bytes.Equal(block.HashTransactions(), header.MerkleRoot) {
+		result.report(hash, "Merkle root does not match the transactions")
+	}
+
+	// 矿工节点把 coinbase 放在交易列表的末尾，所以只检查数量，不检查位置
+	coinbases := 0
+
+	for _, tx := range block.Transactions {
+		if !bytes.Equal(tx.ID, unsignedHash(tx)) {
+			result.report(hash, "Transaction %x has an invalid ID", tx.ID)
+		}
+
+		if tx.IsCoinbase() {
+			coinbases++
+		}
+
+		if level >= VERIFY_LEVEL_SIGNATURES && !tx.IsCoinbase() {
+			bc.verifySignatures(result, hash, tx)
+		}
+	}
+
+	if coinbases != 1 {
+		result.report(hash, "Block has %d coinbase transactions", coinbases)
+	}
+}
+
+// unsignedHash 交易 ID 是在签名之前计算的，验证时需要去掉输入中的签名
+func unsignedHash(tx *Transaction) []byte {
+	txCopy := *tx
+	txCopy.VIn = make([]TXInput, len(tx.VIn))
+	copy(txCopy.VIn, tx.VIn)
+
+	for i := range txCopy.VIn {
+		txCopy.VIn[i].Signature = nil
+	}
+
+	return txCopy.Hash()
+}
+
+// verifySignatures 检查交易引用的输出是否存在以及签名是否有效
+func (bc *Blockchain) verifySignatures(result *ChainVerification, hash []byte, tx *Transaction) {
+	prevTXs := make(map[string]Transaction)
+
+	for _, vin := range tx.VIn {
+		prevTX, err := bc.FindTransaction(vin.TxID)
+		if err != nil {
+			result.report(hash, "Transaction %x spends unknown transaction %x", tx.ID, vin.TxID)
+			return
+		}
+
+		if vin.VOut < 0 || vin.VOut >= len(prevTX.VOut) {
+			result.report(hash, "Transaction %x spends missing output %x:%d", tx.ID, vin.TxID, vin.VOut)
+			return
+		}
+
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+
+	if !tx.Verify(prevTXs) {
+		result.report(hash, "Transaction %x has an invalid signature", tx.ID)
+	}
+}
+
+// verifyUndo 检查区块的撤销数据能否把区块从 UTXO 集中撤销：区块修改的每条记录都有且只有一条撤销记录，
+// 区块创建的交易在区块之前不存在，区块花费的输出在区块之前存在
+// 重建 UTXO 集或者下载快照之前的历史区块时不会生成撤销数据，所以没有撤销数据的区块不报告问题
+func (bc *Blockchain) verifyUndo(result *ChainVerification, block *Block) error {
+	var data []byte
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		if undos := tx.Bucket([]byte(UNDO_BUCKET)); undos != nil {
+			if v := undos.Get(block.Hash); v != nil {
+				data = append([]byte{}, v...)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return nil
+	}
+
+	undo, err := deserializeBlockUndo(data)
+	if err != nil {
+		result.report(block.Hash, "Undo data cannot be decoded: %v", err)
+		return nil
+	}
+
+	entries := make(map[string][]byte)
+	for _, entry := range undo.Entries {
+		if _, ok := entries[string(entry.TxID)]; ok {
+			result.report(block.Hash, "Undo data has more than one entry for transaction %x", entry.TxID)
+		}
+		entries[string(entry.TxID)] = entry.Outputs
+	}
+
+	// 同一个区块中创建又被花费的输出只需要撤销创建
+	created := make(map[string]bool)
+	spent := make(map[string][]int)
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, vin := range tx.VIn {
+				if !created[string(vin.TxID)] {
+					spent[string(vin.TxID)] = append(spent[string(vin.TxID)], vin.VOut)
+				}
+			}
+		}
+		created[string(tx.ID)] = true
+	}
+
+	for txID := range created {
+		outputs, ok := entries[txID]
+		if !ok {
+			result.report(block.Hash, "Undo data has no entry for transaction %x", txID)
+		} else if len(outputs) > 0 {
+			result.report(block.Hash, "Undo data restores outputs of transaction %x created by the block", txID)
+		}
+	}
+
+	for txID, vouts := range spent {
+		outputs, ok := entries[txID]
+		if !ok {
+			result.report(block.Hash, "Undo data has no entry for transaction %x", txID)
+			continue
+		}
+
+		outs, err := DeserializeOutputs(outputs)
+		if err != nil {
+			result.report(block.Hash, "Undo data of transaction %x cannot be decoded: %v", txID, err)
+			continue
+		}
+
+		for _, vout := range vouts {
+			if _, found := findOutput(outs, vout); !found {
+				result.report(block.Hash, "Undo data does not restore the spent output %x:%d", txID, vout)
+			}
+		}
+	}
+
+	for txID := range entries {
+		if _, ok := spent[txID]; !ok && !created[txID] {
+			result.report(block.Hash, "Undo data has an entry for transaction %x that the block does not modify", txID)
+		}
+	}
+
+	return nil
+}
+
+// verifyUTXOSet 根据区块在内存中重新计算 UTXO 集，与 chainstate 逐条比较，不修改数据库
+// 开启了缓存时比较的是缓存中的修改覆盖 chainstate 之后的结果，也就是区块链的 tip 对应的 UTXO 集
+// 不一致的记录使用创建该交易的区块报告，chainstate 中多余的记录找不到区块时使用 UTXO 集对应的区块
+func (bc *Blockchain) verifyUTXOSet(result *ChainVerification) error {
+	// 记录每笔交易所在的区块
+	txBlocks := make(map[string][]byte)
+	bci := bc.Iterator()
+	for {
+		block, err := bci.Next()
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			break
+		}
+
+		for _, tx := range block.Transactions {
+			txBlocks[string(tx.ID)] = block.Hash
+		}
+	}
+
+	utxos, err := bc.FindUTXO()
+	if err != nil {
+		return err
+	}
+
+	utxoTip, err := UTXOSet{Blockchain: bc}.Tip()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(utxoTip, bc.tip) {
+		result.report(utxoTip, "UTXO set is at block %x, but the tip is %x", utxoTip, bc.tip)
+	}
+
+	blockOf := func(txID []byte) []byte {
+		if hash, ok := txBlocks[string(txID)]; ok {
+			return hash
+		}
+
+		return utxoTip
+	}
+
+	chainstate, stored, err := bc.readChainstate()
+	if err != nil {
+		return err
+	}
+	if chainstate == nil {
+		result.report(bc.tip, "chainstate is missing")
+		return nil
+	}
+
+	expectedStats := newUTXOStats()
+
+	for txID, expected := range utxos {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
+		}
+
+		err = expectedStats.addEntry(key, expected.Serialize())
+		if err != nil {
+			return err
+		}
+
+		value, ok := chainstate[string(key)]
+		if !ok {
+			result.report(blockOf(key), "Unspent outputs of transaction %x are missing from chainstate", key)
+			continue
+		}
+
+		actual, err := DeserializeOutputs(value)
+		if err != nil {
+			result.report(blockOf(key), "Unspent outputs of transaction %x cannot be decoded: %v", key, err)
+			continue
+		}
+
+		if !sameOutputs(expected, actual) {
+			result.report(blockOf(key), "Unspent outputs of transaction %x differ from chainstate", key)
+		}
+	}
+
+	for key := range chainstate {
+		if _, ok := utxos[hex.EncodeToString([]byte(key))]; !ok {
+			result.report(blockOf([]byte(key)), "chainstate has outputs of transaction %x that are spent or unknown", key)
+		}
+	}
+
+	if stored != nil {
+		if stored.Transactions != expectedStats.Transactions || stored.Outputs != expectedStats.Outputs ||
+			stored.Amount != expectedStats.Amount || stored.Size != expectedStats.Size || !bytes.Equal(stored.Hash(), expectedStats.Hash()) {
+			result.report(utxoTip, "UTXO set statistics do not match the rebuilt UTXO set")
+		}
+	}
+
+	return nil
+}
+
+// readChainstate 读取 chainstate 中的所有记录和统计信息，开启了缓存时缓存中的修改优先，只读取而不写入缓存
+// chainstate 不存在时返回 nil，旧版本的数据库没有统计信息时返回的统计信息为 nil
+func (bc *Blockchain) readChainstate() (map[string][]byte, *UTXOStats, error) {
+	var chainstate map[string][]byte
+	var stats *UTXOStats
+
+	cache := bc.utxoCache
+	if cache != nil {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+	}
+
+	err := bc.DB.View(func(tx storage.Tx) error {
+		b := tx.Bucket([]byte(UTXO_BUCKET))
+		if b == nil {
+			return nil
+		}
+
+		chainstate = make(map[string][]byte)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			chainstate[string(k)] = append([]byte{}, v...)
+		}
+
+		var err error
+		stats, err = getUTXOStats(tx)
+
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cache != nil && chainstate != nil {
+		for key, entry := range cache.entries {
+			if entry.value == nil {
+				delete(chainstate, key)
+			} else {
+				chainstate[key] = entry.value
+			}
+		}
+
+		// 缓存加载后统计信息随缓存一起更新，chainstate 中保存的是上次写入时的统计信息
+		if cache.tip != nil {
+			stats = cache.stats
+		}
+	}
+
+	return chainstate, stats, nil
+}
+
+// sameOutputs 比较解码后的输出，gob 编码的结果与进程有关，不能直接比较字节
+func sameOutputs(a, b TXOutputs) bool {
+	if len(a.Outputs) != len(b.Outputs) {
+		return false
+	}
+
+	for i := range a.Outputs {
+		if a.Outputs[i].Value != b.Outputs[i].Value ||
+			!bytes.Equal(a.Outputs[i].PubKeyHash, b.Outputs[i].PubKeyHash) ||
+			a.Index(i) != b.Index(i) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"bytes"
+	"strings"
+	"tchain/storage"
+	"testing"
+)
+
+// verify 检查整条链，返回发现的问题
+func (c *testChain) verify(t *testing.T, level int) []ChainIssue {
+	result, err := c.bc.VerifyChain(0, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return result.Issues
+}
+
+// assertDetectedAt 检查问题在 level 被发现，而在更低的级别不会被发现
+func assertDetectedAt(t *testing.T, c *testChain, level int, hash []byte, problem string) {
+	t.Helper()
+
+	for l := VERIFY_LEVEL_LINKAGE; l < level; l++ {
+		if issues := c.verify(t, l); len(issues) > 0 {
+			t.Fatalf("level %d found %v, want no issues", l, issues)
+		}
+	}
+
+	for _, issue := range c.verify(t, level) {
+		if bytes.Equal(issue.BlockHash, hash) && strings.Contains(issue.Problem, problem) {
+			return
+		}
+	}
+	t.Fatalf("level %d did not report %q for block %x", level, problem, hash)
+}
+
+// update 在一个事务中修改数据库，用于构造损坏的数据
+func (c *testChain) update(t *testing.T, fn func(tx storage.Tx) error) {
+	err := c.bc.DB.Update(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newVerifyTestChain(t *testing.T) *testChain {
+	c := newTestChain(t)
+	alice := newWallet(t)
+
+	c.mine(t, c.send(t, c.miner, alice, 3))
+	c.mine(t, c.send(t, alice, c.miner, 1))
+
+	for level := VERIFY_LEVEL_LINKAGE; level <= VERIFY_LEVEL_UTXO; level++ {
+		if issues := c.verify(t, level); len(issues) > 0 {
+			t.Fatalf("level %d found %v in a valid chain", level, issues)
+		}
+	}
+
+	return c
+}
+
+func TestVerifyChainDetectsBlockNotMatchingHeader(t *testing.T) {
+	c := newVerifyTestChain(t)
+	tip := c.tip(t)
+
+	// 以 tip 的哈希保存高度不同的区块
+	corrupted := *tip
+	corrupted.Height++
+	c.update(t, func(tx storage.Tx) error {
+		return c.bc.putBlock(tx, &corrupted)
+	})
+
+	assertDetectedAt(t, c, VERIFY_LEVEL_LINKAGE, tip.Hash, "does not match its header")
+}
+
+func TestVerifyChainDetectsBadProofOfWork(t *testing.T) {
+	c := newVerifyTestChain(t)
+	tip := c.tip(t)
+
+	corrupted := *tip
+	corrupted.Nonce++
+	c.update(t, func(tx storage.Tx) error {
+		return c.bc.putBlock(tx, &corrupted)
+	})
+
+	assertDetectedAt(t, c, VERIFY_LEVEL_BLOCKS, tip.Hash, "Invalid proof of work")
+}
+
+func TestVerifyChainDetectsBadSignature(t *testing.T) {
+	c := newTestChain(t)
+	alice := newWallet(t)
+	c.mine(t, c.send(t, c.miner, alice, 3))
+
+	// 签名不参与交易 ID 的计算，修改签名后重新挖出的区块的工作量证明和 Merkle 树根仍然有效
+	tx := c.send(t, alice, c.miner, 1)
+	tx.VIn[0].Signature[0] ^= 0xff
+	block := c.block(c.tip(t), tx)
+
+	c.update(t, func(dbTx storage.Tx) error {
+		err := c.bc.putBlock(dbTx, block)
+		if err != nil {
+			return err
+		}
+
+		err = putHeader(dbTx, block)
+		if err != nil {
+			return err
+		}
+
+		return dbTx.Bucket([]byte(BLOCKS_BUCKET)).Put([]byte("l"), block.Hash)
+	})
+	c.bc.tip = block.Hash
+
+	assertDetectedAt(t, c, VERIFY_LEVEL_SIGNATURES, block.Hash, "invalid signature")
+}
+
+func TestVerifyChainDetectsCorruptUndoData(t *testing.T) {
+	c := newVerifyTestChain(t)
+	tip := c.tip(t)
+
+	c.update(t, func(tx storage.Tx) error {
+		return putUndo(tx, tip.Hash, blockUndo{})
+	})
+
+	assertDetectedAt(t, c, VERIFY_LEVEL_UTXO, tip.Hash, "Undo data has no entry")
+}
+
+func TestVerifyChainDetectsMissingUTXOEntry(t *testing.T) {
+	c := newVerifyTestChain(t)
+	tip := c.tip(t)
+
+	// 删除 tip 中的 coinbase 的输出
+	coinbase := tip.Transactions[len(tip.Transactions)-1]
+	c.update(t, func(tx storage.Tx) error {
+		return putUTXOEntry(tx, coinbase.ID, nil)
+	})
+
+	assertDetectedAt(t, c, VERIFY_LEVEL_UTXO, tip.Hash, "missing from chainstate")
+}
+
+func TestVerifyChainDoesNotFlushUTXOCache(t *testing.T) {
+	c := newTestChain(t)
+	c.bc.EnableUTXOCache(DEFAULT_UTXO_CACHE_SIZE, 100)
+	genesis := c.bc.Tip()
+	alice := newWallet(t)
+
+	c.mine(t, c.send(t, c.miner, alice, 3))
+
+	// 缓存中的修改覆盖 chainstate 之后与区块一致
+	if issues := c.verify(t, VERIFY_LEVEL_UTXO); len(issues) > 0 {
+		t.Fatalf("found %v with unflushed cache", issues)
+	}
+
+	utxoTip, err := c.utxoSet.storedTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(utxoTip, genesis) {
+		t.Fatalf("chainstate is at %x after verifying, want %x", utxoTip, genesis)
+	}
+}
@@ -0,0 +1,154 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"math"
+)
+
+// 过滤器的大小和哈希函数数量的上限，防止轻节点让全节点做过多的计算
+const MAX_FILTER_SIZE = 36000
+const MAX_HASH_FUNCS = 50
+
+// 不同哈希函数之间种子的间隔
+const SEED_MULTIPLIER = 0xfba4c795
+
+// 匹配到输出时如何更新过滤器
+const (
+	UPDATE_NONE = byte(0) // 不更新过滤器
+	UPDATE_ALL  = byte(1) // 把匹配到的输出的 outpoint 加入过滤器，以便匹配之后花费它的交易
+)
+
+// Filter 布隆过滤器
+// 轻节点把关心的数据（公钥哈希、公钥等）加入过滤器后发送给全节点，全节点只转发匹配的交易
+// 布隆过滤器可能误判匹配，但不会漏判，误判率越高轻节点的隐私越好，但浪费的带宽越多
+type Filter struct {
+	Data      []byte // 位数组
+	HashFuncs uint32 // 哈希函数的数量
+	Tweak     uint32 // 随机数，使不同过滤器的哈希函数不同
+	Flags     byte   // 更新方式
+}
+
+// NewFilter 根据预计加入的元素数量和期望的误判率计算位数组大小和哈希函数数量，返回一个空的过滤器
+func NewFilter(elements int, fpRate float64, tweak uint32, flags byte) *Filter {
+	if elements < 1 {
+		elements = 1
+	}
+	if fpRate <= 0 {
+		fpRate = 1e-9
+	}
+	if fpRate >= 1 {
+		fpRate = 0.999
+	}
+
+	// 最优的位数组大小为 -n * ln(p) / (ln2)^2
+	size := int(-1 / (math.Ln2 * math.Ln2) * float64(elements) * math.Log(fpRate) / 8)
+	if size < 1 {
+		size = 1
+	}
+	if size > MAX_FILTER_SIZE {
+		size = MAX_FILTER_SIZE
+	}
+
+	// 最优的哈希函数数量为 m / n * ln2
+	hashFuncs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if hashFuncs < 1 {
+		hashFuncs = 1
+	}
+	if hashFuncs > MAX_HASH_FUNCS {
+		hashFuncs = MAX_HASH_FUNCS
+	}
+
+	return &Filter{
+		Data:      make([]byte, size),
+		HashFuncs: hashFuncs,
+		Tweak:     tweak,
+		Flags:     flags,
+	}
+}
+
+// bitIndex 返回第 n 个哈希函数在位数组中的位置
+func (f *Filter) bitIndex(n uint32, data []byte) uint32 {
+	return murmur3(n*SEED_MULTIPLIER+f.Tweak, data) % uint32(len(f.Data)*8)
+}
+
+// Add 将数据加入过滤器
+func (f *Filter) Add(data []byte) {
+	if len(f.Data) == 0 {
+		return
+	}
+
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bitIndex(i, data)
+		f.Data[index>>3] |= 1 << (index & 7)
+	}
+}
+
+// Matches 检查数据是否可能在过滤器中
+func (f *Filter) Matches(data []byte) bool {
+	if len(f.Data) == 0 {
+		return false
+	}
+
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		index := f.bitIndex(i, data)
+		if f.Data[index>>3]&(1<<(index&7)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsValid 检查过滤器的参数是否在允许的范围内
+func (f *Filter) IsValid() bool {
+	return len(f.Data) > 0 && len(f.Data) <= MAX_FILTER_SIZE && f.HashFuncs > 0 && f.HashFuncs <= MAX_HASH_FUNCS
+}
+
+// FalsePositiveRate 根据已设置的位估算当前的误判率
+func (f *Filter) FalsePositiveRate() float64 {
+	if len(f.Data) == 0 {
+		return 1
+	}
+
+	set := 0
+	for _, b := range f.Data {
+		for ; b != 0; b &= b - 1 {
+			set++
+		}
+	}
+
+	return math.Pow(float64(set)/float64(len(f.Data)*8), float64(f.HashFuncs))
+}
+
+// Serialize 序列化过滤器
+func (f *Filter) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(f)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// DeserializeFilter 反序列化过滤器，并检查参数是否有效
+func DeserializeFilter(data []byte) (*Filter, error) {
+	var filter Filter
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !filter.IsValid() {
+		return nil, errors.New("Bloom filter is too large or has too many hash functions")
+	}
+
+	return &filter, nil
+}
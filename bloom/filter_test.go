@@ -0,0 +1,79 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+func element(prefix string, i int) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, uint32(i))
+
+	return append([]byte(prefix), data...)
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	const probes = 100000
+
+	for _, tc := range []struct {
+		elements int
+		fpRate   float64
+	}{
+		{10, 0.01},
+		{100, 0.01},
+		{1000, 0.001},
+		{1000, 0.05},
+		{5000, 0.0001},
+	} {
+		t.Run(fmt.Sprintf("%d elements at %g", tc.elements, tc.fpRate), func(t *testing.T) {
+			f := NewFilter(tc.elements, tc.fpRate, 0x5eed, UPDATE_NONE)
+			if !f.IsValid() {
+				t.Fatal("filter is not valid")
+			}
+
+			for i := 0; i < tc.elements; i++ {
+				f.Add(element("in", i))
+			}
+
+			// 布隆过滤器不会漏判
+			for i := 0; i < tc.elements; i++ {
+				if !f.Matches(element("in", i)) {
+					t.Fatalf("false negative for element %d", i)
+				}
+			}
+
+			falsePositives := 0
+			for i := 0; i < probes; i++ {
+				if f.Matches(element("out", i)) {
+					falsePositives++
+				}
+			}
+
+			// 位数组大小和哈希函数数量取整后误判率会略高于目标，允许两倍的误差，再加上抽样的误差
+			measured := float64(falsePositives) / probes
+			tolerance := 2*tc.fpRate + 3/float64(probes)
+			if measured > tolerance {
+				t.Fatalf("measured false positive rate %g, target %g", measured, tc.fpRate)
+			}
+
+			estimated := f.FalsePositiveRate()
+			if estimated > tolerance {
+				t.Fatalf("estimated false positive rate %g, target %g", estimated, tc.fpRate)
+			}
+		})
+	}
+}
+
+func TestSerialize(t *testing.T) {
+	f := NewFilter(10, 0.01, 1, UPDATE_ALL)
+	f.Add([]byte("data"))
+
+	decoded, err := DeserializeFilter(f.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Matches([]byte("data")) || decoded.Flags != UPDATE_ALL || decoded.Tweak != 1 {
+		t.Fatal("decoded filter differs")
+	}
+}
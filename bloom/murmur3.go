@@ -0,0 +1,53 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// murmur3 32 位 MurmurHash3，布隆过滤器的各个哈希函数使用不同的种子
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1 = 0xcc9e2d51
+	const c2 = 0x1b873593
+
+	h := seed
+	blocks := len(data) / 4
+
+	for i := 0; i < blocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	// 处理剩余不足 4 字节的数据
+	tail := data[blocks*4:]
+	var k uint32
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+
+	return h
+}
@@ -0,0 +1,22 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"tchain/server"
+)
+
+func (cli *CLI) clearBanned(address, nodeID string) {
+	banned, err := server.ClearBanned(fmt.Sprintf("localhost:%s", nodeID), address)
+	if err != nil {
+		fmt.Printf("Cannot connect to node %s: %s\n", nodeID, err)
+		os.Exit(1)
+	}
+
+	if address == "" {
+		fmt.Println("Cleared all bans")
+	} else {
+		fmt.Printf("Cleared the ban of %s\n", address)
+	}
+	printBanned(banned)
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"tchain/blockchain"
+	"tchain/server"
 )
 
 // CLI 负责处理命令行参数
@@ -13,14 +15,24 @@ type CLI struct{}
 // printUsage 打印使用方法
 func (cli *CLI) printUsage() {
 	fmt.Println("Usage:")
+	fmt.Println("  clearbanned -address ADDRESS - Lift the ban of ADDRESS on the running node, or all bans when -address is not set")
 	fmt.Println("  createblockchain -address ADDRESS - Create a blockchain and send genesis block reward to ADDRESS")
 	fmt.Println("  createwallet - Generates a new key-pair and saves it into the wallet file")
-	fmt.Println("  getbalance -address ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  dumputxo -file FILE - Write a snapshot of the UTXO set at the current tip to FILE")
+	fmt.Println("  getbalance -address ADDRESS -light - Get balance of ADDRESS. Use the light node header database when -light is set.")
+	fmt.Println("  getmerkleproof -txid TXID - Print the merkle proof of transaction TXID")
+	fmt.Println("  getpeerinfo - Print the peers of the running node, including the measured ping latency")
+	fmt.Println("  gettxoutsetinfo - Print statistics and the MuHash of the UTXO set")
 	fmt.Println("  listaddresses - Lists all addresses from the wallet file")
+	fmt.Println("  listbanned - Print the addresses banned by the running node for misbehavior")
+	fmt.Println("  loadutxo -file FILE -hash HASH - Create a blockchain starting from the UTXO snapshot in FILE, whose hash must be HASH")
 	fmt.Println("  printchain - Print all the blocks of the blockchain")
+	fmt.Println("  rebuildblockindex - Rebuilds the block index from the blk*.dat block files")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
 	fmt.Println("  send -from FROM -to TO -amount AMOUNT -mine - Send AMOUNT of coins from FROM address to TO. Mine on the same node, when -mine is set.")
-	fmt.Println("  startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println("  verifychain -depth N -level L - Check the last N blocks (all blocks when N is 0) of the local database. Level 0 checks linkage and heights, 1 adds proof of work, merkle roots and transaction IDs, 2 adds signatures, 3 rebuilds the UTXO set and compares it with chainstate")
+	fmt.Println("  verifymerkleproof -root ROOT -proof PROOF - Verify PROOF against merkle root ROOT offline")
+	fmt.Println("  startnode -miner ADDRESS -light -cfilters -prune DEPTH -dbcache MB -flushinterval N -banduration DURATION - Start a node with ID specified in NODE_ID env. var. -miner enables mining, -light syncs block headers only, -cfilters matches compact block filters locally instead of loading a bloom filter, -prune keeps only the last DEPTH full blocks, -dbcache sets the UTXO cache size in MB, -flushinterval writes the cache every N blocks, -banduration sets how long misbehaving peers are banned, e.g. 24h")
 }
 
 // validateArgs 验证参数
@@ -31,6 +43,17 @@ func (cli *CLI) validateArgs() {
 	}
 }
 
+// openBlockchain 打开节点的区块链，区块链不存在或者无法打开时打印原因并退出
+func openBlockchain(nodeID string) *blockchain.Blockchain {
+	bc, err := blockchain.NewBlockchain(nodeID)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	return bc
+}
+
 // Run 解析命令行参数并处理命令
 func (cli *CLI) Run() {
 	cli.validateArgs()
@@ -41,29 +64,75 @@ func (cli *CLI) Run() {
 		os.Exit(1)
 	}
 
+	clearBannedCmd := flag.NewFlagSet("clearbanned", flag.ExitOnError)
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
+	getMerkleProofCmd := flag.NewFlagSet("getmerkleproof", flag.ExitOnError)
+	getPeerInfoCmd := flag.NewFlagSet("getpeerinfo", flag.ExitOnError)
+	getTxOutSetInfoCmd := flag.NewFlagSet("gettxoutsetinfo", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
+	dumpUTXOCmd := flag.NewFlagSet("dumputxo", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	listBannedCmd := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	loadUTXOCmd := flag.NewFlagSet("loadutxo", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	rebuildBlockIndexCmd := flag.NewFlagSet("rebuildblockindex", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	verifyMerkleProofCmd := flag.NewFlagSet("verifymerkleproof", flag.ExitOnError)
 
+	clearBannedAddress := clearBannedCmd.String("address", "", "The banned IP or host:port, all bans when empty")
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address to get balance for")
+	getBalanceLight := getBalanceCmd.Bool("light", false, "Compute balance from the light node header database")
+	getMerkleProofTxID := getMerkleProofCmd.String("txid", "", "The transaction to prove")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "The address to send genesis block reward to")
+	dumpUTXOFile := dumpUTXOCmd.String("file", "", "The file to write the UTXO snapshot to")
+	loadUTXOFile := loadUTXOCmd.String("file", "", "The UTXO snapshot file")
+	loadUTXOHash := loadUTXOCmd.String("hash", "", "The trusted hash of the UTXO snapshot")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeLight := startNodeCmd.Bool("light", false, "Sync block headers only and verify wallet transactions with merkle proofs")
+	startNodeCFilters := startNodeCmd.Bool("cfilters", false, "In light mode, use compact block filters instead of a bloom filter")
+	startNodePrune := startNodeCmd.Int("prune", 0, "Delete full blocks deeper than DEPTH, keeping headers and the UTXO set")
+	startNodeDBCache := startNodeCmd.Int("dbcache", blockchain.DEFAULT_UTXO_CACHE_SIZE>>20, "Memory budget of the UTXO cache in MB")
+	startNodeFlushInterval := startNodeCmd.Int("flushinterval", blockchain.DEFAULT_UTXO_FLUSH_INTERVAL, "Write the UTXO cache to disk every N blocks")
+	startNodeBanDuration := startNodeCmd.Duration("banduration", server.DEFAULT_BAN_DURATION, "How long misbehaving peers are banned")
+	verifyChainDepth := verifyChainCmd.Int("depth", blockchain.DEFAULT_VERIFY_DEPTH, "Number of blocks to check from the tip, 0 for all blocks")
+	verifyChainLevel := verifyChainCmd.Int("level", blockchain.DEFAULT_VERIFY_LEVEL, "Thoroughness of the checks, from 0 to 3")
+	verifyMerkleRoot := verifyMerkleProofCmd.String("root", "", "The trusted merkle root of the block")
+	verifyMerkleProof := verifyMerkleProofCmd.String("proof", "", "The proof printed by getmerkleproof")
 
 	switch os.Args[1] {
+	case "clearbanned":
+		err := clearBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "getmerkleproof":
+		err := getMerkleProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpeerinfo":
+		err := getPeerInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettxoutsetinfo":
+		err := getTxOutSetInfoCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "createblockchain":
 		err := createBlockchainCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -74,16 +143,36 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "dumputxo":
+		err := dumpUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "listaddresses":
 		err := listAddressesCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "listbanned":
+		err := listBannedCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "loadutxo":
+		err := loadUTXOCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "printchain":
 		err := printChainCmd.Parse(os.Args[2:])
 		if err != nil {
 			log.Panic(err)
 		}
+	case "rebuildblockindex":
+		err := rebuildBlockIndexCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "reindexutxo":
 		err := reindexUTXOCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -99,17 +188,51 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifymerkleproof":
+		err := verifyMerkleProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
 	}
 
+	if clearBannedCmd.Parsed() {
+		cli.clearBanned(*clearBannedAddress, nodeID)
+	}
+
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress, nodeID)
+		if *getBalanceLight {
+			cli.getLightBalance(*getBalanceAddress, nodeID)
+		} else {
+			cli.getBalance(*getBalanceAddress, nodeID)
+		}
+	}
+
+	if getMerkleProofCmd.Parsed() {
+		if *getMerkleProofTxID == "" {
+			getMerkleProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.getMerkleProof(*getMerkleProofTxID, nodeID)
+	}
+
+	if getPeerInfoCmd.Parsed() {
+		cli.getPeerInfo(nodeID)
+	}
+
+	if getTxOutSetInfoCmd.Parsed() {
+		cli.getTxOutSetInfo(nodeID)
 	}
 
 	if createBlockchainCmd.Parsed() {
@@ -124,14 +247,38 @@ func (cli *CLI) Run() {
 		cli.createWallet(nodeID)
 	}
 
+	if dumpUTXOCmd.Parsed() {
+		if *dumpUTXOFile == "" {
+			dumpUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.dumpUTXO(*dumpUTXOFile, nodeID)
+	}
+
 	if listAddressesCmd.Parsed() {
 		cli.listAddresses(nodeID)
 	}
 
+	if listBannedCmd.Parsed() {
+		cli.listBanned(nodeID)
+	}
+
+	if loadUTXOCmd.Parsed() {
+		if *loadUTXOFile == "" || *loadUTXOHash == "" {
+			loadUTXOCmd.Usage()
+			os.Exit(1)
+		}
+		cli.loadUTXO(*loadUTXOFile, *loadUTXOHash, nodeID)
+	}
+
 	if printChainCmd.Parsed() {
 		cli.printChain(nodeID)
 	}
 
+	if rebuildBlockIndexCmd.Parsed() {
+		cli.rebuildBlockIndex(nodeID)
+	}
+
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
@@ -145,12 +292,32 @@ func (cli *CLI) Run() {
 		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
 	}
 
+	if verifyChainCmd.Parsed() {
+		if *verifyChainDepth < 0 || *verifyChainLevel < 0 || *verifyChainLevel > blockchain.VERIFY_LEVEL_UTXO {
+			verifyChainCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyChain(*verifyChainDepth, *verifyChainLevel, nodeID)
+	}
+
+	if verifyMerkleProofCmd.Parsed() {
+		if *verifyMerkleRoot == "" || *verifyMerkleProof == "" {
+			verifyMerkleProofCmd.Usage()
+			os.Exit(1)
+		}
+		cli.verifyMerkleProof(*verifyMerkleRoot, *verifyMerkleProof)
+	}
+
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.startNode(nodeID, *startNodeMiner)
+		if *startNodeLight {
+			cli.startLightNode(nodeID, *startNodeCFilters, *startNodeBanDuration)
+		} else {
+			cli.startNode(nodeID, *startNodeMiner, *startNodePrune, *startNodeDBCache, *startNodeFlushInterval, *startNodeBanDuration)
+		}
 	}
 }
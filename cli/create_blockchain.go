@@ -1,8 +1,10 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"tchain/blockchain"
 	"tchain/wallet"
 )
@@ -11,12 +13,22 @@ func (cli *CLI) createBlockchain(address string, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := blockchain.CreateBlockchain(address, nodeID)
+	bc, err := blockchain.CreateBlockchain(address, nodeID)
+	if errors.Is(err, blockchain.ErrChainExists) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 	defer bc.DB.Close()
 
 	// 当一个新的区块链被创建以后，就会立刻进行重建索引
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	err = UTXOSet.Reindex()
+	if err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Println("Done!")
 }
@@ -2,13 +2,21 @@ package cli
 
 import (
 	"fmt"
+	"log"
 	"tchain/wallet"
 )
 
 func (cli *CLI) createWallet(nodeID string) {
 	wallets, _ := wallet.NewWallets(nodeID)
-	address := wallets.CreateWallet()
-	wallets.SaveToFile(nodeID)
+	address, err := wallets.CreateWallet()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = wallets.SaveToFile(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	fmt.Printf("Your new address: %s\n", address)
 }
@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"tchain/blockchain"
+)
+
+func (cli *CLI) dumpUTXO(file, nodeID string) {
+	bc := openBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	snapshot, err := UTXOSet.Snapshot()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = ioutil.WriteFile(file, snapshot.Serialize(), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", snapshot.BlockHash)
+	fmt.Printf("Height: %d\n", snapshot.Height)
+	fmt.Printf("Transactions: %d\n", len(snapshot.Entries))
+	fmt.Printf("Hash: %x\n", snapshot.Hash)
+}
@@ -0,0 +1,36 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+func (cli *CLI) getMerkleProof(txID string, nodeID string) {
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("ERROR: Transaction ID is not valid")
+	}
+
+	bc := openBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	proof, err := bc.FindTransactionProof(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	block, err := bc.GetBlock(proof.BlockHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Merkle root: %x\n", block.HashTransactions())
+	fmt.Printf("Index: %d\n", proof.Proof.Index)
+	for i, hash := range proof.Proof.Hashes {
+		fmt.Printf("  Level %d: %x\n", i, hash)
+	}
+	fmt.Printf("Proof: %x\n", proof.Serialize())
+}
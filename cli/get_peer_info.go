@@ -0,0 +1,40 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"tchain/server"
+	"time"
+)
+
+func (cli *CLI) getPeerInfo(nodeID string) {
+	infos, err := server.GetPeerInfo(fmt.Sprintf("localhost:%s", nodeID))
+	if err != nil {
+		fmt.Printf("Cannot connect to node %s: %s\n", nodeID, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d peers\n", len(infos))
+	for _, info := range infos {
+		direction := "outbound"
+		if info.Inbound {
+			direction = "inbound"
+		}
+
+		latency := "-"
+		if info.Latency > 0 {
+			latency = info.Latency.Round(time.Microsecond).String()
+		}
+
+		fmt.Printf("============ %s ============\n", info.Address)
+		fmt.Printf("Direction: %s\n", direction)
+		fmt.Printf("User agent: %s\n", info.UserAgent)
+		fmt.Printf("Version: %d\n", info.Version)
+		fmt.Printf("Services: %s\n", info.ServiceNames())
+		fmt.Printf("Start height: %d\n", info.StartHeight)
+		fmt.Printf("Connected: %s ago\n", time.Since(info.ConnectedAt).Round(time.Second))
+		fmt.Printf("Last received: %s ago\n", time.Since(info.LastRecv).Round(time.Second))
+		fmt.Printf("Latency: %s\n", latency)
+		fmt.Println()
+	}
+}
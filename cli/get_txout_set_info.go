@@ -0,0 +1,31 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"tchain/blockchain"
+)
+
+func (cli *CLI) getTxOutSetInfo(nodeID string) {
+	bc := openBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	stats, err := UTXOSet.Stats()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Best block: %x\n", bc.Tip())
+	fmt.Printf("Transactions: %d\n", stats.Transactions)
+	fmt.Printf("Outputs: %d\n", stats.Outputs)
+	fmt.Printf("Total amount: %d\n", stats.Amount)
+	fmt.Printf("Size: %d bytes\n", stats.Size)
+	fmt.Printf("MuHash: %x\n", stats.Hash())
+}
@@ -12,14 +12,17 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := blockchain.NewBlockchain(nodeID)
+	bc := openBlockchain(nodeID)
 	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
 	defer bc.DB.Close()
 
 	balance := 0
 	pubKeyHash := common.Base58Decode([]byte(address))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUTXO(pubKeyHash)
+	UTXOs, err := UTXOSet.FindUTXO(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	for _, out := range UTXOs {
 		balance += out.Value
@@ -27,3 +30,34 @@ func (cli *CLI) getBalance(address string, nodeID string) {
 
 	fmt.Printf("Balance of '%s': %d\n", address, balance)
 }
+
+// getLightBalance 使用轻节点保存的区块头和经过验证的钱包交易计算余额
+func (cli *CLI) getLightBalance(address string, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("ERROR: Address is not valid")
+	}
+	hc, err := blockchain.NewHeaderChain(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer hc.DB.Close()
+
+	balance := 0
+	pubKeyHash := common.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	UTXOs, err := hc.FindUTXO(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+
+	height, err := hc.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Balance of '%s': %d (headers synced to height %d)\n", address, balance, height)
+}
@@ -0,0 +1,25 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"tchain/server"
+	"time"
+)
+
+func (cli *CLI) listBanned(nodeID string) {
+	banned, err := server.ListBanned(fmt.Sprintf("localhost:%s", nodeID))
+	if err != nil {
+		fmt.Printf("Cannot connect to node %s: %s\n", nodeID, err)
+		os.Exit(1)
+	}
+
+	printBanned(banned)
+}
+
+func printBanned(banned []server.BannedAddress) {
+	fmt.Printf("%d banned\n", len(banned))
+	for _, b := range banned {
+		fmt.Printf("%s until %s (%s left)\n", b.Address, b.Until.Format(time.RFC3339), time.Until(b.Until).Round(time.Second))
+	}
+}
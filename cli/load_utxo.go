@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"tchain/blockchain"
+)
+
+func (cli *CLI) loadUTXO(file, trustedHash, nodeID string) {
+	hash, err := hex.DecodeString(trustedHash)
+	if err != nil || len(hash) == 0 {
+		log.Panic("ERROR: Snapshot hash is not valid")
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	snapshot, err := blockchain.DeserializeUTXOSnapshot(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 快照的内容哈希必须与从可信来源得到的哈希一致
+	err = snapshot.Validate(hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	bc, err := blockchain.LoadUTXOSnapshot(nodeID, snapshot)
+	if errors.Is(err, blockchain.ErrChainExists) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+	defer bc.DB.Close()
+
+	fmt.Printf("Loaded %d transactions at height %d. Start the node to sync and validate the history.\n", len(snapshot.Entries), snapshot.Height)
+}
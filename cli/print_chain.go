@@ -2,22 +2,36 @@ package cli
 
 import (
 	"fmt"
+	"log"
 	"strconv"
 	"tchain/blockchain"
 )
 
 func (cli *CLI) printChain(nodeID string) {
-	bc := blockchain.NewBlockchain(nodeID)
+	bc := openBlockchain(nodeID)
 	defer bc.DB.Close()
 
 	bci := bc.Iterator()
 
 	for {
-		block := bci.Next()
+		block, err := bci.Next()
+		if err != nil {
+			log.Panic(err)
+		}
+		if block == nil {
+			pruneHeight, err := bc.PruneHeight()
+			if err != nil {
+				log.Panic(err)
+			}
+
+			fmt.Printf("Blocks below height %d are pruned\n", pruneHeight)
+			break
+		}
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Height: %d\n", block.Height)
 		fmt.Printf("Prev block: %x\n", block.PrevBlockHash)
+		fmt.Printf("Merkle root: %x\n", block.HashTransactions())
 		pow := blockchain.NewProofOfWork(block)
 		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
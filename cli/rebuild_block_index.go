@@ -0,0 +1,46 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"tchain/blockchain"
+)
+
+// rebuildBlockIndex 根据区块文件重建区块索引，用于数据库损坏或者丢失后的恢复
+func (cli *CLI) rebuildBlockIndex(nodeID string) {
+	bc, count, err := blockchain.RebuildBlockIndex(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer bc.DB.Close()
+
+	height, err := bc.GetBestHeight()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Indexed %d blocks, tip is %x at height %d.\n", count, bc.Tip(), height)
+
+	// 有完整的历史区块时重建 UTXO 集，否则只能从 chainstate 对应的区块继续更新
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	fullHistory, err := bc.HasFullHistory()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if fullHistory {
+		err = UTXOSet.Reindex()
+	} else {
+		_, err = bc.RecoverUTXOSet()
+	}
+	if err != nil {
+		log.Panic(err)
+	}
+
+	transactions, err := UTXOSet.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", transactions)
+}
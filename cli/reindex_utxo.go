@@ -2,14 +2,24 @@ package cli
 
 import (
 	"fmt"
+	"log"
 	"tchain/blockchain"
 )
 
 func (cli *CLI) reindexUTXO(nodeID string) {
-	bc := blockchain.NewBlockchain(nodeID)
-	UTXOSet := blockchain.UTXOSet{bc}
-	UTXOSet.Reindex()
+	bc := openBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
+	err := UTXOSet.Reindex()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	count, err := UTXOSet.CountTransactions()
+	if err != nil {
+		log.Panic(err)
+	}
 
-	count := UTXOSet.CountTransactions()
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
@@ -1,8 +1,10 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
 	"tchain/blockchain"
 	"tchain/server"
 	"tchain/wallet"
@@ -16,7 +18,7 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
 
-	bc := blockchain.NewBlockchain(nodeID)
+	bc := openBlockchain(nodeID)
 	UTXOSet := blockchain.UTXOSet{Blockchain: bc}
 	defer bc.DB.Close()
 
@@ -24,18 +26,39 @@ func (cli *CLI) send(from, to string, amount int, nodeID string, mineNow bool) {
 	if err != nil {
 		log.Panic(err)
 	}
-	wallet := wallets.GetWallet(from)
+	wallet, err := wallets.GetWallet(from)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	tx := blockchain.NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	tx, err := blockchain.NewUTXOTransaction(&wallet, to, amount, &UTXOSet)
+	if errors.Is(err, blockchain.ErrInsufficientFunds) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Panic(err)
+	}
 
 	if mineNow {
 		cbTx := blockchain.NewCoinbaseTX(from, "")
 		txs := []*blockchain.Transaction{cbTx, tx}
 
-		newBlock := bc.MineBlock(txs)
-		UTXOSet.Update(newBlock)
+		// 区块和 UTXO 集在同一个事务中写入
+		_, err = bc.MineBlock(txs)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		_, err = bc.Prune()
+		if err != nil {
+			log.Panic(err)
+		}
 	} else {
-		server.SendTx(server.KnownNodes[0], tx)
+		err = server.SendTx(server.CENTRAL_NODE, tx)
+		if err != nil {
+			log.Panic(err)
+		}
 	}
 
 	fmt.Println("Success!")
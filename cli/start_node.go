@@ -1,13 +1,17 @@
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"tchain/blockchain"
 	"tchain/server"
 	"tchain/wallet"
+	"time"
 )
 
-func (cli *CLI) startNode(nodeID, minerAddress string) {
+func (cli *CLI) startNode(nodeID, minerAddress string, pruneDepth, dbCache, flushInterval int, banDuration time.Duration) {
 	fmt.Printf("Starting node %s\n", nodeID)
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
@@ -16,5 +20,40 @@ func (cli *CLI) startNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	server.StartServer(nodeID, minerAddress)
+	if pruneDepth > 0 {
+		fmt.Printf("Pruning is on. Keeping the last %d blocks\n", pruneDepth)
+	}
+	err := server.StartServer(server.Config{
+		NodeID:        nodeID,
+		MinerAddress:  minerAddress,
+		PruneDepth:    pruneDepth,
+		CacheSize:     dbCache << 20,
+		FlushInterval: flushInterval,
+		BanDuration:   banDuration,
+	})
+	if errors.Is(err, blockchain.ErrChainNotFound) {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	exitOnForcedStop(err)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func (cli *CLI) startLightNode(nodeID string, cfilters bool, banDuration time.Duration) {
+	fmt.Printf("Starting light node %s\n", nodeID)
+	err := server.StartServer(server.Config{NodeID: nodeID, Light: true, CFilters: cfilters, BanDuration: banDuration})
+	exitOnForcedStop(err)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// exitOnForcedStop 停止节点期间再次收到中断信号时不再等待，直接退出，下次启动时会恢复 UTXO 集
+func exitOnForcedStop(err error) {
+	if errors.Is(err, server.ErrForcedExit) {
+		fmt.Println("Forced exit")
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// verifyChain 检查本地区块链数据库的完整性，发现问题时以非零状态退出
+func (cli *CLI) verifyChain(depth, level int, nodeID string) {
+	bc := openBlockchain(nodeID)
+	defer bc.DB.Close()
+
+	result, err := bc.VerifyChain(depth, level)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	for _, issue := range result.Issues {
+		fmt.Printf("Block %x: %s\n", issue.BlockHash, issue.Problem)
+	}
+
+	utxo := "not checked"
+	if result.UTXOChecked {
+		utxo = "checked"
+	}
+	fmt.Printf("Verified %d blocks at level %d, UTXO set %s, %d issues found.\n", result.Blocks, level, utxo, len(result.Issues))
+
+	if len(result.Issues) > 0 {
+		bc.DB.Close()
+		os.Exit(1)
+	}
+}
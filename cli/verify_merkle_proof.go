@@ -0,0 +1,39 @@
+package cli
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"tchain/blockchain"
+)
+
+// verifyMerkleProof 离线验证交易证明，不需要打开本地数据库
+func (cli *CLI) verifyMerkleProof(root string, proofData string) {
+	merkleRoot, err := hex.DecodeString(root)
+	if err != nil {
+		log.Panic("ERROR: Merkle root is not valid")
+	}
+
+	data, err := hex.DecodeString(proofData)
+	if err != nil {
+		log.Panic("ERROR: Proof is not valid")
+	}
+
+	proof, err := blockchain.DeserializeTransactionProof(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	tx, err := blockchain.DeserializeTransaction(proof.Transaction)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if !proof.Verify(merkleRoot) {
+		fmt.Printf("Proof of transaction %x is invalid!\n", tx.ID)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Transaction %x is included in block %x\n", tx.ID, proof.BlockHash)
+}
@@ -23,7 +23,11 @@ func Base58Encode(input []byte) []byte {
 	}
 
 	// https://en.bitcoin.it/wiki/Base58Check_encoding#Version_bytes
-	if input[0] == 0x00 {
+	// every leading zero byte is encoded as one leading '1', e.g. the version byte and a hash starting with 0x00
+	for _, b := range input {
+		if b != 0x00 {
+			break
+		}
 		result = append(result, b58Alphabet[0])
 	}
 
@@ -44,7 +48,10 @@ func Base58Decode(input []byte) []byte {
 
 	decoded := result.Bytes()
 
-	if input[0] == b58Alphabet[0] {
+	for _, b := range input {
+		if b != b58Alphabet[0] {
+			break
+		}
 		decoded = append([]byte{0x00}, decoded...)
 	}
 
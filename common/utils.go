@@ -17,6 +17,17 @@ func IntToHex(num int64) []byte {
 	return buff.Bytes()
 }
 
+// HexToInt 将 IntToHex 生成的字节数组转化回 int64
+func HexToInt(data []byte) int64 {
+	var num int64
+	err := binary.Read(bytes.NewReader(data), binary.BigEndian, &num)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return num
+}
+
 // ReverseBytes reverses a byte array
 func ReverseBytes(data []byte) {
 	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
@@ -0,0 +1,64 @@
+package gcs
+
+import "errors"
+
+// bitWriter 按位写入数据，高位在前
+type bitWriter struct {
+	data  []byte
+	count uint8 // 最后一个字节中已写入的位数
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count == 0 || w.count == 8 {
+		w.data = append(w.data, 0)
+		w.count = 0
+	}
+
+	if bit {
+		w.data[len(w.data)-1] |= 1 << (7 - w.count)
+	}
+	w.count++
+}
+
+// writeBits 写入 value 的低 n 位
+func (w *bitWriter) writeBits(value uint64, n uint8) {
+	for i := int(n) - 1; i >= 0; i-- {
+		w.writeBit(value&(1<<uint(i)) != 0)
+	}
+}
+
+// bitReader 按位读取数据，高位在前
+type bitReader struct {
+	data []byte
+	pos  int // 已读取的位数
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, errors.New("Unexpected end of filter")
+	}
+
+	bit := r.data[r.pos/8]&(1<<(7-uint(r.pos%8))) != 0
+	r.pos++
+
+	return bit, nil
+}
+
+// readBits 读取 n 位组成的整数
+func (r *bitReader) readBits(n uint8) (uint64, error) {
+	var value uint64
+
+	for i := uint8(0); i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+
+	return value, nil
+}
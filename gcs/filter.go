@@ -0,0 +1,185 @@
+package gcs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sort"
+)
+
+// Golomb-Rice 编码的参数，与 BIP158 的基础过滤器一致
+// P 为余数部分的位数，M 为误判率的倒数，误判率约为 1/M
+const (
+	P = 19
+	M = 784931
+)
+
+// KEY_SIZE SipHash 的密钥长度，取区块哈希的前 16 字节
+const KEY_SIZE = 16
+
+// Filter Golomb 编码集合（GCS）
+// 集合中的每个元素先被哈希到 [0, N*M) 的范围内，排序后对相邻元素的差值进行 Golomb-Rice 编码，
+// 与布隆过滤器相比，过滤器由全节点根据区块内容生成，轻节点下载后在本地匹配，不会向全节点暴露自己的地址
+type Filter struct {
+	N    uint32 // 元素数量
+	Data []byte // 编码后的数据
+}
+
+// hashToRange 将元素哈希到 [0, f) 的范围内
+func hashToRange(k0, k1 uint64, item []byte, f uint64) uint64 {
+	hi, _ := bits.Mul64(sipHash(k0, k1, item), f)
+
+	return hi
+}
+
+func splitKey(key []byte) (uint64, uint64, error) {
+	if len(key) < KEY_SIZE {
+		return 0, 0, errors.New("Filter key is too short")
+	}
+
+	return binary.LittleEndian.Uint64(key[0:8]), binary.LittleEndian.Uint64(key[8:16]), nil
+}
+
+// hashedSet 返回排序后的元素哈希值
+func hashedSet(k0, k1 uint64, items [][]byte, f uint64) []uint64 {
+	values := make([]uint64, 0, len(items))
+	for _, item := range items {
+		values = append(values, hashToRange(k0, k1, item, f))
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	return values
+}
+
+// NewFilter 使用密钥 key 为元素集合构建过滤器，重复的元素只保留一个
+func NewFilter(key []byte, items [][]byte) (*Filter, error) {
+	k0, k1, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	unique := make(map[string]bool)
+	var set [][]byte
+	for _, item := range items {
+		if !unique[string(item)] {
+			unique[string(item)] = true
+			set = append(set, item)
+		}
+	}
+
+	filter := Filter{N: uint32(len(set))}
+	if filter.N == 0 {
+		return &filter, nil
+	}
+
+	var writer bitWriter
+	var last uint64
+
+	for _, value := range hashedSet(k0, k1, set, uint64(filter.N)*M) {
+		delta := value - last
+		last = value
+
+		// 商使用一元编码，余数使用 P 位的二进制编码
+		for q := delta >> P; q > 0; q-- {
+			writer.writeBit(true)
+		}
+		writer.writeBit(false)
+		writer.writeBits(delta, P)
+	}
+
+	filter.Data = writer.data
+
+	return &filter, nil
+}
+
+// MatchAny 检查集合中是否可能包含 items 中的任意一个元素
+func (f *Filter) MatchAny(key []byte, items [][]byte) (bool, error) {
+	if f.N == 0 || len(items) == 0 {
+		return false, nil
+	}
+
+	k0, k1, err := splitKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	targets := hashedSet(k0, k1, items, uint64(f.N)*M)
+	reader := bitReader{data: f.Data}
+	var value uint64
+
+	// 过滤器和待匹配的元素都是有序的，同时遍历两者即可
+	for i := uint32(0); i < f.N; i++ {
+		var q uint64
+		for {
+			bit, err := reader.readBit()
+			if err != nil {
+				return false, err
+			}
+			if !bit {
+				break
+			}
+			q++
+		}
+
+		r, err := reader.readBits(P)
+		if err != nil {
+			return false, err
+		}
+		value += q<<P | r
+
+		for len(targets) > 0 && targets[0] < value {
+			targets = targets[1:]
+		}
+		if len(targets) == 0 {
+			return false, nil
+		}
+		if targets[0] == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Match 检查集合中是否可能包含 item
+func (f *Filter) Match(key []byte, item []byte) (bool, error) {
+	return f.MatchAny(key, [][]byte{item})
+}
+
+// Bytes 返回过滤器的序列化结果，前 4 字节为元素数量
+func (f *Filter) Bytes() []byte {
+	data := make([]byte, 4, 4+len(f.Data))
+	binary.BigEndian.PutUint32(data, f.N)
+
+	return append(data, f.Data...)
+}
+
+// FromBytes 反序列化过滤器
+func FromBytes(data []byte) (*Filter, error) {
+	if len(data) < 4 {
+		return nil, errors.New("Filter is too short")
+	}
+
+	return &Filter{N: binary.BigEndian.Uint32(data), Data: data[4:]}, nil
+}
+
+// Hash 返回过滤器的哈希
+func (f *Filter) Hash() []byte {
+	hash := sha256.Sum256(f.Bytes())
+
+	return hash[:]
+}
+
+// FilterHeader 由过滤器哈希和前一个区块的过滤器头计算当前区块的过滤器头
+// 过滤器头构成一条链，只要确认了链上某个过滤器头，之前所有的过滤器都无法被篡改
+func FilterHeader(filterHash []byte, prevHeader []byte) []byte {
+	if len(prevHeader) == 0 {
+		prevHeader = make([]byte, sha256.Size)
+	}
+
+	hash := sha256.Sum256(append(append([]byte{}, filterHash...), prevHeader...))
+
+	return hash[:]
+}
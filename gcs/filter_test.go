@@ -0,0 +1,113 @@
+package gcs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func items(prefix string, n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		item := make([]byte, 4)
+		binary.BigEndian.PutUint32(item, uint32(i))
+		data = append(data, append([]byte(prefix), item...))
+	}
+
+	return data
+}
+
+var key = []byte("0123456789abcdef")
+
+func TestRoundTripAndMatch(t *testing.T) {
+	for _, n := range []int{1, 2, 10, 100, 1000} {
+		members := items("in", n)
+
+		f, err := NewFilter(key, members)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := FromBytes(f.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.N != f.N || !bytes.Equal(decoded.Data, f.Data) || !bytes.Equal(decoded.Hash(), f.Hash()) {
+			t.Fatalf("%d items: decoded filter differs", n)
+		}
+
+		for i, item := range members {
+			ok, err := decoded.Match(key, item)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Fatalf("%d items: false negative for item %d", n, i)
+			}
+		}
+
+		ok, err := decoded.MatchAny(key, append(items("out", 10), members[n-1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatalf("%d items: MatchAny missed a member", n)
+		}
+	}
+}
+
+func TestFalsePositiveRate(t *testing.T) {
+	const probes = 20000
+
+	f, err := NewFilter(key, items("in", 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	falsePositives := 0
+	for _, item := range items("out", probes) {
+		ok, err := f.Match(key, item)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			falsePositives++
+		}
+	}
+
+	// 误判率约为 1/M，20000 次几乎不应出现误判
+	if falsePositives > 2 {
+		t.Fatalf("%d false positives in %d probes, expected about %d", falsePositives, probes, probes/M)
+	}
+}
+
+func TestDuplicatesAndEmpty(t *testing.T) {
+	f, err := NewFilter(key, [][]byte{[]byte("a"), []byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.N != 2 {
+		t.Fatalf("N = %d, want 2", f.N)
+	}
+
+	empty, err := NewFilter(key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := empty.Match(key, []byte("a")); ok {
+		t.Fatal("empty filter matched")
+	}
+
+	if _, err := NewFilter([]byte("short"), nil); err == nil {
+		t.Fatal("short key accepted")
+	}
+}
+
+func TestFilterHeaderChain(t *testing.T) {
+	first := FilterHeader([]byte("filter 1"), nil)
+	second := FilterHeader([]byte("filter 2"), first)
+
+	if bytes.Equal(second, FilterHeader([]byte("filter 2"), FilterHeader([]byte("other"), nil))) {
+		t.Fatal("filter header does not commit to the previous header")
+	}
+}
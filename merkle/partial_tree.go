@@ -0,0 +1,174 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+)
+
+// PartialMerkleTree 部分 Merkle 树，只包含验证匹配叶子节点所需的哈希
+// 全节点按深度优先遍历整棵树：子树中没有匹配的叶子时只保存子树根的哈希，
+// 否则继续向下遍历，Flags 记录每个被遍历的节点是否包含匹配的叶子
+type PartialMerkleTree struct {
+	Total  int      // 叶子节点总数
+	Hashes [][]byte // 深度优先遍历时保存的哈希
+	Flags  []bool   // 深度优先遍历时每个节点的标记
+}
+
+// treeWidth 返回第 height 层（叶子为第 0 层）的节点数
+func treeWidth(total int, height int) int {
+	return (total + (1 << uint(height)) - 1) >> uint(height)
+}
+
+// treeHeight 返回树根所在的层
+func treeHeight(total int) int {
+	height := 0
+	for treeWidth(total, height) > 1 {
+		height++
+	}
+
+	return height
+}
+
+// calcHash 计算第 height 层第 pos 个节点的哈希，与 NewMerkleTree 一样，单数层的最后一个节点原样提升
+func calcHash(leafHashes [][]byte, height int, pos int) []byte {
+	if height == 0 {
+		return leafHashes[pos]
+	}
+
+	left := calcHash(leafHashes, height-1, pos*2)
+	if pos*2+1 >= treeWidth(len(leafHashes), height-1) {
+		return left
+	}
+
+	return NodeHash(left, calcHash(leafHashes, height-1, pos*2+1))
+}
+
+// NewPartialMerkleTree 由所有叶子节点的哈希和匹配标记构建部分 Merkle 树
+func NewPartialMerkleTree(leafHashes [][]byte, matches []bool) *PartialMerkleTree {
+	tree := PartialMerkleTree{Total: len(leafHashes)}
+	if tree.Total == 0 || len(matches) != tree.Total {
+		return &tree
+	}
+
+	tree.build(leafHashes, matches, treeHeight(tree.Total), 0)
+
+	return &tree
+}
+
+func (t *PartialMerkleTree) build(leafHashes [][]byte, matches []bool, height int, pos int) {
+	// 检查该节点下是否有匹配的叶子
+	parentOfMatch := false
+	for p := pos << uint(height); p < (pos+1)<<uint(height) && p < t.Total; p++ {
+		if matches[p] {
+			parentOfMatch = true
+			break
+		}
+	}
+
+	t.Flags = append(t.Flags, parentOfMatch)
+
+	if height == 0 || !parentOfMatch {
+		t.Hashes = append(t.Hashes, calcHash(leafHashes, height, pos))
+		return
+	}
+
+	t.build(leafHashes, matches, height-1, pos*2)
+	if pos*2+1 < treeWidth(t.Total, height-1) {
+		t.build(leafHashes, matches, height-1, pos*2+1)
+	}
+}
+
+// ExtractMatches 从部分 Merkle 树重新计算树根，并返回匹配的叶子节点哈希及其位置
+func (t *PartialMerkleTree) ExtractMatches() ([]byte, [][]byte, []int, error) {
+	var matched [][]byte
+	var indexes []int
+
+	if t.Total == 0 || len(t.Hashes) > t.Total {
+		return nil, nil, nil, errors.New("Partial merkle tree is malformed")
+	}
+
+	hashUsed, flagUsed := 0, 0
+	root, err := t.extract(treeHeight(t.Total), 0, &hashUsed, &flagUsed, &matched, &indexes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// 所有的哈希和标记都必须被用到
+	if hashUsed != len(t.Hashes) || flagUsed != len(t.Flags) {
+		return nil, nil, nil, errors.New("Partial merkle tree has unused data")
+	}
+
+	return root, matched, indexes, nil
+}
+
+func (t *PartialMerkleTree) extract(height int, pos int, hashUsed *int, flagUsed *int, matched *[][]byte, indexes *[]int) ([]byte, error) {
+	if *flagUsed >= len(t.Flags) {
+		return nil, errors.New("Partial merkle tree ran out of flags")
+	}
+	parentOfMatch := t.Flags[*flagUsed]
+	*flagUsed++
+
+	if height == 0 || !parentOfMatch {
+		if *hashUsed >= len(t.Hashes) {
+			return nil, errors.New("Partial merkle tree ran out of hashes")
+		}
+		hash := t.Hashes[*hashUsed]
+		*hashUsed++
+
+		if height == 0 && parentOfMatch {
+			*matched = append(*matched, hash)
+			*indexes = append(*indexes, pos)
+		}
+
+		return hash, nil
+	}
+
+	left, err := t.extract(height-1, pos*2, hashUsed, flagUsed, matched, indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	if pos*2+1 >= treeWidth(t.Total, height-1) {
+		return left, nil
+	}
+
+	right, err := t.extract(height-1, pos*2+1, hashUsed, flagUsed, matched, indexes)
+	if err != nil {
+		return nil, err
+	}
+
+	// 左右子节点相同说明有人通过复制节点伪造了叶子
+	if bytes.Equal(left, right) {
+		return nil, errors.New("Partial merkle tree has duplicated nodes")
+	}
+
+	return NodeHash(left, right), nil
+}
+
+// Serialize 序列化部分 Merkle 树
+func (t PartialMerkleTree) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(t)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// DeserializePartialMerkleTree 反序列化部分 Merkle 树
+func DeserializePartialMerkleTree(data []byte) (*PartialMerkleTree, error) {
+	var tree PartialMerkleTree
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tree, nil
+}
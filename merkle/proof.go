@@ -0,0 +1,77 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+)
+
+// MerkleProof Merkle 路径，证明某个叶子节点包含在树中
+type MerkleProof struct {
+	Index  int      // 叶子节点在树中的位置
+	Total  int      // 叶子节点总数，决定哪些层的节点没有兄弟节点
+	Hashes [][]byte // 自底向上，路径上每一层的兄弟节点哈希，没有兄弟节点的层不保存
+}
+
+// Serialize 序列化 Merkle 路径
+func (p MerkleProof) Serialize() []byte {
+	var encoded bytes.Buffer
+
+	enc := gob.NewEncoder(&encoded)
+	err := enc.Encode(p)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return encoded.Bytes()
+}
+
+// DeserializeMerkleProof 反序列化 Merkle 路径
+func DeserializeMerkleProof(data []byte) (*MerkleProof, error) {
+	var proof MerkleProof
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&proof)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proof, nil
+}
+
+// VerifyProof 使用 Merkle 路径从叶子数据重新计算树根，并与给定的树根进行比较
+// 验证过程不需要整棵树，只需要树根、叶子数据和路径
+func VerifyProof(root []byte, leaf []byte, proof *MerkleProof) bool {
+	if proof == nil || proof.Index < 0 || proof.Index >= proof.Total {
+		return false
+	}
+
+	current := LeafHash(leaf)
+	index := proof.Index
+	used := 0
+
+	for width := proof.Total; width > 1; width = (width + 1) / 2 {
+		// 单数层的最后一个节点没有兄弟节点，原样提升到上一层
+		if index^1 >= width {
+			index /= 2
+			continue
+		}
+
+		if used >= len(proof.Hashes) {
+			return false
+		}
+		sibling := proof.Hashes[used]
+		used++
+
+		// 下标为双数说明当前节点是左节点，兄弟节点在右边
+		if index%2 == 0 {
+			current = NodeHash(current, sibling)
+		} else {
+			current = NodeHash(sibling, current)
+		}
+		index /= 2
+	}
+
+	// 路径中的哈希必须全部用到，否则说明路径与叶子总数不匹配
+	return used == len(proof.Hashes) && bytes.Equal(current, root)
+}
@@ -1,9 +1,19 @@
 package merkle
 
-import "crypto/sha256"
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// 叶子节点和非叶子节点使用不同的前缀进行哈希，防止把非叶子节点伪装成叶子节点（第二原像攻击）
+const (
+	LEAF_PREFIX = byte(0x00)
+	NODE_PREFIX = byte(0x01)
+)
 
 type MerkleTree struct {
 	RootNode *MerkleNode
+	levels   [][]*MerkleNode // 自底向上保存每一层的节点，用于生成 Merkle 路径
 }
 
 type MerkleNode struct {
@@ -12,17 +22,32 @@ type MerkleNode struct {
 	Data  []byte
 }
 
+// LeafHash 计算叶子节点的哈希
+func LeafHash(data []byte) []byte {
+	hash := sha256.Sum256(append([]byte{LEAF_PREFIX}, data...))
+
+	return hash[:]
+}
+
+// NodeHash 由左右两个子节点的哈希计算父节点的哈希
+func NodeHash(left, right []byte) []byte {
+	data := make([]byte, 0, 1+len(left)+len(right))
+	data = append(data, NODE_PREFIX)
+	data = append(data, left...)
+	data = append(data, right...)
+	hash := sha256.Sum256(data)
+
+	return hash[:]
+}
+
 func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode {
 	mNode := MerkleNode{}
 
 	// 判断当前创建的是否为叶子节点
 	if left == nil && right == nil {
-		hash := sha256.Sum256(data)
-		mNode.Data = hash[:]
+		mNode.Data = LeafHash(data)
 	} else {
-		prevHashes := append(left.Data, right.Data...)
-		hash := sha256.Sum256(prevHashes)
-		mNode.Data = hash[:]
+		mNode.Data = NodeHash(left.Data, right.Data)
 	}
 
 	mNode.Left = left
@@ -32,32 +57,60 @@ func NewMerkleNode(left *MerkleNode, right *MerkleNode, data []byte) *MerkleNode
 }
 
 func NewMerkleTree(data [][]byte) *MerkleTree {
-	var nodes []MerkleNode
+	var nodes []*MerkleNode
 
-	// 确保叶子节点必须是双数
-	if len(data)%2 != 0 {
-		data = append(data, data[len(data)-1])
+	for _, datum := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, datum))
 	}
 
-	for _, datum := range data {
-		node := NewMerkleNode(nil, nil, datum)
-		nodes = append(nodes, *node)
+	// 没有数据时使用空数据作为唯一的叶子节点
+	if len(nodes) == 0 {
+		nodes = append(nodes, NewMerkleNode(nil, nil, nil))
 	}
 
-	// 确定层数
-	for i := 0; i < len(data)/2; i++ {
-		var newLevel []MerkleNode
+	levels := [][]*MerkleNode{nodes}
+
+	// 逐层向上构建，直到只剩下树根
+	for len(nodes) > 1 {
+		var newLevel []*MerkleNode
 
-		// 选择叶子节点
 		for j := 0; j < len(nodes); j += 2 {
-			node := NewMerkleNode(&nodes[j], &nodes[j+1], nil)
-			newLevel = append(newLevel, *node)
+			// 每一层的节点数都可能是单数，单数时最后一个节点不做哈希，原样提升到上一层
+			// 如果与自身配对，[a, b, c] 和 [a, b, c, c] 会得到相同的树根
+			if j+1 == len(nodes) {
+				newLevel = append(newLevel, nodes[j])
+				continue
+			}
+
+			newLevel = append(newLevel, NewMerkleNode(nodes[j], nodes[j+1], nil))
 		}
 
 		nodes = newLevel
+		levels = append(levels, nodes)
 	}
 
-	mTree := MerkleTree{&nodes[0]}
+	mTree := MerkleTree{nodes[0], levels}
 
 	return &mTree
 }
+
+// Proof 返回第 index 个叶子节点到树根的 Merkle 路径
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if len(t.levels) == 0 || index < 0 || index >= len(t.levels[0]) {
+		return nil, errors.New("Leaf index out of range")
+	}
+
+	proof := MerkleProof{Index: index, Total: len(t.levels[0])}
+
+	// 逐层向上，记录路径上每个节点的兄弟节点哈希
+	for _, level := range t.levels[:len(t.levels)-1] {
+		// 单数层的最后一个节点没有兄弟节点，直接提升到上一层
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof.Hashes = append(proof.Hashes, level[sibling].Data)
+		}
+		index /= 2
+	}
+
+	return &proof, nil
+}
@@ -0,0 +1,174 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func leaves(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		data = append(data, []byte(fmt.Sprintf("leaf %d", i)))
+	}
+
+	return data
+}
+
+// naiveRoot 按定义递归计算树根，单数层的最后一个节点原样提升
+func naiveRoot(hashes [][]byte) []byte {
+	if len(hashes) == 1 {
+		return hashes[0]
+	}
+
+	var next [][]byte
+	for i := 0; i < len(hashes); i += 2 {
+		if i+1 == len(hashes) {
+			next = append(next, hashes[i])
+		} else {
+			next = append(next, NodeHash(hashes[i], hashes[i+1]))
+		}
+	}
+
+	return naiveRoot(next)
+}
+
+func TestRootMatchesDefinition(t *testing.T) {
+	for n := 1; n <= 70; n++ {
+		data := leaves(n)
+
+		var hashes [][]byte
+		for _, d := range data {
+			hashes = append(hashes, LeafHash(d))
+		}
+
+		root := NewMerkleTree(data).RootNode.Data
+		if !bytes.Equal(root, naiveRoot(hashes)) {
+			t.Fatalf("%d leaves: root does not match the definition", n)
+		}
+	}
+}
+
+func TestProofVerifiesEveryLeaf(t *testing.T) {
+	for n := 1; n <= 70; n++ {
+		data := leaves(n)
+		tree := NewMerkleTree(data)
+		root := tree.RootNode.Data
+
+		for i := 0; i < n; i++ {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatalf("%d leaves: proof of %d: %s", n, i, err)
+			}
+
+			if !VerifyProof(root, data[i], proof) {
+				t.Fatalf("%d leaves: proof of %d does not verify", n, i)
+			}
+
+			decoded, err := DeserializeMerkleProof(proof.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyProof(root, data[i], decoded) {
+				t.Fatalf("%d leaves: decoded proof of %d does not verify", n, i)
+			}
+
+			if VerifyProof(root, []byte("other"), proof) {
+				t.Fatalf("%d leaves: proof of %d verifies a different leaf", n, i)
+			}
+
+			moved := *proof
+			moved.Index = (i + 1) % n
+			if n > 1 && VerifyProof(root, data[i], &moved) {
+				t.Fatalf("%d leaves: proof of %d verifies at index %d", n, i, moved.Index)
+			}
+
+			if len(proof.Hashes) > 0 {
+				truncated := *proof
+				truncated.Hashes = proof.Hashes[:len(proof.Hashes)-1]
+				if VerifyProof(root, data[i], &truncated) {
+					t.Fatalf("%d leaves: truncated proof of %d verifies", n, i)
+				}
+
+				extended := *proof
+				extended.Hashes = append(append([][]byte{}, proof.Hashes...), root)
+				if VerifyProof(root, data[i], &extended) {
+					t.Fatalf("%d leaves: extended proof of %d verifies", n, i)
+				}
+			}
+		}
+
+		if _, err := tree.Proof(n); err == nil {
+			t.Fatalf("%d leaves: proof of an index out of range", n)
+		}
+	}
+}
+
+func TestDuplicatedLastLeafChangesRoot(t *testing.T) {
+	for n := 1; n <= 70; n++ {
+		data := leaves(n)
+		duplicated := append(leaves(n), data[n-1])
+
+		root := NewMerkleTree(data).RootNode.Data
+		duplicatedTree := NewMerkleTree(duplicated)
+		if bytes.Equal(root, duplicatedTree.RootNode.Data) {
+			t.Fatalf("%d leaves: duplicating the last leaf keeps the root", n)
+		}
+
+		// 树中多出的叶子不能在原来的树根下得到证明
+		proof, err := duplicatedTree.Proof(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if VerifyProof(root, data[n-1], proof) {
+			t.Fatalf("%d leaves: duplicated leaf verifies against the original root", n)
+		}
+	}
+}
+
+func TestPartialTreeMatchesRoot(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for n := 1; n <= 70; n++ {
+		data := leaves(n)
+		root := NewMerkleTree(data).RootNode.Data
+
+		var hashes [][]byte
+		for _, d := range data {
+			hashes = append(hashes, LeafHash(d))
+		}
+
+		for round := 0; round < 5; round++ {
+			matches := make([]bool, n)
+			var want []int
+			for i := range matches {
+				if r.Intn(4) == 0 {
+					matches[i] = true
+					want = append(want, i)
+				}
+			}
+
+			tree, err := DeserializePartialMerkleTree(NewPartialMerkleTree(hashes, matches).Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			extracted, matched, indexes, err := tree.ExtractMatches()
+			if err != nil {
+				t.Fatalf("%d leaves: %s", n, err)
+			}
+			if !bytes.Equal(extracted, root) {
+				t.Fatalf("%d leaves: partial tree root does not match", n)
+			}
+			if fmt.Sprint(indexes) != fmt.Sprint(want) {
+				t.Fatalf("%d leaves: matched %v, want %v", n, indexes, want)
+			}
+			for i, index := range indexes {
+				if !bytes.Equal(matched[i], hashes[index]) {
+					t.Fatalf("%d leaves: wrong hash for leaf %d", n, index)
+				}
+			}
+		}
+	}
+}
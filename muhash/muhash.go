@@ -0,0 +1,100 @@
+package muhash
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+// 元素被映射到 3072 位的整数，在模素数 2^3072 - 1103717 的乘法群中累乘
+const ELEMENT_SIZE = 384
+
+// 与 Bitcoin Core 的 MuHash3072 使用相同的素数
+var prime = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 3072), big.NewInt(1103717))
+
+// MuHash 乘法集合哈希
+// 加入元素时乘到分子上，移除元素时乘到分母上，结果与元素的加入顺序无关，
+// 所以可以随着集合的变化增量更新，而不需要重新计算整个集合
+type MuHash struct {
+	numerator   *big.Int
+	denominator *big.Int
+}
+
+// New 返回空集合的 MuHash
+func New() *MuHash {
+	return &MuHash{big.NewInt(1), big.NewInt(1)}
+}
+
+// toNum 将元素映射为模 prime 的整数：以元素的 SHA-256 作为 ChaCha20 的密钥生成 384 字节，按小端序解释
+func toNum(data []byte) *big.Int {
+	key := sha256.Sum256(data)
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		panic(err)
+	}
+
+	stream := make([]byte, ELEMENT_SIZE)
+	cipher.XORKeyStream(stream, stream)
+
+	num := new(big.Int).SetBytes(reverse(stream))
+
+	return num.Mod(num, prime)
+}
+
+// Add 向集合中加入一个元素
+func (m *MuHash) Add(data []byte) {
+	m.numerator.Mul(m.numerator, toNum(data))
+	m.numerator.Mod(m.numerator, prime)
+}
+
+// Remove 从集合中移除一个元素，元素必须已经被加入过
+func (m *MuHash) Remove(data []byte) {
+	m.denominator.Mul(m.denominator, toNum(data))
+	m.denominator.Mod(m.denominator, prime)
+}
+
+// Digest 返回集合的 32 字节哈希
+func (m *MuHash) Digest() []byte {
+	result := new(big.Int).ModInverse(m.denominator, prime)
+	result.Mul(result, m.numerator)
+	result.Mod(result, prime)
+
+	hash := sha256.Sum256(reverse(fixedBytes(result)))
+
+	return hash[:]
+}
+
+// Serialize 序列化分子和分母，用于保存增量计算的中间状态
+func (m *MuHash) Serialize() []byte {
+	return append(fixedBytes(m.numerator), fixedBytes(m.denominator)...)
+}
+
+// Deserialize 反序列化 MuHash
+func Deserialize(data []byte) (*MuHash, error) {
+	if len(data) != 2*ELEMENT_SIZE {
+		return nil, errors.New("Invalid MuHash length")
+	}
+
+	m := MuHash{
+		numerator:   new(big.Int).SetBytes(data[:ELEMENT_SIZE]),
+		denominator: new(big.Int).SetBytes(data[ELEMENT_SIZE:]),
+	}
+
+	return &m, nil
+}
+
+// fixedBytes 将整数编码为 ELEMENT_SIZE 字节的大端序
+func fixedBytes(num *big.Int) []byte {
+	return num.FillBytes(make([]byte, ELEMENT_SIZE))
+}
+
+func reverse(data []byte) []byte {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+
+	return data
+}
@@ -0,0 +1,125 @@
+package muhash
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// element 与 Bitcoin Core 的测试相同：第一个字节为 i，其余为 0 的 32 字节
+func element(i byte) []byte {
+	data := make([]byte, 32)
+	data[0] = i
+
+	return data
+}
+
+// coreHash 把 Bitcoin Core 中 uint256 的十六进制表示（字节逆序）转换为摘要的字节
+func coreHash(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reverse(data)
+}
+
+func TestKnownAnswers(t *testing.T) {
+	tests := []struct {
+		name    string
+		added   []byte
+		removed []byte
+		want    []byte
+	}{
+		// 空集合的值为 1，摘要为 384 字节小端序的 1 的 SHA-256
+		{"empty set", nil, nil, coreHash(t, "dd5ad2a105c2d29495f577245c357409002329b9f4d6182c0af3dc2f462555c8")},
+		// Bitcoin Core src/test/crypto_tests.cpp 中的 muhash_tests
+		{"core vector", []byte{0, 1}, []byte{2}, coreHash(t, "10d312b100cbd32ada024a6646e40d3482fcff103668d2625f10002a607d5863")},
+	}
+
+	for _, test := range tests {
+		m := New()
+		for _, i := range test.added {
+			m.Add(element(i))
+		}
+		for _, i := range test.removed {
+			m.Remove(element(i))
+		}
+
+		if got := m.Digest(); !bytes.Equal(got, test.want) {
+			t.Errorf("%s: digest %x, want %x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestOrderIndependence(t *testing.T) {
+	first := New()
+	for i := byte(0); i < 5; i++ {
+		first.Add(element(i))
+	}
+
+	second := New()
+	for i := byte(5); i > 0; i-- {
+		second.Add(element(i - 1))
+	}
+
+	if !bytes.Equal(first.Digest(), second.Digest()) {
+		t.Fatal("adding the same elements in a different order gives a different digest")
+	}
+
+	// 移除和加入交替进行时结果也与顺序无关
+	first.Remove(element(3))
+	first.Add(element(9))
+
+	second.Add(element(9))
+	second.Remove(element(3))
+
+	if !bytes.Equal(first.Digest(), second.Digest()) {
+		t.Fatal("interleaving additions and removals changes the digest")
+	}
+}
+
+func TestAddThenRemoveCancels(t *testing.T) {
+	m := New()
+	m.Add(element(1))
+	want := m.Digest()
+
+	m.Add(element(2))
+	if bytes.Equal(m.Digest(), want) {
+		t.Fatal("adding an element does not change the digest")
+	}
+
+	m.Remove(element(2))
+	if got := m.Digest(); !bytes.Equal(got, want) {
+		t.Fatalf("digest %x after adding and removing an element, want %x", got, want)
+	}
+
+	// 移除所有元素后回到空集合
+	m.Remove(element(1))
+	if got := m.Digest(); !bytes.Equal(got, New().Digest()) {
+		t.Fatalf("digest %x after removing every element, want the empty set", got)
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	m := New()
+	m.Add(element(1))
+	m.Remove(element(2))
+
+	restored, err := Deserialize(m.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 恢复的状态可以继续增量更新
+	m.Add(element(3))
+	restored.Add(element(3))
+	if !bytes.Equal(m.Digest(), restored.Digest()) {
+		t.Fatal("restored state gives a different digest")
+	}
+
+	_, err = Deserialize(m.Serialize()[1:])
+	if err == nil {
+		t.Fatal("truncated state was accepted")
+	}
+}
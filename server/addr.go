@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// 单个 addr 消息中最多包含的地址数量，超过时整个消息被拒绝
+const MAX_ADDR_PER_MESSAGE = 1000
+
+// 每个连接平均每秒最多处理 ADDR_RATE 个地址，超过的地址被丢弃，防止地址簿被大量地址淹没
+// 发送 getaddr 之后额外允许对方回复 MAX_ADDR_PER_MESSAGE 个地址
+const ADDR_RATE = 0.1
+
+// 时间超过当前时间 ADDR_FUTURE_LIMIT 的地址被认为时间不可信，按 ADDR_UNTRUSTED_AGE 之前出现过处理
+const ADDR_FUTURE_LIMIT = 10 * time.Minute
+const ADDR_UNTRUSTED_AGE = 5 * 24 * time.Hour
+
+// 包含不超过 ADDR_RELAY_MAX 个地址的 addr 消息是节点在宣布自己，
+// 其中 ADDR_RELAY_AGE 之内出现过的新地址会转发给 ADDR_RELAY_PEERS 个随机的连接
+const ADDR_RELAY_MAX = 10
+const ADDR_RELAY_AGE = 10 * time.Minute
+const ADDR_RELAY_PEERS = 2
+
+type netAddress struct {
+	Addr      string
+	Services  uint64
+	Timestamp int64 // 最近一次听说这个地址仍然在线的时间，Unix 秒
+}
+
+type addr struct {
+	AddrList []netAddress
+}
+
+// refillAddrTokens 按经过的时间补充连接可以发送的地址数量
+func (p *peer) refillAddrTokens(now time.Time) {
+	if !p.addrTokensUpdated.IsZero() {
+		p.addrTokens += now.Sub(p.addrTokensUpdated).Seconds() * ADDR_RATE
+		if p.addrTokens > MAX_ADDR_PER_MESSAGE {
+			p.addrTokens = MAX_ADDR_PER_MESSAGE
+		}
+	}
+	p.addrTokensUpdated = now
+}
+
+// sendGetAddr 向主动连接的节点请求它知道的地址
+func (n *Node) sendGetAddr(p *peer) {
+	p.addrTokens += MAX_ADDR_PER_MESSAGE
+	p.queue("getaddr", nil)
+}
+
+// advertiseAddress 全节点在握手完成后宣布自己的地址，对方会把它加入地址簿并转发给其他节点
+// 轻节点不能提供区块，不宣布自己
+func (n *Node) advertiseAddress(p *peer) error {
+	services, err := n.services()
+	if err != nil {
+		return err
+	}
+	if services&(SERVICE_FULL|SERVICE_PRUNED) == 0 {
+		return nil
+	}
+
+	payload := gobEncode(addr{[]netAddress{{n.address, services, time.Now().Unix()}}})
+	p.queue("addr", payload)
+
+	return nil
+}
+
+// handleGetAddr 回复地址簿中随机的一部分地址
+// 每个连接只回复一次，并且只回复被动连接，避免其他节点通过反复请求得到整个地址簿
+func (n *Node) handleGetAddr(p *peer) error {
+	if !p.inbound || p.getAddrAnswered {
+		return nil
+	}
+	p.getAddrAnswered = true
+
+	addrs := n.addrBook.sample(MAX_ADDR_PER_MESSAGE, time.Now())
+	p.queue("addr", gobEncode(addr{addrs}))
+
+	return nil
+}
+
+// handleAddr 把能提供区块的节点的地址加入地址簿，并转发对方宣布的新地址
+func (n *Node) handleAddr(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload addr
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if len(payload.AddrList) > MAX_ADDR_PER_MESSAGE {
+		return fmt.Errorf("%w: %d addresses, maximum is %d", ErrMalformedMessage, len(payload.AddrList), MAX_ADDR_PER_MESSAGE)
+	}
+
+	now := time.Now()
+	p.refillAddrTokens(now)
+
+	added, limited := 0, 0
+	var relay []netAddress
+	for _, na := range payload.AddrList {
+		if p.addrTokens < 1 {
+			limited++
+			continue
+		}
+		p.addrTokens--
+
+		if na.Addr == n.address || na.Services&(SERVICE_FULL|SERVICE_PRUNED) == 0 {
+			continue
+		}
+
+		timestamp := time.Unix(na.Timestamp, 0)
+		if na.Timestamp <= 0 || timestamp.After(now.Add(ADDR_FUTURE_LIMIT)) {
+			timestamp = now.Add(-ADDR_UNTRUSTED_AGE)
+		}
+		if now.Sub(timestamp) > ADDR_MAX_AGE {
+			continue
+		}
+
+		if !n.addrBook.add(na.Addr, na.Services, timestamp, p.address()) {
+			continue
+		}
+		added++
+
+		if len(payload.AddrList) <= ADDR_RELAY_MAX && now.Sub(timestamp) <= ADDR_RELAY_AGE {
+			relay = append(relay, na)
+		}
+	}
+
+	if limited > 0 {
+		fmt.Printf("Ignored %d addresses from %s, too many addresses\n", limited, p.address())
+	}
+	if added > 0 {
+		fmt.Printf("Learned %d new addresses from %s, %d known now\n", added, p.address(), n.addrBook.size())
+	}
+
+	if len(relay) > 0 {
+		for _, other := range n.peers.random(ADDR_RELAY_PEERS, p) {
+			other.queue("addr", gobEncode(addr{relay}))
+		}
+	}
+
+	return nil
+}
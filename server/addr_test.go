@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newAddrTestNode() *Node {
+	return &Node{
+		address:  "localhost:3000",
+		peers:    newPeerManager(),
+		addrBook: newAddrBookWithKey(testAddrBookKey),
+	}
+}
+
+// addrMessage 返回包含 count 个不同网段的全节点地址的 addr 消息
+func addrMessage(first, count int) []byte {
+	var addrs []netAddress
+	for i := first; i < first+count; i++ {
+		addrs = append(addrs, netAddress{groupAddr(i), SERVICE_FULL, time.Now().Unix()})
+	}
+
+	return gobEncode(addr{addrs})
+}
+
+func TestAddrRateLimit(t *testing.T) {
+	n := newAddrTestNode()
+	p := newTestPeer("203.0.113.7:50123", "", true)
+
+	// 新的连接只能宣布自己的地址
+	err := n.handleAddr(p, addrMessage(0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.addrBook.size() != 1 {
+		t.Fatalf("%d addresses added from a new connection, want 1", n.addrBook.size())
+	}
+
+	// 之后按 ADDR_RATE 补充
+	p.addrTokensUpdated = time.Now().Add(-100 * time.Second)
+	err = n.handleAddr(p, addrMessage(100, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.addrBook.size(), 1+int(100*ADDR_RATE); got != want {
+		t.Fatalf("%d addresses after 100 seconds, want %d", got, want)
+	}
+
+	// 长时间没有发送地址也只能积累 MAX_ADDR_PER_MESSAGE 个
+	p.addrTokensUpdated = time.Now().Add(-time.Duration(10*MAX_ADDR_PER_MESSAGE/ADDR_RATE) * time.Second)
+	p.refillAddrTokens(time.Now())
+	if p.addrTokens > MAX_ADDR_PER_MESSAGE {
+		t.Fatalf("%.0f addresses allowed after a long pause, maximum is %d", p.addrTokens, MAX_ADDR_PER_MESSAGE)
+	}
+}
+
+func TestGetAddrAllowsFullReply(t *testing.T) {
+	n := newAddrTestNode()
+	p := newTestPeer("203.0.113.7:50123", "localhost:3001", false)
+
+	n.sendGetAddr(p)
+	if msg := <-p.send; msg.command != "getaddr" {
+		t.Fatalf("sent %s, want getaddr", msg.command)
+	}
+
+	err := n.handleAddr(p, addrMessage(0, MAX_ADDR_PER_MESSAGE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 回复中的所有地址都被处理，受桶的容量限制只保留其中一部分，
+	// 剩下的只有对方宣布自己地址的额度
+	if p.addrTokens >= 2 {
+		t.Fatalf("%.0f addresses still allowed after the reply", p.addrTokens)
+	}
+	if n.addrBook.size() == 0 {
+		t.Fatal("no addresses learned from the getaddr reply")
+	}
+
+	// 没有请求的第二个回复被丢弃
+	size := n.addrBook.size()
+	err = n.handleAddr(p, addrMessage(MAX_ADDR_PER_MESSAGE, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.addrBook.size() > size+1 {
+		t.Fatalf("%d addresses learned from an unrequested reply", n.addrBook.size()-size)
+	}
+}
+
+func TestAddrMessageTooLarge(t *testing.T) {
+	n := newAddrTestNode()
+	p := newTestPeer("203.0.113.7:50123", "", true)
+	n.sendGetAddr(p)
+
+	err := n.handleAddr(p, addrMessage(0, MAX_ADDR_PER_MESSAGE+1))
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("handling %d addresses returned %v, want ErrMalformedMessage", MAX_ADDR_PER_MESSAGE+1, err)
+	}
+	if n.addrBook.size() != 0 {
+		t.Fatalf("%d addresses added from a rejected message", n.addrBook.size())
+	}
+}
+
+func TestAddrSkipsUselessAddresses(t *testing.T) {
+	n := newAddrTestNode()
+	p := newTestPeer("203.0.113.7:50123", "", true)
+	n.sendGetAddr(p)
+
+	now := time.Now()
+	payload := gobEncode(addr{[]netAddress{
+		{n.address, SERVICE_FULL, now.Unix()},                                          // 节点自己
+		{"198.51.100.1:3000", 0, now.Unix()},                                           // 不能提供区块
+		{"198.51.100.2:3000", SERVICE_FULL, now.Add(-ADDR_MAX_AGE - time.Hour).Unix()}, // 已经失效
+		{"198.51.100.3:3000", SERVICE_FULL, now.Add(time.Hour).Unix()},                 // 时间不可信
+	}})
+
+	err := n.handleAddr(p, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := n.addrBook.addresses()
+	if len(addrs) != 1 || addrs[0] != "198.51.100.3:3000" {
+		t.Fatalf("learned %v, want only the address with an untrusted time", addrs)
+	}
+	if ka := n.addrBook.addrs["198.51.100.3:3000"]; now.Sub(ka.Timestamp) < ADDR_UNTRUSTED_AGE-time.Minute {
+		t.Fatalf("address from the future stored with time %s", ka.Timestamp)
+	}
+}
+
+func TestAddrRelaysAnnouncements(t *testing.T) {
+	n := newAddrTestNode()
+	from := newTestPeer("203.0.113.7:50123", "", true)
+	other := newTestPeer("192.0.2.1:3000", "192.0.2.1:3000", false)
+	for _, p := range []*peer{from, other} {
+		n.peers.add(p)
+		n.peers.setReady(p)
+	}
+
+	err := n.handleAddr(from, addrMessage(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(from.send) != 0 {
+		t.Fatal("announcement relayed back to the sender")
+	}
+	if msg := <-other.send; msg.command != "addr" {
+		t.Fatalf("relayed %s, want addr", msg.command)
+	}
+
+	// 已经知道的地址不再转发
+	from.addrTokens = 1
+	err = n.handleAddr(from, addrMessage(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(other.send) != 0 {
+		t.Fatal("known address relayed again")
+	}
+}
@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 节点停止时地址簿保存在这个文件中，下次启动时重新加载
+const PEERS_FILE = "peers_%s.dat"
+
+// 地址簿分为两部分：new 保存从其他节点听说的地址，tried 保存成功连接过的地址
+// 每个桶最多 BUCKET_SIZE 个地址，桶满时淘汰其中最差的地址
+const NEW_BUCKET_COUNT = 64
+const TRIED_BUCKET_COUNT = 16
+const BUCKET_SIZE = 32
+
+// 同一个来源网段告诉我们的地址最多放入 NEW_BUCKETS_PER_SOURCE_GROUP 个 new 桶，
+// 攻击者发送再多的地址也只能占据地址簿的一小部分
+const NEW_BUCKETS_PER_SOURCE_GROUP = 8
+
+// 连续失败 MAX_ADDR_FAILURES 次并且 ADDR_SUCCESS_WINDOW 之内没有成功连接过的地址会被优先淘汰，也不再发给其他节点
+const MAX_ADDR_FAILURES = 10
+const ADDR_SUCCESS_WINDOW = 7 * 24 * time.Hour
+
+// 超过 ADDR_MAX_AGE 没有出现过的地址被认为已经失效
+const ADDR_MAX_AGE = 30 * 24 * time.Hour
+
+// knownAddress 地址簿中的一个地址
+type knownAddress struct {
+	Addr        string
+	Services    uint64
+	Timestamp   time.Time // 最近一次听说这个地址仍然在线的时间
+	Source      string    // 告诉我们这个地址的节点，配置中的地址为节点自己
+	Attempts    int       // 上次成功之后连接失败的次数
+	LastAttempt time.Time
+	LastSuccess time.Time
+	Tried       bool
+
+	bucket int
+}
+
+// isTerrible 判断地址是否已经不值得保留
+func (ka *knownAddress) isTerrible(now time.Time) bool {
+	if now.Sub(ka.Timestamp) > ADDR_MAX_AGE && now.Sub(ka.LastSuccess) > ADDR_MAX_AGE {
+		return true
+	}
+
+	return ka.Attempts >= MAX_ADDR_FAILURES && now.Sub(ka.LastSuccess) > ADDR_SUCCESS_WINDOW
+}
+
+// addrBook 节点知道的其他节点的地址，按桶组织
+// 地址所在的桶由只有节点自己知道的随机密钥决定，其他节点无法预测哪些地址会互相淘汰
+type addrBook struct {
+	lock  sync.Mutex
+	key   []byte
+	addrs map[string]*knownAddress
+
+	newBuckets   [NEW_BUCKET_COUNT]map[string]*knownAddress
+	triedBuckets [TRIED_BUCKET_COUNT]map[string]*knownAddress
+}
+
+// addrBookFile 地址簿保存到文件中的内容，桶在加载时根据密钥重新计算
+type addrBookFile struct {
+	Key       []byte
+	Addresses []knownAddress
+}
+
+func newAddrBook() (*addrBook, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newAddrBookWithKey(key), nil
+}
+
+func newAddrBookWithKey(key []byte) *addrBook {
+	ab := &addrBook{
+		key:   key,
+		addrs: make(map[string]*knownAddress),
+	}
+	for i := range ab.newBuckets {
+		ab.newBuckets[i] = make(map[string]*knownAddress)
+	}
+	for i := range ab.triedBuckets {
+		ab.triedBuckets[i] = make(map[string]*knownAddress)
+	}
+
+	return ab
+}
+
+// loadAddrBook 加载上次停止时保存的地址簿，文件不存在时返回空的地址簿
+func loadAddrBook(nodeID string) (*addrBook, error) {
+	peersFile := fmt.Sprintf(PEERS_FILE, nodeID)
+
+	fileContent, err := ioutil.ReadFile(peersFile)
+	if os.IsNotExist(err) {
+		return newAddrBook()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file addrBookFile
+	dec := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode %s: %w", peersFile, err)
+	}
+
+	ab := newAddrBookWithKey(file.Key)
+	for i := range file.Addresses {
+		ka := file.Addresses[i]
+		if !validAddress(ka.Addr) || ab.addrs[ka.Addr] != nil {
+			continue
+		}
+
+		if ka.Tried {
+			ka.bucket = ab.triedBucket(ka.Addr)
+			if len(ab.triedBuckets[ka.bucket]) >= BUCKET_SIZE {
+				continue
+			}
+			ab.triedBuckets[ka.bucket][ka.Addr] = &ka
+		} else {
+			ka.bucket = ab.newBucket(ka.Addr, ka.Source)
+			if len(ab.newBuckets[ka.bucket]) >= BUCKET_SIZE {
+				continue
+			}
+			ab.newBuckets[ka.bucket][ka.Addr] = &ka
+		}
+		ab.addrs[ka.Addr] = &ka
+	}
+
+	return ab, nil
+}
+
+// save 把地址簿写入文件，先写入临时文件再重命名，中途退出不会留下不完整的文件
+func (ab *addrBook) save(nodeID string) error {
+	peersFile := fmt.Sprintf(PEERS_FILE, nodeID)
+
+	ab.lock.Lock()
+	file := addrBookFile{Key: ab.key}
+	for _, ka := range ab.addrs {
+		file.Addresses = append(file.Addresses, *ka)
+	}
+	ab.lock.Unlock()
+
+	tmpFile := peersFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, gobEncode(file), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, peersFile)
+}
+
+// addrGroup 返回地址所在的网段，IPv4 为 /16，IPv6 为 /32，域名为域名本身
+// 同一个网段中的地址通常由同一个人控制
+func addrGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String()
+	}
+
+	return ip.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// validAddress 判断地址是否是可以连接的 host:port
+func validAddress(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+
+	p, err := strconv.Atoi(port)
+
+	return err == nil && p > 0 && p < 65536
+}
+
+func (ab *addrBook) hash(parts ...string) uint64 {
+	h := sha256.New()
+	h.Write(ab.key)
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
+
+// newBucket 计算 source 告诉我们的 addr 所在的 new 桶
+// 来源网段相同的地址只会落在 NEW_BUCKETS_PER_SOURCE_GROUP 个桶中
+func (ab *addrBook) newBucket(addr, source string) int {
+	sourceGroup := addrGroup(source)
+	slot := ab.hash(addrGroup(addr), sourceGroup) % NEW_BUCKETS_PER_SOURCE_GROUP
+
+	return int(ab.hash(sourceGroup, strconv.FormatUint(slot, 10)) % NEW_BUCKET_COUNT)
+}
+
+func (ab *addrBook) triedBucket(addr string) int {
+	return int(ab.hash(addr) % TRIED_BUCKET_COUNT)
+}
+
+// worst 返回桶中最应该被淘汰的地址：优先淘汰失效的地址，其次是最久没有出现过的地址
+func worst(bucket map[string]*knownAddress, now time.Time) *knownAddress {
+	var worst *knownAddress
+	for _, ka := range bucket {
+		if ka.isTerrible(now) {
+			return ka
+		}
+		if worst == nil || ka.Timestamp.Before(worst.Timestamp) {
+			worst = ka
+		}
+	}
+
+	return worst
+}
+
+// add 加入 source 告诉我们的地址，已经存在的地址只更新时间和服务，返回地址是否是新的
+func (ab *addrBook) add(addr string, services uint64, timestamp time.Time, source string) bool {
+	if !validAddress(addr) {
+		return false
+	}
+
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if ka, ok := ab.addrs[addr]; ok {
+		if timestamp.After(ka.Timestamp) {
+			ka.Timestamp = timestamp
+		}
+		if services != 0 {
+			ka.Services = services
+		}
+		return false
+	}
+
+	ka := &knownAddress{
+		Addr:      addr,
+		Services:  services,
+		Timestamp: timestamp,
+		Source:    source,
+		bucket:    ab.newBucket(addr, source),
+	}
+
+	bucket := ab.newBuckets[ka.bucket]
+	if len(bucket) >= BUCKET_SIZE {
+		evicted := worst(bucket, time.Now())
+		delete(bucket, evicted.Addr)
+		delete(ab.addrs, evicted.Addr)
+	}
+	bucket[addr] = ka
+	ab.addrs[addr] = ka
+
+	return true
+}
+
+// remove 从地址簿中删除地址，例如发现这个地址指向节点自己
+func (ab *addrBook) remove(addr string) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	ka, ok := ab.addrs[addr]
+	if !ok {
+		return
+	}
+
+	if ka.Tried {
+		delete(ab.triedBuckets[ka.bucket], addr)
+	} else {
+		delete(ab.newBuckets[ka.bucket], addr)
+	}
+	delete(ab.addrs, addr)
+}
+
+// attempt 记录一次主动连接
+func (ab *addrBook) attempt(addr string, now time.Time) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	if ka, ok := ab.addrs[addr]; ok {
+		ka.Attempts++
+		ka.LastAttempt = now
+	}
+}
+
+// good 记录一次成功的握手，地址移入 tried 桶
+// tried 桶满时其中最久没有出现过的地址移回 new 桶
+func (ab *addrBook) good(addr string, services uint64, now time.Time) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	ka, ok := ab.addrs[addr]
+	if !ok {
+		ka = &knownAddress{Addr: addr, Source: addr}
+		ab.addrs[addr] = ka
+	} else if !ka.Tried {
+		delete(ab.newBuckets[ka.bucket], addr)
+	}
+
+	ka.Services = services
+	ka.Timestamp = now
+	ka.Attempts = 0
+	ka.LastSuccess = now
+	if ka.Tried {
+		return
+	}
+
+	ka.Tried = true
+	ka.bucket = ab.triedBucket(addr)
+
+	bucket := ab.triedBuckets[ka.bucket]
+	if len(bucket) >= BUCKET_SIZE {
+		evicted := worst(bucket, now)
+		delete(bucket, evicted.Addr)
+
+		evicted.Tried = false
+		evicted.bucket = ab.newBucket(evicted.Addr, evicted.Source)
+		if len(ab.newBuckets[evicted.bucket]) < BUCKET_SIZE {
+			ab.newBuckets[evicted.bucket][evicted.Addr] = evicted
+		} else {
+			delete(ab.addrs, evicted.Addr)
+		}
+	}
+	bucket[addr] = ka
+}
+
+// addresses 返回地址簿中的所有地址
+func (ab *addrBook) addresses() []string {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	var addrs []string
+	for addr := range ab.addrs {
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+func (ab *addrBook) size() int {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	return len(ab.addrs)
+}
+
+func randomInt(max int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0
+	}
+
+	return int(n.Int64())
+}
+
+// pick 随机选择一个可以连接的地址，tried 和 new 中的地址各有一半的机会
+// skip 返回 true 的地址不会被选中，没有可选的地址时返回 false
+func (ab *addrBook) pick(skip func(addr string) bool) (string, bool) {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	var tried, fresh []*knownAddress
+	for _, ka := range ab.addrs {
+		if skip(ka.Addr) {
+			continue
+		}
+		if ka.Tried {
+			tried = append(tried, ka)
+		} else {
+			fresh = append(fresh, ka)
+		}
+	}
+
+	candidates := fresh
+	if len(tried) > 0 && (len(fresh) == 0 || randomInt(2) == 0) {
+		candidates = tried
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	return candidates[randomInt(len(candidates))].Addr, true
+}
+
+// sample 随机返回最多 max 个仍然有效的地址，用于回复 getaddr
+func (ab *addrBook) sample(max int, now time.Time) []netAddress {
+	ab.lock.Lock()
+	defer ab.lock.Unlock()
+
+	var addrs []netAddress
+	for _, ka := range ab.addrs {
+		if ka.isTerrible(now) {
+			continue
+		}
+		addrs = append(addrs, netAddress{ka.Addr, ka.Services, ka.Timestamp.Unix()})
+	}
+
+	for i := len(addrs) - 1; i > 0; i-- {
+		j := randomInt(i + 1)
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	}
+	if len(addrs) > max {
+		addrs = addrs[:max]
+	}
+
+	return addrs
+}
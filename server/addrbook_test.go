@@ -0,0 +1,259 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+var testAddrBookKey = []byte("0123456789abcdef0123456789abcdef")
+
+// groupAddr 返回第 i 个网段中的地址，i 不同时 /16 网段也不同
+func groupAddr(i int) string {
+	return fmt.Sprintf("%d.%d.0.1:3000", 1+i/256, i%256)
+}
+
+// sameGroupAddr 返回 10.0.0.0/16 中的第 i 个地址，同一个来源告诉我们的这些地址都在同一个 new 桶中
+func sameGroupAddr(i int) string {
+	return fmt.Sprintf("10.0.%d.%d:3000", i/256, i%256)
+}
+
+// triedCollisions 返回 count 个落在同一个 tried 桶中的地址
+func triedCollisions(ab *addrBook, count int) []string {
+	var addrs []string
+	bucket := ab.triedBucket(groupAddr(0))
+	for i := 0; len(addrs) < count; i++ {
+		if addr := groupAddr(i); ab.triedBucket(addr) == bucket {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// checkBuckets 检查每个地址都恰好在它记录的桶中
+func checkBuckets(t *testing.T, ab *addrBook) {
+	t.Helper()
+
+	count := 0
+	for i, bucket := range ab.newBuckets {
+		for addr, ka := range bucket {
+			if ka.Tried || ka.bucket != i || ab.addrs[addr] != ka {
+				t.Fatalf("%s is in new bucket %d, tried %v, bucket %d", addr, i, ka.Tried, ka.bucket)
+			}
+		}
+		count += len(bucket)
+	}
+	for i, bucket := range ab.triedBuckets {
+		for addr, ka := range bucket {
+			if !ka.Tried || ka.bucket != i || ab.addrs[addr] != ka {
+				t.Fatalf("%s is in tried bucket %d, tried %v, bucket %d", addr, i, ka.Tried, ka.bucket)
+			}
+		}
+		count += len(bucket)
+	}
+
+	if count != len(ab.addrs) {
+		t.Fatalf("%d addresses in buckets, %d known", count, len(ab.addrs))
+	}
+}
+
+func TestSourceGroupUsesFewBuckets(t *testing.T) {
+	ab := newAddrBookWithKey(testAddrBookKey)
+	now := time.Now()
+
+	// 同一个网段中的多个来源发送大量地址也只能占据 NEW_BUCKETS_PER_SOURCE_GROUP 个桶
+	for i := 0; i < 5000; i++ {
+		source := fmt.Sprintf("203.0.113.%d:3000", i%200)
+		ab.add(groupAddr(i), SERVICE_FULL, now, source)
+	}
+	checkBuckets(t, ab)
+
+	buckets := make(map[int]bool)
+	for _, ka := range ab.addrs {
+		buckets[ka.bucket] = true
+	}
+	if len(buckets) > NEW_BUCKETS_PER_SOURCE_GROUP {
+		t.Fatalf("addresses from one source group are in %d buckets", len(buckets))
+	}
+	if ab.size() > NEW_BUCKETS_PER_SOURCE_GROUP*BUCKET_SIZE {
+		t.Fatalf("%d addresses from one source group are kept", ab.size())
+	}
+
+	// 其他来源的地址不受影响
+	if !ab.add("198.51.100.1:3000", SERVICE_FULL, now, "192.0.2.1:3000") {
+		t.Fatal("address from another source group was not added")
+	}
+}
+
+func TestFullNewBucketEvictsWorst(t *testing.T) {
+	ab := newAddrBookWithKey(testAddrBookKey)
+	now := time.Now()
+	source := "203.0.113.7:3000"
+
+	for i := 0; i < BUCKET_SIZE; i++ {
+		ab.add(sameGroupAddr(i), SERVICE_FULL, now.Add(time.Duration(i-BUCKET_SIZE)*time.Minute), source)
+	}
+	if ab.size() != BUCKET_SIZE {
+		t.Fatalf("%d addresses in a full bucket, want %d", ab.size(), BUCKET_SIZE)
+	}
+
+	// 桶满时淘汰最久没有出现过的地址
+	ab.add(sameGroupAddr(BUCKET_SIZE), SERVICE_FULL, now, source)
+	if _, ok := ab.addrs[sameGroupAddr(0)]; ok {
+		t.Fatal("oldest address was not evicted")
+	}
+
+	// 失效的地址比最旧的地址更先被淘汰
+	ab.addrs[sameGroupAddr(5)].Attempts = MAX_ADDR_FAILURES
+	ab.add(sameGroupAddr(BUCKET_SIZE+1), SERVICE_FULL, now, source)
+	if _, ok := ab.addrs[sameGroupAddr(5)]; ok {
+		t.Fatal("terrible address was not evicted")
+	}
+	if _, ok := ab.addrs[sameGroupAddr(1)]; !ok {
+		t.Fatal("oldest address was evicted before a terrible one")
+	}
+
+	if ab.size() != BUCKET_SIZE {
+		t.Fatalf("%d addresses after evicting, want %d", ab.size(), BUCKET_SIZE)
+	}
+	checkBuckets(t, ab)
+}
+
+func TestAddUpdatesKnownAddress(t *testing.T) {
+	ab := newAddrBookWithKey(testAddrBookKey)
+	now := time.Now()
+
+	if !ab.add("198.51.100.1:3000", SERVICE_FULL, now.Add(-time.Hour), "203.0.113.7:3000") {
+		t.Fatal("new address was not added")
+	}
+	if ab.add("198.51.100.1:3000", SERVICE_PRUNED, now, "192.0.2.1:3000") {
+		t.Fatal("known address was added again")
+	}
+
+	ka := ab.addrs["198.51.100.1:3000"]
+	if !ka.Timestamp.Equal(now) || ka.Services != SERVICE_PRUNED || ka.Source != "203.0.113.7:3000" {
+		t.Fatalf("known address updated to %+v", ka)
+	}
+
+	// 更旧的时间不会覆盖更新的时间
+	ab.add("198.51.100.1:3000", 0, now.Add(-2*time.Hour), "192.0.2.1:3000")
+	if !ka.Timestamp.Equal(now) || ka.Services != SERVICE_PRUNED {
+		t.Fatalf("older announcement changed the address to %+v", ka)
+	}
+
+	if ab.add("not an address", SERVICE_FULL, now, "192.0.2.1:3000") {
+		t.Fatal("invalid address was added")
+	}
+}
+
+func TestGoodMovesAddressToTried(t *testing.T) {
+	ab := newAddrBookWithKey(testAddrBookKey)
+	now := time.Now()
+	addrs := triedCollisions(ab, BUCKET_SIZE+1)
+
+	for i, addr := range addrs {
+		ab.add(addr, SERVICE_FULL, now, "203.0.113.7:3000")
+		ab.attempt(addr, now)
+		ab.good(addr, SERVICE_FULL, now.Add(time.Duration(i)*time.Minute))
+	}
+	checkBuckets(t, ab)
+
+	ka := ab.addrs[addrs[BUCKET_SIZE]]
+	if !ka.Tried || ka.Attempts != 0 || ka.LastSuccess.IsZero() {
+		t.Fatalf("address after a successful handshake is %+v", ka)
+	}
+
+	// tried 桶满时最久没有出现过的地址移回 new 桶，而不是被删除
+	evicted, ok := ab.addrs[addrs[0]]
+	if !ok {
+		t.Fatal("address evicted from the tried bucket was forgotten")
+	}
+	if evicted.Tried {
+		t.Fatal("oldest tried address was not moved back to new")
+	}
+	if ab.size() != BUCKET_SIZE+1 {
+		t.Fatalf("%d addresses known, want %d", ab.size(), BUCKET_SIZE+1)
+	}
+
+	// 不在地址簿中的地址握手成功后也会加入
+	ab.good("192.0.2.1:3000", SERVICE_FULL, now)
+	if ka := ab.addrs["192.0.2.1:3000"]; ka == nil || !ka.Tried {
+		t.Fatal("unknown address was not added to tried")
+	}
+	checkBuckets(t, ab)
+}
+
+func TestSampleSkipsTerribleAddresses(t *testing.T) {
+	ab := newAddrBookWithKey(testAddrBookKey)
+	now := time.Now()
+
+	ab.add("198.51.100.1:3000", SERVICE_FULL, now, "203.0.113.7:3000")
+	ab.add("198.51.100.2:3000", SERVICE_FULL, now.Add(-ADDR_MAX_AGE-time.Hour), "203.0.113.7:3000")
+	ab.add("192.0.2.1:3000", SERVICE_FULL, now, "203.0.113.7:3000")
+	ab.addrs["192.0.2.1:3000"].Attempts = MAX_ADDR_FAILURES
+
+	sample := ab.sample(MAX_ADDR_PER_MESSAGE, now)
+	if len(sample) != 1 || sample[0].Addr != "198.51.100.1:3000" {
+		t.Fatalf("sampled %v, want only the live address", sample)
+	}
+	if sample[0].Services != SERVICE_FULL || sample[0].Timestamp != now.Unix() {
+		t.Fatalf("sampled %+v", sample[0])
+	}
+
+	ab.remove("198.51.100.1:3000")
+	if len(ab.sample(MAX_ADDR_PER_MESSAGE, now)) != 0 {
+		t.Fatal("removed address was sampled")
+	}
+	checkBuckets(t, ab)
+}
+
+func TestAddrBookPersistence(t *testing.T) {
+	chdirTemp(t)
+
+	ab, err := loadAddrBook("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ab.size() != 0 {
+		t.Fatalf("%d addresses without a peers file", ab.size())
+	}
+
+	now := time.Now().Round(time.Second)
+	for i := 0; i < 100; i++ {
+		ab.add(groupAddr(i), SERVICE_FULL, now, fmt.Sprintf("203.0.%d.1:3000", i%7))
+	}
+	for i := 0; i < 10; i++ {
+		ab.good(groupAddr(i), SERVICE_PRUNED, now)
+	}
+	ab.attempt(groupAddr(50), now)
+
+	err = ab.save("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadAddrBook("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBuckets(t, loaded)
+
+	// 密钥相同，每个地址都回到原来的桶中
+	if string(loaded.key) != string(ab.key) {
+		t.Fatal("bucket key changed after loading")
+	}
+	if loaded.size() != ab.size() {
+		t.Fatalf("%d addresses after loading, want %d", loaded.size(), ab.size())
+	}
+	for addr, ka := range ab.addrs {
+		got := loaded.addrs[addr]
+		if got == nil {
+			t.Fatalf("%s was not loaded", addr)
+		}
+		if got.Tried != ka.Tried || got.bucket != ka.bucket || got.Services != ka.Services ||
+			got.Attempts != ka.Attempts || !got.Timestamp.Equal(ka.Timestamp) || got.Source != ka.Source {
+			t.Fatalf("%s loaded as %+v, want %+v", addr, got, ka)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"tchain/blockchain"
+	"time"
+)
+
+// 一个主机的不良行为分数达到 BAN_THRESHOLD 时断开连接并封禁对方
+const BAN_THRESHOLD = 100
+
+// 不良行为分数每经过 MISBEHAVIOR_DECAY_INTERVAL 减少 1 分，偶尔出错的节点不会一直累积分数
+const MISBEHAVIOR_DECAY_INTERVAL = time.Minute
+
+// 没有配置时封禁的时长
+const DEFAULT_BAN_DURATION = 24 * time.Hour
+
+// 封禁的地址保存在这个文件中，每次修改后立即写入
+const BANLIST_FILE = "banlist_%s.dat"
+
+// ErrUnsolicited 收到了没有请求过的数据
+var ErrUnsolicited = errors.New("Unsolicited data")
+
+// misbehaviorScore 返回处理消息时的错误对应的不良行为分数，不是对方的过错时为 0
+func misbehaviorScore(err error) int {
+	switch {
+	case errors.Is(err, blockchain.ErrInvalidBlock):
+		return 100
+	case errors.Is(err, ErrMalformedMessage):
+		return 20
+	case errors.Is(err, ErrUnsolicited):
+		return 20
+	case errors.Is(err, blockchain.ErrInvalidTransaction):
+		return 10
+	case errors.Is(err, ErrHandshakeIncomplete):
+		return 10
+	}
+
+	return 0
+}
+
+// misbehaviorScores 按主机记录的不良行为分数
+// 分数记在节点上而不是连接上，对方断开后重新连接不会清空分数，否则每次都在断开前发送格式错误的消息就永远不会被封禁
+type misbehaviorScores struct {
+	lock   sync.Mutex
+	scores map[string]*hostScore
+}
+
+// hostScore 一个主机的不良行为分数
+type hostScore struct {
+	score   int
+	updated time.Time // 上次衰减的时间
+}
+
+func newMisbehaviorScores() *misbehaviorScores {
+	return &misbehaviorScores{scores: make(map[string]*hostScore)}
+}
+
+// decay 按经过的时间减少分数，减到 0 时返回 true
+func (s *hostScore) decay(now time.Time) bool {
+	steps := int(now.Sub(s.updated) / MISBEHAVIOR_DECAY_INTERVAL)
+	if steps <= 0 {
+		return false
+	}
+
+	s.score -= steps
+	s.updated = s.updated.Add(time.Duration(steps) * MISBEHAVIOR_DECAY_INTERVAL)
+
+	return s.score <= 0
+}
+
+// add 增加 key 的分数，返回衰减后的总分，已经衰减到 0 的记录被删除
+func (ms *misbehaviorScores) add(key string, score int, now time.Time) int {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for k, s := range ms.scores {
+		if s.decay(now) {
+			delete(ms.scores, k)
+		}
+	}
+
+	s, ok := ms.scores[key]
+	if !ok {
+		s = &hostScore{updated: now}
+		ms.scores[key] = s
+	}
+	s.score += score
+
+	return s.score
+}
+
+// get 返回 key 当前的分数
+func (ms *misbehaviorScores) get(key string, now time.Time) int {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	s, ok := ms.scores[key]
+	if !ok {
+		return 0
+	}
+	if s.decay(now) {
+		delete(ms.scores, key)
+		return 0
+	}
+
+	return s.score
+}
+
+// forget 删除 key 的分数，对方被封禁后不需要再记录
+func (ms *misbehaviorScores) forget(key string) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.scores, key)
+}
+
+// BannedAddress 一个被封禁的地址，Address 为 IP，或者本机节点监听的 host:port
+type BannedAddress struct {
+	Address string
+	Until   time.Time
+}
+
+// banList 被封禁的地址以及解除封禁的时间
+type banList struct {
+	lock   sync.Mutex
+	nodeID string
+	bans   map[string]time.Time
+}
+
+// loadBanList 加载保存的封禁列表，已经过期的封禁被丢弃
+func loadBanList(nodeID string) (*banList, error) {
+	bl := &banList{nodeID: nodeID, bans: make(map[string]time.Time)}
+
+	banListFile := fmt.Sprintf(BANLIST_FILE, nodeID)
+	fileContent, err := ioutil.ReadFile(banListFile)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return bl, err
+	}
+
+	var bans map[string]time.Time
+	dec := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = dec.Decode(&bans)
+	if err != nil {
+		return bl, fmt.Errorf("Failed to decode %s: %w", banListFile, err)
+	}
+
+	now := time.Now()
+	for addr, until := range bans {
+		if until.After(now) {
+			bl.bans[addr] = until
+		}
+	}
+
+	return bl, nil
+}
+
+// save 把封禁列表写入文件，调用者需要持有 lock
+func (bl *banList) save() error {
+	banListFile := fmt.Sprintf(BANLIST_FILE, bl.nodeID)
+
+	if len(bl.bans) == 0 {
+		err := os.Remove(banListFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	tmpFile := banListFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, gobEncode(bl.bans), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, banListFile)
+}
+
+func (bl *banList) ban(addr string, until time.Time) error {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	if current, ok := bl.bans[addr]; ok && current.After(until) {
+		return nil
+	}
+	bl.bans[addr] = until
+
+	return bl.save()
+}
+
+// isBanned 判断 addr 或者它的 IP 是否被封禁
+func (bl *banList) isBanned(addr string, now time.Time) bool {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	keys := []string{addr}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		keys = append(keys, host)
+	}
+
+	for _, key := range keys {
+		if until, ok := bl.bans[key]; ok && now.Before(until) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list 返回还没有过期的封禁，按地址排序
+func (bl *banList) list(now time.Time) []BannedAddress {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	var banned []BannedAddress
+	for addr, until := range bl.bans {
+		if now.Before(until) {
+			banned = append(banned, BannedAddress{addr, until})
+		}
+	}
+
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].Address < banned[j].Address
+	})
+
+	return banned
+}
+
+// clear 解除对 addr 的封禁，addr 为空时解除所有封禁
+func (bl *banList) clear(addr string) error {
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+
+	if addr == "" {
+		bl.bans = make(map[string]time.Time)
+	} else {
+		delete(bl.bans, addr)
+	}
+
+	return bl.save()
+}
+
+// banAddress 返回封禁对方时使用的地址：其他主机按 IP 封禁，
+// 本机的节点之间只能通过端口区分，主动连接按连接的地址封禁；本机的被动连接无法识别对方，返回空字符串，只断开连接
+func banAddress(p *peer) string {
+	host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return ""
+	}
+
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if p.inbound {
+			return ""
+		}
+
+		return p.addr
+	}
+
+	return host
+}
+
+// scoreKey 返回记录对方不良行为分数的标识，与封禁时使用的地址相同
+// 无法识别的本机被动连接只能按连接记录
+func scoreKey(p *peer) string {
+	if addr := banAddress(p); addr != "" {
+		return addr
+	}
+
+	return p.addr
+}
+
+// misbehaving 按处理消息时的错误增加对方主机的不良行为分数，达到 BAN_THRESHOLD 时断开连接并封禁对方
+func (n *Node) misbehaving(p *peer, err error) {
+	score := misbehaviorScore(err)
+	if score == 0 {
+		return
+	}
+
+	key := scoreKey(p)
+	total := n.scores.add(key, score, time.Now())
+	fmt.Printf("%s misbehaved, score %d: %s\n", p.address(), total, err)
+	if total < BAN_THRESHOLD {
+		return
+	}
+
+	p.close()
+	n.scores.forget(key)
+
+	addr := banAddress(p)
+	if addr == "" {
+		fmt.Printf("Disconnected %s for misbehavior\n", p.address())
+		return
+	}
+
+	until := time.Now().Add(n.config.BanDuration)
+	err = n.bans.ban(addr, until)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to save the ban list: %s\n", err)
+	}
+	fmt.Printf("Banned %s until %s\n", addr, until.Format(time.RFC3339))
+}
+
+// Banned 返回所有被封禁的地址
+func (n *Node) Banned() []BannedAddress {
+	return n.bans.list(time.Now())
+}
+
+// ClearBanned 解除对 addr 的封禁，addr 为空时解除所有封禁
+func (n *Node) ClearBanned(addr string) error {
+	return n.bans.clear(addr)
+}
+
+type clearBanned struct {
+	Address string
+}
+
+// handleListBanned 向本机的客户端回复被封禁的地址
+func (n *Node) handleListBanned(p *peer) error {
+	err := checkLocal(p)
+	if err != nil {
+		return err
+	}
+
+	p.queue("banned", gobEncode(n.Banned()))
+
+	return nil
+}
+
+// handleClearBanned 按本机的客户端的请求解除封禁，然后回复剩下的被封禁的地址
+func (n *Node) handleClearBanned(p *peer, data []byte) error {
+	err := checkLocal(p)
+	if err != nil {
+		return err
+	}
+
+	var buff bytes.Buffer
+	var payload clearBanned
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err = dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	err = n.ClearBanned(payload.Address)
+	if err != nil {
+		return err
+	}
+
+	p.queue("banned", gobEncode(n.Banned()))
+
+	return nil
+}
+
+// ListBanned 在没有运行节点的进程中（例如命令行）查询 addr 上的节点封禁的地址
+func ListBanned(addr string) ([]BannedAddress, error) {
+	reply, err := clientRequest(addr, "listBanned", nil, "banned")
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBanned(reply)
+}
+
+// ClearBanned 在没有运行节点的进程中解除 addr 上的节点对 target 的封禁，target 为空时解除所有封禁
+// 返回剩下的被封禁的地址
+func ClearBanned(addr, target string) ([]BannedAddress, error) {
+	reply, err := clientRequest(addr, "clearBanned", gobEncode(clearBanned{target}), "banned")
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeBanned(reply)
+}
+
+func decodeBanned(data []byte) ([]BannedAddress, error) {
+	var banned []BannedAddress
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(&banned)
+	if err != nil && len(data) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	return banned, nil
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"net"
+	"os"
+	"tchain/blockchain"
+	"testing"
+	"time"
+)
+
+// chdirTemp 切换到临时目录，节点的数据文件都写在当前目录中
+func chdirTemp(t *testing.T) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// newBanTestNode 创建只用于记录不良行为的节点，封禁列表写入临时目录
+func newBanTestNode(t *testing.T) *Node {
+	chdirTemp(t)
+
+	bans, err := loadBanList("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Node{
+		config: Config{BanDuration: time.Hour},
+		peers:  newPeerManager(),
+		bans:   bans,
+		scores: newMisbehaviorScores(),
+	}
+}
+
+func TestMisbehaviorReachesBanThreshold(t *testing.T) {
+	n := newBanTestNode(t)
+	p := newTestPeer("203.0.113.7:50123", "", true)
+
+	for i := 1; i < BAN_THRESHOLD/misbehaviorScore(blockchain.ErrInvalidTransaction); i++ {
+		n.misbehaving(p, blockchain.ErrInvalidTransaction)
+
+		if n.bans.isBanned("203.0.113.7:3000", time.Now()) {
+			t.Fatalf("banned after %d invalid transactions, score %d", i, n.scores.get("203.0.113.7", time.Now()))
+		}
+	}
+
+	n.misbehaving(p, blockchain.ErrInvalidTransaction)
+	if !n.bans.isBanned("203.0.113.7:3000", time.Now()) {
+		t.Fatal("not banned at the threshold")
+	}
+	if n.bans.isBanned("203.0.113.7:3000", time.Now().Add(2*time.Hour)) {
+		t.Fatal("ban does not expire")
+	}
+
+	// 与对方无关的错误不计分
+	other := newTestPeer("203.0.113.8:50123", "", true)
+	n.misbehaving(other, os.ErrDeadlineExceeded)
+	if score := n.scores.get("203.0.113.8", time.Now()); score != 0 {
+		t.Fatalf("score %d for an error that is not the peer's fault", score)
+	}
+
+	// 无效的区块直接达到封禁的分数
+	n.misbehaving(other, blockchain.ErrInvalidBlock)
+	if !n.bans.isBanned("203.0.113.8", time.Now()) {
+		t.Fatal("not banned after an invalid block")
+	}
+}
+
+// readTestPeer 从 203.0.113.9 建立一个新的连接，把 data 写入连接后关闭，返回 readPeer 退出时这个主机的不良行为分数
+func readTestPeer(t *testing.T, n *Node, data []byte) int {
+	local, remote := net.Pipe()
+	p := newPeer(testConn{local, &net.TCPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 50123}}, "203.0.113.9:50123", true)
+
+	go func() {
+		remote.Write(data)
+		remote.Close()
+	}()
+
+	n.handlers.Add(1)
+	n.readPeer(p)
+
+	return n.scores.get("203.0.113.9", time.Now())
+}
+
+func TestFramingErrorsAreScored(t *testing.T) {
+	n := newBanTestNode(t)
+	score := misbehaviorScore(ErrMalformedMessage)
+
+	if got := readTestPeer(t, n, nil); got != 0 {
+		t.Fatalf("score %d after the peer closed the connection", got)
+	}
+
+	garbage := make([]byte, MESSAGE_HEADER_LENGTH)
+	if got := readTestPeer(t, n, garbage); got != score {
+		t.Fatalf("score %d after a bad magic, want %d", got, score)
+	}
+
+	// 分数按主机记录，新的连接继续累积
+	if got := readTestPeer(t, n, garbage[:5]); got != 2*score {
+		t.Fatalf("score %d after a truncated header, want %d", got, 2*score)
+	}
+}
+
+func TestReconnectingWithGarbageIsBanned(t *testing.T) {
+	n := newBanTestNode(t)
+	garbage := make([]byte, MESSAGE_HEADER_LENGTH)
+
+	// 每次发送格式错误的消息都会被断开，重新连接后分数仍然保留
+	for i := 1; i < BAN_THRESHOLD/misbehaviorScore(ErrMalformedMessage); i++ {
+		readTestPeer(t, n, garbage)
+
+		if n.bans.isBanned("203.0.113.9:3000", time.Now()) {
+			t.Fatalf("banned after %d connections", i)
+		}
+	}
+
+	readTestPeer(t, n, garbage)
+	if !n.bans.isBanned("203.0.113.9:3000", time.Now()) {
+		t.Fatal("not banned after reconnecting with garbage")
+	}
+}
+
+func TestMisbehaviorDecays(t *testing.T) {
+	scores := newMisbehaviorScores()
+	now := time.Now()
+
+	scores.add("203.0.113.7", 50, now)
+	if got := scores.get("203.0.113.7", now.Add(10*MISBEHAVIOR_DECAY_INTERVAL)); got != 40 {
+		t.Fatalf("score %d after 10 intervals, want 40", got)
+	}
+
+	if got := scores.add("203.0.113.7", 20, now.Add(30*MISBEHAVIOR_DECAY_INTERVAL)); got != 40 {
+		t.Fatalf("score %d after 30 intervals and 20 more, want 40", got)
+	}
+
+	// 衰减到 0 后记录被删除，之后重新开始计分
+	if got := scores.get("203.0.113.7", now.Add(100*MISBEHAVIOR_DECAY_INTERVAL)); got != 0 {
+		t.Fatalf("score %d after decaying, want 0", got)
+	}
+	if len(scores.scores) != 0 {
+		t.Fatalf("%d scores kept after decaying", len(scores.scores))
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// 请求主链上从 StartHeight 到 StopHash 的紧凑过滤器
+type getCFilters struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+// 区块的紧凑过滤器以及过滤器头
+type cfilter struct {
+	AddrFrom  string
+	BlockHash []byte
+	Filter    []byte
+	Header    []byte
+}
+
+func (n *Node) sendCFilter(addr string, blockHash []byte, filter []byte, header []byte) {
+	payload := gobEncode(cfilter{n.address, blockHash, filter, header})
+	n.sendData(addr, "cfilter", payload)
+}
+
+func (n *Node) handleGetCFilters(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload getCFilters
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	hashes, err := n.bc.GetBlockHashesRange(payload.StartHeight, payload.StopHash)
+	if err != nil {
+		fmt.Printf("Invalid getCFilters from %s: %s\n", p.addr, err)
+		return nil
+	}
+
+	for _, hash := range hashes {
+		filter, err := n.bc.GetCFilter(hash)
+		if err != nil {
+			return err
+		}
+
+		header, err := n.bc.GetCFilterHeader(hash)
+		if err != nil {
+			return err
+		}
+
+		n.sendCFilter(p.addr, hash, filter.Bytes(), header)
+	}
+
+	return nil
+}
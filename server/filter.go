@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"tchain/blockchain"
+	"tchain/bloom"
+	"tchain/merkle"
+)
+
+// 轻节点加载布隆过滤器
+type filterLoad struct {
+	AddrFrom string
+	Filter   []byte
+}
+
+// 轻节点向已加载的布隆过滤器中加入数据
+type filterAdd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+// 轻节点移除布隆过滤器
+type filterClear struct {
+	AddrFrom string
+}
+
+// relayToPeer 检查是否需要向节点转发交易，没有加载过滤器的节点接收所有交易
+func (n *Node) relayToPeer(addr string, tx *blockchain.Transaction) bool {
+	n.peerFiltersLock.Lock()
+	defer n.peerFiltersLock.Unlock()
+
+	filter := n.peerFilters[addr]
+	if filter == nil {
+		return true
+	}
+
+	return tx.MatchesFilter(filter)
+}
+
+// filterBlock 使用节点加载的过滤器过滤区块，节点没有加载过滤器时返回 false
+func (n *Node) filterBlock(addr string, b *blockchain.Block) (*merkle.PartialMerkleTree, []*blockchain.Transaction, bool) {
+	n.peerFiltersLock.Lock()
+	defer n.peerFiltersLock.Unlock()
+
+	filter := n.peerFilters[addr]
+	if filter == nil {
+		return nil, nil, false
+	}
+
+	tree, txs := b.FilterBlock(filter)
+
+	return tree, txs, true
+}
+
+func (n *Node) sendFilterLoad(address string, filter *bloom.Filter) {
+	payload := gobEncode(filterLoad{n.address, filter.Serialize()})
+	n.sendData(address, "filterLoad", payload)
+}
+
+func (n *Node) handleFilterLoad(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload filterLoad
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	filter, err := bloom.DeserializeFilter(payload.Filter)
+	if err != nil {
+		fmt.Printf("Rejected filter from %s: %s\n", p.addr, err)
+		return nil
+	}
+
+	n.peerFiltersLock.Lock()
+	n.peerFilters[p.addr] = filter
+	n.peerFiltersLock.Unlock()
+
+	fmt.Printf("Loaded filter from %s, %d bytes, %d hash functions\n", p.addr, len(filter.Data), filter.HashFuncs)
+
+	return nil
+}
+
+func (n *Node) handleFilterAdd(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload filterAdd
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	n.peerFiltersLock.Lock()
+	defer n.peerFiltersLock.Unlock()
+
+	filter := n.peerFilters[p.addr]
+	if filter == nil {
+		fmt.Printf("%s added data without loading a filter\n", p.addr)
+		return nil
+	}
+
+	filter.Add(payload.Data)
+
+	return nil
+}
+
+func (n *Node) handleFilterClear(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload filterClear
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	n.peerFiltersLock.Lock()
+	delete(n.peerFilters, p.addr)
+	n.peerFiltersLock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// 节点能够接受的最低协议版本，更早的版本不使用消息头，无法通信
+const MIN_PROTOCOL_VERSION = 2
+
+const USER_AGENT = "/tchain/"
+
+// 连接后必须在 HANDSHAKE_TIMEOUT 之内完成握手，否则断开连接
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// 节点在 version 消息中声明自己提供的服务
+const (
+	SERVICE_FULL   = 1 << iota // 保存了从创世块开始的所有区块
+	SERVICE_PRUNED             // 只保存了最近的区块，例如裁剪模式或者从快照启动的节点
+	SERVICE_LIGHT              // 轻节点，只保存区块头，不能提供区块
+	SERVICE_INDEX              // 可以提供区块的紧凑过滤器
+)
+
+// ErrHandshakeIncomplete 握手完成之前收到了其他消息
+var ErrHandshakeIncomplete = errors.New("Handshake is not complete")
+
+// ErrProtocolVersion 对方的协议版本低于 MIN_PROTOCOL_VERSION
+var ErrProtocolVersion = errors.New("Protocol version is too old")
+
+// ErrSelfConnection 连接到了节点自己
+var ErrSelfConnection = errors.New("Connected to self")
+
+func randomNonce() (uint64, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(nonce), nil
+}
+
+// services 返回节点当前能够提供的服务
+func (n *Node) services() (uint64, error) {
+	if n.hc != nil {
+		return SERVICE_LIGHT, nil
+	}
+
+	full, err := n.bc.HasFullHistory()
+	if err != nil {
+		return 0, err
+	}
+
+	if full {
+		return SERVICE_FULL | SERVICE_INDEX, nil
+	}
+
+	return SERVICE_PRUNED | SERVICE_INDEX, nil
+}
+
+func servicesString(services uint64) string {
+	var names []string
+	for _, s := range []struct {
+		flag uint64
+		name string
+	}{
+		{SERVICE_FULL, "full"},
+		{SERVICE_PRUNED, "pruned"},
+		{SERVICE_LIGHT, "light"},
+		{SERVICE_INDEX, "index"},
+	} {
+		if services&s.flag != 0 {
+			names = append(names, s.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return fmt.Sprintf("%s", names)
+}
+
+// sendVersion 直接通过连接发送 version，此时对方的地址可能还不知道
+func (n *Node) sendVersion(p *peer) error {
+	services, err := n.services()
+	if err != nil {
+		return err
+	}
+
+	var bestHeight, pruneHeight int
+	if n.hc != nil {
+		bestHeight, err = n.hc.GetBestHeight()
+	} else {
+		bestHeight, err = n.bc.GetBestHeight()
+		if err == nil {
+			pruneHeight, err = n.bc.PruneHeight()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	payload := gobEncode(version{NODE_VERSION, services, USER_AGENT, n.nonce, bestHeight, n.address, pruneHeight})
+	p.queue("version", payload)
+
+	return nil
+}
+
+func (n *Node) sendVerack(p *peer) {
+	p.queue("verack", nil)
+}
+
+// handleVersion 检查对方的版本，被动连接回复自己的 version，然后回复 verack
+// 协议版本过低或者连接到自己时断开连接
+func (n *Node) handleVersion(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload version
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if p.version != nil {
+		return fmt.Errorf("%w: duplicate version", ErrMalformedMessage)
+	}
+
+	if payload.Version < MIN_PROTOCOL_VERSION {
+		p.close()
+		return fmt.Errorf("%w: %s uses version %d, minimum is %d", ErrProtocolVersion, p.conn.RemoteAddr(), payload.Version, MIN_PROTOCOL_VERSION)
+	}
+
+	if payload.Nonce == n.nonce {
+		p.close()
+
+		// 被动连接的另一端是节点自己的主动连接，它连接的地址指向节点自己，不再连接它
+		if self := n.peers.outboundFrom(p.conn.RemoteAddr()); self != nil {
+			self.close()
+			n.addrBook.remove(self.addr)
+		}
+
+		return fmt.Errorf("%w: %s", ErrSelfConnection, p.address())
+	}
+
+	p.version = &payload
+
+	if p.inbound {
+		err = n.sendVersion(p)
+		if err != nil {
+			return err
+		}
+	}
+	n.sendVerack(p)
+
+	return n.completeHandshake(p)
+}
+
+func (n *Node) handleVerack(p *peer) error {
+	if p.verackReceived {
+		return fmt.Errorf("%w: duplicate verack", ErrMalformedMessage)
+	}
+	p.verackReceived = true
+
+	return n.completeHandshake(p)
+}
+
+// completeHandshake 收到对方的 version 和 verack 之后握手完成，开始处理其他消息并与对方同步
+func (n *Node) completeHandshake(p *peer) error {
+	if p.version == nil || !p.verackReceived {
+		return nil
+	}
+
+	v := p.version
+	n.peers.setReady(p)
+	fmt.Printf("Connected to %s %s, version %d, services %s, height %d\n", p.address(), v.UserAgent, v.Version, servicesString(v.Services), v.BestHeight)
+
+	// 主动连接的地址确认可用，并向对方请求更多的地址
+	// 被动连接的对方声明的监听地址没有经过验证，只作为地址簿中的新地址，之后主动连接成功才会被确认
+	if !p.inbound {
+		n.peers.succeeded(p.addr)
+		n.addrBook.good(p.addr, v.Services, time.Now())
+		n.sendGetAddr(p)
+	} else if v.AddrFrom != "" && v.AddrFrom != n.address && v.Services&(SERVICE_FULL|SERVICE_PRUNED) != 0 {
+		n.addrBook.add(v.AddrFrom, v.Services, time.Now(), p.address())
+	}
+
+	err := n.advertiseAddress(p)
+	if err != nil {
+		return err
+	}
+
+	n.handlers.Add(1)
+	go n.pingPeer(p)
+
+	if n.hc != nil {
+		return n.startLightSync(p)
+	}
+
+	return n.startSync(p)
+}
+
+// dialClient 以不提供任何服务的客户端连接 addr 上的节点并完成握手，之后对方才会处理其他消息
+func dialClient(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(PROTOCOL, addr, DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+
+	err = clientHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func clientHandshake(conn net.Conn) error {
+	nonce, err := randomNonce()
+	if err != nil {
+		return err
+	}
+
+	err = writeMessage(conn, "version", gobEncode(version{NODE_VERSION, 0, USER_AGENT, nonce, 0, "", 0}))
+	if err != nil {
+		return err
+	}
+
+	versionReceived, verackReceived := false, false
+	for !versionReceived || !verackReceived {
+		command, _, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch command {
+		case "version":
+			versionReceived = true
+			err = writeMessage(conn, "verack", nil)
+			if err != nil {
+				return err
+			}
+		case "verack":
+			verackReceived = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"tchain/blockchain"
+	"tchain/merkle"
+)
+
+// 轻节点布隆过滤器的误判率，误判率越高，全节点越难判断哪些交易属于轻节点，但浪费的带宽越多
+const LIGHT_FILTER_FP_RATE = 0.001
+
+func (n *Node) sendGetHeaders(address string) {
+	payload := gobEncode(getHeaders{n.address, n.hc.Tip()})
+	n.sendData(address, "getHeaders", payload)
+}
+
+func (n *Node) sendGetMerkleBlock(address string, blockHash []byte) {
+	payload := gobEncode(getMerkleBlock{n.address, blockHash})
+	n.sendData(address, "getMerkleBlock", payload)
+}
+
+// startLightSync 握手完成后加载过滤器，并下载缺少的区块头和过滤器
+func (n *Node) startLightSync(p *peer) error {
+	v := p.version
+
+	// 只从能提供区块的节点同步
+	if v.Services&(SERVICE_FULL|SERVICE_PRUNED) == 0 {
+		return nil
+	}
+
+	// 先加载过滤器，之后请求的交易和区块都会经过过滤
+	if n.walletFilter != nil {
+		n.sendFilterLoad(p.addr, n.walletFilter)
+	}
+
+	bestHeight, err := n.hc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	// 轻节点只下载区块头，不下载完整的区块
+	if bestHeight < v.BestHeight {
+		n.sendGetHeaders(p.addr)
+	}
+
+	// 继续处理上次退出时还没有匹配的过滤器
+	if n.config.CFilters && v.Services&SERVICE_INDEX != 0 {
+		return n.requestCFilters(p.addr)
+	}
+
+	return nil
+}
+
+func (n *Node) handleHeaders(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload headers
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	fmt.Printf("Received %d headers\n", len(payload.Headers))
+
+	for _, headerData := range payload.Headers {
+		header, err := blockchain.DeserializeBlockHeader(headerData)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+		}
+
+		// 校验工作量证明和链接关系，无效的区块头之后的区块头也无法链接，直接停止处理
+		added, err := n.hc.AddHeader(header)
+		if err != nil {
+			return fmt.Errorf("Rejected header %x: %w", header.Hash, err)
+		}
+
+		// 对于新的区块头，请求其中与钱包相关的交易
+		if added && n.walletFilter != nil {
+			n.sendGetMerkleBlock(p.addr, header.Hash)
+		}
+	}
+
+	// 使用紧凑过滤器时，请求新区块的过滤器，在本地进行匹配
+	if n.config.CFilters {
+		err = n.requestCFilters(p.addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 区块头数量达到上限，说明还有更多的区块头需要下载
+	if len(payload.Headers) == MAX_HEADERS {
+		n.sendGetHeaders(p.addr)
+	}
+
+	return nil
+}
+
+func (n *Node) handleMerkleBlock(data []byte) error {
+	var buff bytes.Buffer
+	var payload merkleBlock
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	header, err := blockchain.DeserializeBlockHeader(payload.Header)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	tree, err := merkle.DeserializePartialMerkleTree(payload.Tree)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	// 使用本地保存的区块头验证部分 Merkle 树，过滤器误判的交易也会被保存，但计算余额时不会用到
+	count, err := n.hc.AddMerkleBlock(header.Hash, tree, payload.Transactions)
+	if err != nil {
+		return fmt.Errorf("Rejected merkle block %x: %w", header.Hash, err)
+	}
+
+	fmt.Printf("Received %d wallet transactions in block %x\n", count, header.Hash)
+
+	return nil
+}
+
+func (n *Node) handleLightTx(data []byte) error {
+	var buff bytes.Buffer
+	var payload tx
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	// 未确认的交易没有 Merkle 证明，只做提示，等它被打包后再通过 merkleBlock 保存
+	tx, err := blockchain.DeserializeTransaction(payload.Transaction)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	fmt.Printf("Received unconfirmed wallet transaction %x\n", tx.ID)
+
+	return nil
+}
+
+func (n *Node) handleLightInv(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload inv
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if len(payload.Items) == 0 {
+		return fmt.Errorf("%w: inventory from %s is empty", ErrMalformedMessage, p.addr)
+	}
+
+	// 有新块时只请求新的区块头，交易会通过 merkleBlock 获取
+	if payload.Type == "block" {
+		n.sendGetHeaders(p.addr)
+	}
+
+	// 全节点只会转发与过滤器匹配的交易
+	if payload.Type == "tx" {
+		n.sendGetData(p.addr, "tx", payload.Items[0])
+	}
+
+	return nil
+}
+
+func (n *Node) handleLightNotFound(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload notFound
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	// 裁剪节点无法提供旧区块，这些区块中的钱包交易需要从其他全节点获取
+	fmt.Printf("Peer %s cannot serve %s %x\n", p.addr, payload.Type, payload.ID)
+
+	return nil
+}
+
+// handleLightMessage 把轻节点收到的消息交给对应的处理函数
+func (n *Node) handleLightMessage(p *peer, command string, payload []byte) error {
+	var err error
+
+	switch command {
+	case "headers":
+		err = n.handleHeaders(p, payload)
+	case "merkleBlock":
+		err = n.handleMerkleBlock(payload)
+	case "inv":
+		err = n.handleLightInv(p, payload)
+	case "tx":
+		err = n.handleLightTx(payload)
+	case "cfilter":
+		err = n.handleCFilter(p, payload)
+	case "block":
+		err = n.handleLightBlock(p, payload)
+	case "notFound":
+		err = n.handleLightNotFound(p, payload)
+	default:
+		fmt.Println("Ignored command in light mode!")
+	}
+
+	return err
+}
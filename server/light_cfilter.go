@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"tchain/blockchain"
+	"tchain/gcs"
+)
+
+func (n *Node) sendGetCFilters(address string, startHeight int, stopHash []byte) {
+	payload := gobEncode(getCFilters{n.address, startHeight, stopHash})
+	n.sendData(address, "getCFilters", payload)
+}
+
+// cfilterTipHeight 返回最后一个已处理的过滤器的高度，没有时返回 -1
+func (n *Node) cfilterTipHeight() (int, error) {
+	tip, err := n.hc.GetCFilterTip()
+	if err != nil {
+		return 0, err
+	}
+	if tip == nil {
+		return -1, nil
+	}
+
+	header, err := n.hc.GetHeader(tip)
+	if err != nil {
+		return 0, err
+	}
+
+	return header.Height, nil
+}
+
+// requestCFilters 请求所有尚未处理的区块的过滤器，每个请求最多包含 MAX_CFILTERS 个区块
+func (n *Node) requestCFilters(address string) error {
+	bestHeight, err := n.hc.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	tipHeight, err := n.cfilterTipHeight()
+	if err != nil {
+		return err
+	}
+
+	for start := tipHeight + 1; start <= bestHeight; start += blockchain.MAX_CFILTERS {
+		stop := start + blockchain.MAX_CFILTERS - 1
+		if stop > bestHeight {
+			stop = bestHeight
+		}
+
+		stopHash, err := n.hc.GetMainChainHash(stop)
+		if err != nil {
+			return err
+		}
+		if stopHash == nil {
+			return nil
+		}
+
+		n.sendGetCFilters(address, start, stopHash)
+	}
+
+	return nil
+}
+
+func (n *Node) handleCFilter(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload cfilter
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if _, err := n.hc.GetHeader(payload.BlockHash); err != nil {
+		fmt.Printf("Received filter for unknown block %x\n", payload.BlockHash)
+		return nil
+	}
+
+	err = n.hc.PutCFilter(payload.BlockHash, payload.Filter, payload.Header)
+	if err != nil {
+		return err
+	}
+
+	return n.scanCFilters(p.addr)
+}
+
+// scanCFilters 按高度顺序验证过滤器头链，并使用钱包的公钥哈希和 outpoint 在本地匹配过滤器
+// 匹配到时下载完整的区块，全节点无法知道轻节点关心的是区块中的哪笔交易
+func (n *Node) scanCFilters(address string) error {
+	n.cfilterScanLock.Lock()
+	defer n.cfilterScanLock.Unlock()
+
+	if n.pendingBlock != nil {
+		return nil
+	}
+
+	for {
+		var prevHeader []byte
+
+		prevHash, err := n.hc.GetCFilterTip()
+		if err != nil {
+			return err
+		}
+		if prevHash != nil {
+			_, prevHeader, err = n.hc.GetCFilter(prevHash)
+			if err != nil {
+				return err
+			}
+		}
+
+		tipHeight, err := n.cfilterTipHeight()
+		if err != nil {
+			return err
+		}
+
+		hash, err := n.hc.GetMainChainHash(tipHeight + 1)
+		if err != nil {
+			return err
+		}
+		if hash == nil {
+			return nil
+		}
+
+		filterData, filterHeader, err := n.hc.GetCFilter(hash)
+		if err != nil {
+			return err
+		}
+		if filterData == nil {
+			return nil
+		}
+
+		filter, err := gcs.FromBytes(filterData)
+		if err != nil {
+			fmt.Printf("Invalid filter for block %x: %s\n", hash, err)
+			return nil
+		}
+
+		// 过滤器头必须与前一个过滤器头连成链，否则说明全节点提供的过滤器被篡改了
+		if !bytes.Equal(gcs.FilterHeader(filter.Hash(), prevHeader), filterHeader) {
+			fmt.Printf("Filter header mismatch at block %x\n", hash)
+			return nil
+		}
+
+		outpoints, err := n.hc.WalletOutpoints(n.walletPubKeyHashes)
+		if err != nil {
+			return err
+		}
+
+		items := append(outpoints, n.walletPubKeyHashes...)
+		matched, err := filter.MatchAny(hash, items)
+		if err != nil {
+			fmt.Printf("Invalid filter for block %x: %s\n", hash, err)
+			return nil
+		}
+
+		if matched {
+			fmt.Printf("Filter matched block %x, downloading it\n", hash)
+			n.pendingBlock = hash
+			n.sendGetData(address, "block", hash)
+			return nil
+		}
+
+		err = n.hc.SetCFilterTip(hash)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Node) handleLightBlock(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload block
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	block, err := blockchain.DeserializeBlock(payload.Block)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if !p.fulfill(block.Hash) {
+		return fmt.Errorf("%w: block %x was not requested", ErrUnsolicited, block.Hash)
+	}
+
+	count, err := n.hc.AddWalletBlock(block, n.walletPubKeyHashes)
+	if err != nil {
+		return fmt.Errorf("Rejected block %x: %w", block.Hash, err)
+	}
+
+	fmt.Printf("Received %d wallet transactions in block %x\n", count, block.Hash)
+
+	n.cfilterScanLock.Lock()
+	if bytes.Equal(block.Hash, n.pendingBlock) {
+		n.pendingBlock = nil
+
+		err = n.hc.SetCFilterTip(block.Hash)
+	}
+	n.cfilterScanLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return n.scanCFilters(p.addr)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"tchain/blockchain"
+)
+
+// 节点停止时内存池中的交易保存在这个文件中，下次启动时重新加载
+const MEMPOOL_FILE = "mempool_%s.dat"
+
+// ErrMempoolConflict 交易花费的输出已经被内存池中的另一笔交易花费
+// 冲突的交易可能都是由诚实的节点转发的，所以不计入对方的不良行为分数
+var ErrMempoolConflict = errors.New("Transaction conflicts with the mempool")
+
+// outpoint 返回输入引用的输出的标识
+func outpoint(vin blockchain.TXInput) string {
+	return fmt.Sprintf("%x:%d", vin.TxID, vin.VOut)
+}
+
+// checkInputs 检查交易的输入引用的输出都在 UTXO 集中，并且不在 spent 中
+func (n *Node) checkInputs(tx *blockchain.Transaction, spent map[string]bool) error {
+	u := blockchain.UTXOSet{Blockchain: n.bc}
+
+	for _, vin := range tx.VIn {
+		if spent[outpoint(vin)] {
+			return fmt.Errorf("%w: transaction %x spends %s", ErrMempoolConflict, tx.ID, outpoint(vin))
+		}
+
+		_, found, err := u.FindOutput(vin.TxID, vin.VOut)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("%w: transaction %x spends missing or spent output %s", blockchain.ErrInvalidTransaction, tx.ID, outpoint(vin))
+		}
+	}
+
+	return nil
+}
+
+// acceptTx 验证交易并把它加入内存池，返回内存池中的交易数量
+// 交易的签名必须有效，引用的输出必须在 UTXO 集中，并且没有被内存池中的其他交易花费
+func (n *Node) acceptTx(tx blockchain.Transaction) (int, error) {
+	err := n.bc.VerifyTransaction(&tx)
+	if err != nil {
+		return 0, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	txID := hex.EncodeToString(tx.ID)
+	if _, ok := n.mempool[txID]; ok {
+		return len(n.mempool), nil
+	}
+
+	spent := make(map[string]bool)
+	for _, mempoolTx := range n.mempool {
+		for _, vin := range mempoolTx.VIn {
+			spent[outpoint(vin)] = true
+		}
+	}
+
+	err = n.checkInputs(&tx, spent)
+	if err != nil {
+		return 0, err
+	}
+
+	n.mempool[txID] = tx
+
+	return len(n.mempool), nil
+}
+
+// blockTemplate 从内存池中选出打包到新区块中的交易
+// 签名无效、引用的输出已经不在 UTXO 集中（例如被新的区块花费）或者与已选中的交易冲突的交易从内存池中删除，
+// 否则之后每次挖矿都会因为这些交易失败
+func (n *Node) blockTemplate() []*blockchain.Transaction {
+	var txs []*blockchain.Transaction
+	spent := make(map[string]bool)
+
+	for _, tx := range n.Mempool() {
+		tx := tx
+
+		err := n.bc.VerifyTransaction(&tx)
+		if err == nil {
+			err = n.checkInputs(&tx, spent)
+		}
+		if errors.Is(err, blockchain.ErrInvalidTransaction) || errors.Is(err, ErrMempoolConflict) {
+			fmt.Printf("Removed transaction %x from the mempool: %s\n", tx.ID, err)
+			n.removeMempoolTx(hex.EncodeToString(tx.ID))
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Ignored transaction %x: %s\n", tx.ID, err)
+			continue
+		}
+
+		for _, vin := range tx.VIn {
+			spent[outpoint(vin)] = true
+		}
+		txs = append(txs, &tx)
+	}
+
+	return txs
+}
+
+// saveMempool 把内存池中的交易写入文件，先写入临时文件再重命名，中途退出不会留下不完整的文件
+func (n *Node) saveMempool() error {
+	mempoolFile := fmt.Sprintf(MEMPOOL_FILE, n.config.NodeID)
+
+	var txs [][]byte
+	for _, tx := range n.Mempool() {
+		txs = append(txs, tx.Serialize())
+	}
+
+	if len(txs) == 0 {
+		err := os.Remove(mempoolFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return nil
+	}
+
+	tmpFile := mempoolFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, gobEncode(txs), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile, mempoolFile)
+}
+
+// loadMempool 加载上次停止时保存的交易，和收到的交易一样通过 acceptTx 验证，无效或者冲突的交易会被丢弃
+func (n *Node) loadMempool() error {
+	mempoolFile := fmt.Sprintf(MEMPOOL_FILE, n.config.NodeID)
+
+	fileContent, err := ioutil.ReadFile(mempoolFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var txs [][]byte
+	dec := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = dec.Decode(&txs)
+	if err != nil {
+		return fmt.Errorf("Failed to decode %s: %w", mempoolFile, err)
+	}
+
+	loaded := 0
+	for _, data := range txs {
+		tx, err := blockchain.DeserializeTransaction(data)
+		if err != nil {
+			return fmt.Errorf("Failed to decode %s: %w", mempoolFile, err)
+		}
+
+		_, err = n.acceptTx(tx)
+		if err != nil {
+			continue
+		}
+		loaded++
+	}
+
+	if loaded > 0 {
+		fmt.Printf("Loaded %d transactions into the mempool\n", loaded)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// 每条消息以 28 字节的消息头开始，之后是 payload：
+// magic (4) | 命令，不足的部分补 0 (16) | payload 的长度 (4) | payload 两次 SHA-256 的前 4 字节 (4)
+// 一个连接中可以连续发送多条消息
+const NETWORK_MAGIC = 0x7463686e
+const COMMAND_LENGTH = 16
+const CHECKSUM_LENGTH = 4
+const MESSAGE_HEADER_LENGTH = 4 + COMMAND_LENGTH + 4 + CHECKSUM_LENGTH
+
+// 单条消息 payload 的最大长度，超过时不会读取 payload
+const MAX_PAYLOAD_LENGTH = 32 << 20
+
+// commandToBytes 把命令补 0 到 COMMAND_LENGTH 字节，命令过长时返回 ErrMalformedMessage
+func commandToBytes(command string) ([]byte, error) {
+	if len(command) > COMMAND_LENGTH {
+		return nil, fmt.Errorf("%w: command %q is longer than %d bytes", ErrMalformedMessage, command, COMMAND_LENGTH)
+	}
+
+	bytes := make([]byte, COMMAND_LENGTH)
+	copy(bytes, command)
+
+	return bytes, nil
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", command)
+}
+
+func checksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:CHECKSUM_LENGTH]
+}
+
+// writeMessage 把命令和 payload 封装成一条消息写入 w
+func writeMessage(w io.Writer, command string, payload []byte) error {
+	commandBytes, err := commandToBytes(command)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, MESSAGE_HEADER_LENGTH)
+	binary.BigEndian.PutUint32(header[:4], NETWORK_MAGIC)
+	copy(header[4:], commandBytes)
+	binary.BigEndian.PutUint32(header[4+COMMAND_LENGTH:], uint32(len(payload)))
+	copy(header[4+COMMAND_LENGTH+4:], checksum(payload))
+
+	_, err = w.Write(append(header, payload...))
+
+	return err
+}
+
+// readMessage 从 r 中读取下一条消息，r 在两条消息之间结束时返回 io.EOF
+// magic、长度或者校验和不正确时返回 ErrMalformedMessage，之后的数据无法再按消息读取
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, MESSAGE_HEADER_LENGTH)
+	_, err := io.ReadFull(r, header)
+	if err == io.ErrUnexpectedEOF {
+		return "", nil, fmt.Errorf("%w: truncated header", ErrMalformedMessage)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	magic := binary.BigEndian.Uint32(header[:4])
+	if magic != NETWORK_MAGIC {
+		return "", nil, fmt.Errorf("%w: unknown network magic %08x", ErrMalformedMessage, magic)
+	}
+
+	command := bytesToCommand(header[4 : 4+COMMAND_LENGTH])
+	length := binary.BigEndian.Uint32(header[4+COMMAND_LENGTH:])
+	if length > MAX_PAYLOAD_LENGTH {
+		return "", nil, fmt.Errorf("%w: %s payload of %d bytes is too large", ErrMalformedMessage, command, length)
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", nil, fmt.Errorf("%w: truncated %s payload", ErrMalformedMessage, command)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if !bytes.Equal(checksum(payload), header[4+COMMAND_LENGTH+4:]) {
+		return "", nil, fmt.Errorf("%w: %s checksum mismatch", ErrMalformedMessage, command)
+	}
+
+	return command, payload, nil
+}
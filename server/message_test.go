@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buff bytes.Buffer
+
+	commands := []string{"version", "getMerkleBlock", "verack"}
+	for _, command := range commands {
+		err := writeMessage(&buff, command, []byte(command))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range commands {
+		command, payload, err := readMessage(&buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != want || string(payload) != want {
+			t.Fatalf("read %s %q, want %s", command, payload, want)
+		}
+	}
+
+	_, _, err := readMessage(&buff)
+	if err != io.EOF {
+		t.Fatalf("read after the last message: %v, want EOF", err)
+	}
+}
+
+func TestLongCommand(t *testing.T) {
+	var buff bytes.Buffer
+
+	err := writeMessage(&buff, strings.Repeat("x", COMMAND_LENGTH+1), nil)
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("long command: %v, want ErrMalformedMessage", err)
+	}
+	if buff.Len() != 0 {
+		t.Fatal("long command was written")
+	}
+}
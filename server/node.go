@@ -0,0 +1,473 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"tchain/blockchain"
+	"tchain/bloom"
+	"tchain/wallet"
+	"time"
+)
+
+// 中心节点的地址，没有配置其他节点时首先连接它
+const CENTRAL_NODE = "localhost:3000"
+
+// 停止节点时等待正在处理的连接的最长时间，超时后关闭这些连接
+const SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// ErrNodeStopped 节点已经停止，不能再次启动
+var ErrNodeStopped = errors.New("Node is stopped")
+
+// Config 节点的配置
+type Config struct {
+	NodeID       string   // 节点 ID，决定监听的端口和数据文件的名称
+	MinerAddress string   // 挖矿奖励的地址，为空时不挖矿
+	KnownNodes   []string // 启动时加入地址簿的节点，第一个是中心节点，为空时使用 CENTRAL_NODE
+
+	PruneDepth    int // 大于 0 时开启裁剪模式，只保留最近 PruneDepth 个区块的完整内容
+	CacheSize     int // UTXO 缓存的内存上限（字节）
+	FlushInterval int // 每 FlushInterval 个区块把缓存写入 chainstate
+
+	Light    bool // 只同步区块头的轻节点
+	CFilters bool // 轻节点使用紧凑过滤器在本地匹配区块，否则向全节点加载布隆过滤器
+
+	BanDuration time.Duration // 封禁不良行为分数达到 BAN_THRESHOLD 的节点的时长，为 0 时使用 DEFAULT_BAN_DURATION
+}
+
+// Node 一个全节点或者轻节点，节点的状态都保存在这里，同一个进程中可以运行多个节点
+type Node struct {
+	config  Config
+	address string
+	nonce   uint64 // 在 version 中发送，用于发现连接到了自己
+
+	bc *blockchain.Blockchain  // 全节点的区块链
+	hc *blockchain.HeaderChain // 轻节点的区块头链
+
+	listener  net.Listener
+	serving   sync.WaitGroup // 接受连接的循环
+	handlers  sync.WaitGroup // 正在处理的连接和后台任务
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+	quit      chan struct{} // Stop 被调用时关闭
+	done      chan struct{} // 节点完全停止后关闭
+	stopOnce  sync.Once
+	err       error // 节点因为错误停止时的原因
+
+	peers    *peerManager
+	addrBook *addrBook
+	bans     *banList
+	scores   *misbehaviorScores // 按主机记录的不良行为分数
+
+	// 正在下载的区块和内存池会在多个连接中同时访问
+	lock            sync.Mutex
+	blocksInTransit [][]byte
+	mempool         map[string]blockchain.Transaction
+
+	// 轻节点加载的布隆过滤器，key 为轻节点连接的标识（peer.addr）
+	// 匹配交易时过滤器可能会被更新，因此需要加锁
+	peerFilters     map[string]*bloom.Filter
+	peerFiltersLock sync.Mutex
+
+	// 同一时间只运行一个快照验证
+	snapshotValidationLock sync.Mutex
+
+	// 轻节点的布隆过滤器，包含本地钱包的公钥哈希和公钥
+	walletFilter *bloom.Filter
+	// 本地钱包的公钥哈希，用于在本地匹配紧凑过滤器和区块中的交易
+	walletPubKeyHashes [][]byte
+
+	// 过滤器必须按高度顺序验证和匹配，匹配到的区块下载完成之前不会继续处理之后的过滤器
+	cfilterScanLock sync.Mutex
+	pendingBlock    []byte
+}
+
+// NewNode 根据配置创建节点并打开节点的数据库，节点在 Start 之后才开始接受连接
+func NewNode(config Config) (*Node, error) {
+	if len(config.KnownNodes) == 0 {
+		config.KnownNodes = []string{CENTRAL_NODE}
+	}
+	if config.BanDuration <= 0 {
+		config.BanDuration = DEFAULT_BAN_DURATION
+	}
+
+	n := &Node{
+		config:      config,
+		address:     fmt.Sprintf("localhost:%s", config.NodeID),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
+		peers:       newPeerManager(),
+		scores:      newMisbehaviorScores(),
+		mempool:     make(map[string]blockchain.Transaction),
+		peerFilters: make(map[string]*bloom.Filter),
+	}
+
+	var err error
+	n.nonce, err = randomNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	n.addrBook, err = loadAddrBook(config.NodeID)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to load the address book: %s\n", err)
+		n.addrBook, err = newAddrBook()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range config.KnownNodes {
+		n.addrBook.add(addr, 0, time.Now(), n.address)
+	}
+
+	n.bans, err = loadBanList(config.NodeID)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to load the ban list: %s\n", err)
+	}
+
+	if config.Light {
+		err = n.openHeaderChain()
+	} else {
+		err = n.openBlockchain()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+// openBlockchain 打开全节点的区块链，恢复 UTXO 集并按配置裁剪
+func (n *Node) openBlockchain() error {
+	bc, err := blockchain.NewBlockchain(n.config.NodeID)
+	if err != nil {
+		return err
+	}
+
+	// 快照验证失败的 chainstate 不可信，不能再启动节点
+	err = bc.CheckChainstate()
+	if err != nil {
+		bc.DB.Close()
+		return err
+	}
+
+	// 上次退出时缓存可能还没有写入 chainstate，先重新应用缺少的区块
+	recovered, err := bc.RecoverUTXOSet()
+	if err != nil {
+		bc.DB.Close()
+		return err
+	}
+	if recovered {
+		fmt.Println("UTXO set was behind the blockchain, recovered by replaying blocks")
+	}
+
+	bc.EnableUTXOCache(n.config.CacheSize, n.config.FlushInterval)
+
+	if n.config.PruneDepth > 0 {
+		err = bc.SetPruneDepth(n.config.PruneDepth)
+		if err != nil {
+			bc.DB.Close()
+			return err
+		}
+	}
+
+	n.bc = bc
+	n.pruneBlocks()
+
+	err = n.loadMempool()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to load the mempool: %s\n", err)
+	}
+
+	return nil
+}
+
+// openHeaderChain 打开轻节点的区块头链，并根据本地钱包准备过滤器
+func (n *Node) openHeaderChain() error {
+	wallets, err := wallet.NewWallets(n.config.NodeID)
+	if err != nil {
+		fmt.Println("No wallet found, only block headers will be synced.")
+	}
+
+	addresses := wallets.GetAddresses()
+	for _, address := range addresses {
+		wlt, err := wallets.GetWallet(address)
+		if err != nil {
+			return err
+		}
+		n.walletPubKeyHashes = append(n.walletPubKeyHashes, wallet.HashPubKey(wlt.PublicKey))
+	}
+
+	if len(addresses) > 0 && !n.config.CFilters {
+		// 公钥哈希用于匹配输出，公钥用于匹配花费这些输出的输入
+		tweak := make([]byte, 4)
+		_, err = rand.Read(tweak)
+		if err != nil {
+			return err
+		}
+
+		n.walletFilter = bloom.NewFilter(len(addresses)*2, LIGHT_FILTER_FP_RATE, binary.BigEndian.Uint32(tweak), bloom.UPDATE_ALL)
+
+		for _, address := range addresses {
+			wlt, err := wallets.GetWallet(address)
+			if err != nil {
+				return err
+			}
+			n.walletFilter.Add(wallet.HashPubKey(wlt.PublicKey))
+			n.walletFilter.Add(wlt.PublicKey)
+		}
+	}
+
+	n.hc, err = blockchain.NewHeaderChain(n.config.NodeID)
+
+	return err
+}
+
+// Start 开始监听节点的地址，并在后台连接已知的节点
+// ctx 被取消时节点自动停止
+func (n *Node) Start(ctx context.Context) error {
+	select {
+	case <-n.quit:
+		return ErrNodeStopped
+	default:
+	}
+
+	ln, err := net.Listen(PROTOCOL, n.address)
+	if err != nil {
+		return err
+	}
+	n.listener = ln
+
+	if n.bc != nil {
+		err = n.startFull()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+	}
+
+	n.serving.Add(2)
+	go n.serve()
+	go n.connectPeers()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			n.Stop()
+		case <-n.quit:
+		}
+	}()
+
+	return nil
+}
+
+func (n *Node) startFull() error {
+	base, err := n.bc.SnapshotBase()
+	if err != nil {
+		return err
+	}
+	if base != nil {
+		fmt.Printf("Started from UTXO snapshot at block %x, history will be validated after sync\n", base)
+		n.background(n.validateSnapshot)
+	}
+
+	return nil
+}
+
+// serve 接受其他节点的连接
+func (n *Node) serve() {
+	defer n.serving.Done()
+
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			select {
+			case <-n.quit:
+			default:
+				// 监听出错时停止节点，Wait 返回这个错误
+				n.err = err
+				go n.Stop()
+			}
+			return
+		}
+
+		n.acceptPeer(conn)
+	}
+}
+
+// background 在后台运行任务，节点停止时等待任务结束后再关闭数据库
+func (n *Node) background(task func()) {
+	n.handlers.Add(1)
+	go func() {
+		defer n.handlers.Done()
+		task()
+	}()
+}
+
+// Stop 停止接受连接并关闭所有连接，最多等待 SHUTDOWN_TIMEOUT 让正在处理的消息和后台任务结束，
+// 然后保存内存池，把 UTXO 缓存写入 chainstate 并关闭数据库
+// 可以多次调用，之后的调用等待第一次调用完成
+func (n *Node) Stop() error {
+	var err error
+
+	n.stopOnce.Do(func() {
+		close(n.quit)
+
+		if n.listener != nil {
+			n.listener.Close()
+		}
+		n.serving.Wait()
+
+		// 连接关闭后不会再读取新的消息，正在处理的消息会继续处理完
+		n.peers.closeAll()
+		n.waitHandlers(SHUTDOWN_TIMEOUT)
+
+		err = n.closeDB()
+		close(n.done)
+	})
+
+	<-n.done
+
+	return err
+}
+
+// waitHandlers 等待正在处理的消息和后台任务结束
+// 超时后仍然没有结束的任务在数据库关闭后会返回错误，UTXO 集在下次启动时由 RecoverUTXOSet 恢复
+func (n *Node) waitHandlers(timeout time.Duration) {
+	finished := make(chan struct{})
+	go func() {
+		n.handlers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		fmt.Println("Some handlers are still running, closing the database anyway")
+	}
+}
+
+func (n *Node) closeDB() error {
+	err := n.addrBook.save(n.config.NodeID)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to save the address book: %s\n", err)
+	}
+
+	if n.hc != nil {
+		return n.hc.DB.Close()
+	}
+
+	err = n.saveMempool()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to save the mempool: %s\n", err)
+	}
+
+	fmt.Println("Flushing UTXO cache...")
+	err = n.bc.FlushUTXOCache()
+	if err != nil {
+		n.bc.DB.Close()
+		return err
+	}
+
+	return n.bc.DB.Close()
+}
+
+// Wait 等待节点停止，节点因为监听出错或者快照验证失败而停止时返回该错误
+func (n *Node) Wait() error {
+	<-n.done
+
+	return n.err
+}
+
+// Address 返回节点监听的地址
+func (n *Node) Address() string {
+	return n.address
+}
+
+// Blockchain 返回全节点的区块链，轻节点返回 nil
+func (n *Node) Blockchain() *blockchain.Blockchain {
+	return n.bc
+}
+
+// HeaderChain 返回轻节点的区块头链，全节点返回 nil
+func (n *Node) HeaderChain() *blockchain.HeaderChain {
+	return n.hc
+}
+
+// Mempool 返回内存池中交易的副本
+func (n *Node) Mempool() []blockchain.Transaction {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var txs []blockchain.Transaction
+	for _, tx := range n.mempool {
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+// Peers 返回当前连接的节点的地址
+func (n *Node) Peers() []string {
+	return n.peers.addresses()
+}
+
+// KnownNodes 返回地址簿中的所有地址，按地址排序
+func (n *Node) KnownNodes() []string {
+	addrs := n.addrBook.addresses()
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// centralNode 返回配置中的第一个节点
+func (n *Node) centralNode() string {
+	return n.config.KnownNodes[0]
+}
+
+func (n *Node) isCentralNode() bool {
+	return n.address == n.centralNode()
+}
+
+func (n *Node) getMempoolTx(txID string) (blockchain.Transaction, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	tx, ok := n.mempool[txID]
+
+	return tx, ok
+}
+
+func (n *Node) removeMempoolTx(txID string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	delete(n.mempool, txID)
+}
+
+func (n *Node) setBlocksInTransit(hashes [][]byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.blocksInTransit = hashes
+}
+
+// nextBlockInTransit 取出下一个需要下载的区块，没有时返回 nil
+func (n *Node) nextBlockInTransit() []byte {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if len(n.blocksInTransit) == 0 {
+		return nil
+	}
+
+	hash := n.blocksInTransit[0]
+	n.blocksInTransit = n.blocksInTransit[1:]
+
+	return hash
+}
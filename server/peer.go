@@ -0,0 +1,558 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 节点保持的主动连接数量，不足时从地址簿中选择地址连接
+const TARGET_OUTBOUND = 8
+
+// 最多接受的被动连接数量，超过时新的连接会被直接关闭
+const MAX_INBOUND = 32
+
+// 检查主动连接数量的间隔
+const CONNECT_INTERVAL = time.Second
+const DIAL_TIMEOUT = 5 * time.Second
+
+// 写入一条消息的最长时间，超时说明对方已经不再读取，断开连接
+const WRITE_TIMEOUT = 30 * time.Second
+
+// 每个连接等待发送的消息数量，队列满时发送方等待
+const PEER_SEND_QUEUE = 100
+
+// 连接失败后等待 RECONNECT_BACKOFF 再重试，之后每次失败等待时间加倍，最多 MAX_RECONNECT_BACKOFF
+const RECONNECT_BACKOFF = time.Second
+const MAX_RECONNECT_BACKOFF = 5 * time.Minute
+
+type outMessage struct {
+	command string
+	payload []byte
+}
+
+// peer 与另一个节点之间的长连接，读和写分别在单独的 goroutine 中进行
+type peer struct {
+	conn    net.Conn
+	addr    string // 连接的标识：主动连接为连接的地址，被动连接为远端的 IP 和端口，不使用对方在 version 中声明的地址
+	inbound bool
+	ready   bool // 握手已经完成
+
+	// 握手的状态，只在读取消息的 goroutine 中访问
+	version        *version
+	verackReceived bool
+
+	// 地址消息的限流状态，只在读取消息的 goroutine 中访问
+	addrTokens        float64 // 对方还可以发送的地址数量
+	addrTokensUpdated time.Time
+	getAddrAnswered   bool
+
+	lock        sync.Mutex // 保护下面的统计信息和请求
+	connectedAt time.Time
+	lastRecv    time.Time
+	pingNonce   uint64 // 还没有收到 pong 的 ping，没有时为 0
+	pingSent    time.Time
+	latency     time.Duration
+	requested   map[string]struct{} // 向对方请求了还没有收到的区块
+
+	send      chan outMessage
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *peer {
+	return &peer{
+		conn:    conn,
+		addr:    addr,
+		inbound: inbound,
+		send:    make(chan outMessage, PEER_SEND_QUEUE),
+		quit:    make(chan struct{}),
+
+		connectedAt: time.Now(),
+		requested:   make(map[string]struct{}),
+		addrTokens:  1, // 允许对方宣布自己的地址
+
+	}
+}
+
+func (p *peer) handshakeComplete() bool {
+	return p.version != nil && p.verackReceived
+}
+
+func (p *peer) received(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastRecv = now
+}
+
+// pingExpired 判断是否有超过 PING_TIMEOUT 还没有收到 pong 的 ping
+func (p *peer) pingExpired(now time.Time) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.pingNonce != 0 && now.Sub(p.pingSent) > PING_TIMEOUT
+}
+
+// request 记录向对方请求的区块
+func (p *peer) request(hash []byte) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.requested[hex.EncodeToString(hash)] = struct{}{}
+}
+
+// fulfill 收到区块时检查是否请求过它，请求过时返回 true
+func (p *peer) fulfill(hash []byte) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	key := hex.EncodeToString(hash)
+	_, ok := p.requested[key]
+	delete(p.requested, key)
+
+	return ok
+}
+
+// close 关闭连接，读写的 goroutine 随之退出
+func (p *peer) close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		p.conn.Close()
+	})
+}
+
+// address 返回连接的标识，没有时返回连接的远端地址
+func (p *peer) address() string {
+	if p.addr != "" {
+		return p.addr
+	}
+
+	return p.conn.RemoteAddr().String()
+}
+
+// queue 把消息放入发送队列，连接关闭时返回 false
+func (p *peer) queue(command string, payload []byte) bool {
+	select {
+	case p.send <- outMessage{command, payload}:
+		return true
+	case <-p.quit:
+		return false
+	}
+}
+
+// 连接失败的地址在 next 之前不会再次连接
+type retry struct {
+	failures int
+	next     time.Time
+}
+
+// peerManager 管理节点的所有连接，以及主动连接失败的地址的重连时间
+type peerManager struct {
+	lock    sync.Mutex
+	peers   map[*peer]struct{}
+	retries map[string]*retry
+}
+
+func newPeerManager() *peerManager {
+	return &peerManager{
+		peers:   make(map[*peer]struct{}),
+		retries: make(map[string]*retry),
+	}
+}
+
+// add 加入新的连接，被动连接超过 MAX_INBOUND 时返回 false
+func (pm *peerManager) add(p *peer) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if p.inbound && pm.count(true) >= MAX_INBOUND {
+		return false
+	}
+
+	pm.peers[p] = struct{}{}
+
+	return true
+}
+
+func (pm *peerManager) remove(p *peer) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	delete(pm.peers, p)
+}
+
+func (pm *peerManager) count(inbound bool) int {
+	count := 0
+	for p := range pm.peers {
+		if p.inbound == inbound {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (pm *peerManager) outbound() int {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return pm.count(false)
+}
+
+// setReady 握手完成后，发给连接标识的消息才通过这个连接发送
+func (pm *peerManager) setReady(p *peer) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	p.ready = true
+}
+
+// lookup 找到与 addr 之间已经完成握手的连接，没有时返回 nil
+func (pm *peerManager) lookup(addr string) *peer {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if addr == "" {
+		return nil
+	}
+
+	for p := range pm.peers {
+		if p.ready && p.addr == addr {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// connected 判断是否已经有与 addr 之间的连接，包括还没有完成握手的连接
+func (pm *peerManager) connected(addr string) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for p := range pm.peers {
+		if p.addr == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// outboundFrom 找到本地地址为 local 的主动连接
+func (pm *peerManager) outboundFrom(local net.Addr) *peer {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for p := range pm.peers {
+		if !p.inbound && p.conn.LocalAddr().String() == local.String() {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// addresses 返回已经完成握手并且知道地址的连接
+func (pm *peerManager) addresses() []string {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for p := range pm.peers {
+		if p.ready && p.addr != "" && !seen[p.addr] {
+			seen[p.addr] = true
+			addrs = append(addrs, p.addr)
+		}
+	}
+
+	return addrs
+}
+
+// random 随机返回最多 count 个已经完成握手的连接，不包括 except
+func (pm *peerManager) random(count int, except *peer) []*peer {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	var peers []*peer
+	for p := range pm.peers {
+		if p.ready && p != except {
+			peers = append(peers, p)
+		}
+	}
+
+	for i := len(peers) - 1; i > 0; i-- {
+		j := randomInt(i + 1)
+		peers[i], peers[j] = peers[j], peers[i]
+	}
+	if len(peers) > count {
+		peers = peers[:count]
+	}
+
+	return peers
+}
+
+func (pm *peerManager) closeAll() {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for p := range pm.peers {
+		p.close()
+	}
+}
+
+// canDial 判断现在是否可以连接 addr
+func (pm *peerManager) canDial(addr string, now time.Time) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	r, ok := pm.retries[addr]
+
+	return !ok || !now.Before(r.next)
+}
+
+// failed 记录一次连接失败，返回下次重试之前等待的时间
+func (pm *peerManager) failed(addr string, now time.Time) time.Duration {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	r, ok := pm.retries[addr]
+	if !ok {
+		r = &retry{}
+		pm.retries[addr] = r
+	}
+
+	backoff := RECONNECT_BACKOFF << r.failures
+	if backoff > MAX_RECONNECT_BACKOFF || backoff <= 0 {
+		backoff = MAX_RECONNECT_BACKOFF
+	} else {
+		r.failures++
+	}
+	r.next = now.Add(backoff)
+
+	return backoff
+}
+
+// succeeded 对方回复 version 之后清除连接失败的记录
+func (pm *peerManager) succeeded(addr string) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	delete(pm.retries, addr)
+}
+
+// acceptPeer 处理新的被动连接
+func (n *Node) acceptPeer(conn net.Conn) {
+	if n.bans.isBanned(conn.RemoteAddr().String(), time.Now()) {
+		fmt.Printf("Rejected banned peer %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	// 对方声明的地址可以是任意的，被动连接只能通过远端地址识别
+	p := newPeer(conn, conn.RemoteAddr().String(), true)
+	if !n.peers.add(p) {
+		fmt.Printf("Too many inbound connections, rejected %s\n", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	n.runPeer(p)
+}
+
+// connectPeers 定期检查主动连接的数量，不足 TARGET_OUTBOUND 时连接新的节点
+func (n *Node) connectPeers() {
+	defer n.serving.Done()
+
+	ticker := time.NewTicker(CONNECT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		n.dialPeers()
+
+		select {
+		case <-n.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dialPeers 从地址簿中随机选择地址连接，直到主动连接达到 TARGET_OUTBOUND 或者没有可以连接的地址
+func (n *Node) dialPeers() {
+	for n.peers.outbound() < TARGET_OUTBOUND {
+		select {
+		case <-n.quit:
+			return
+		default:
+		}
+
+		now := time.Now()
+		addr, ok := n.addrBook.pick(func(addr string) bool {
+			return addr == n.address || n.peers.connected(addr) || !n.peers.canDial(addr, now) || n.bans.isBanned(addr, now)
+		})
+		if !ok {
+			return
+		}
+
+		n.dialPeer(addr)
+	}
+}
+
+// dialPeer 主动连接 addr，连接成功后发送 version 开始握手
+func (n *Node) dialPeer(addr string) {
+	n.addrBook.attempt(addr, time.Now())
+
+	conn, err := net.DialTimeout(PROTOCOL, addr, DIAL_TIMEOUT)
+	if err != nil {
+		backoff := n.peers.failed(addr, time.Now())
+		fmt.Printf("%s is not available, retrying in %s\n", addr, backoff)
+		return
+	}
+
+	p := newPeer(conn, addr, false)
+	n.peers.add(p)
+	n.runPeer(p)
+
+	err = n.sendVersion(p)
+	if err != nil {
+		fmt.Printf("Failed to send version to %s: %s\n", addr, err)
+		p.close()
+	}
+}
+
+// runPeer 启动连接的读写 goroutine，节点停止时等待它们结束
+func (n *Node) runPeer(p *peer) {
+	n.handlers.Add(2)
+	go n.readPeer(p)
+	go n.writePeer(p)
+}
+
+// readPeer 依次处理连接中的消息，直到连接关闭
+// 消息格式不正确时之后的数据无法再按消息读取，直接关闭连接
+func (n *Node) readPeer(p *peer) {
+	defer n.handlers.Done()
+	defer n.disconnectPeer(p)
+
+	// 握手必须在 HANDSHAKE_TIMEOUT 之内完成，之后每条消息都必须在 IDLE_TIMEOUT 之内收到
+	p.conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+
+	for {
+		if p.handshakeComplete() {
+			p.conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		}
+
+		command, payload, err := readMessage(p.conn)
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				if errors.Is(err, ErrMalformedMessage) {
+					// 格式错误之后无法找到下一条消息的开头，先记录对方的不良行为再断开连接
+					fmt.Printf("Malformed message from %s: %s\n", p.address(), err)
+					n.misbehaving(p, err)
+				} else if errors.Is(err, os.ErrDeadlineExceeded) {
+					fmt.Printf("%s timed out, disconnecting\n", p.address())
+				} else if err != io.EOF {
+					fmt.Printf("Failed to read from %s: %s\n", p.conn.RemoteAddr(), err)
+				}
+			}
+			return
+		}
+		p.received(time.Now())
+		fmt.Printf("Received %s command\n", command)
+
+		err = n.handlePeerMessage(p, command, payload)
+		if err != nil {
+			fmt.Printf("Failed to handle %s: %s\n", command, err)
+			n.misbehaving(p, err)
+		}
+	}
+}
+
+// handlePeerMessage 处理握手消息，握手完成之后才把其他消息交给全节点或者轻节点的处理函数
+func (n *Node) handlePeerMessage(p *peer, command string, payload []byte) error {
+	switch command {
+	case "version":
+		return n.handleVersion(p, payload)
+	case "verack":
+		return n.handleVerack(p)
+	}
+
+	if !p.handshakeComplete() {
+		return ErrHandshakeIncomplete
+	}
+
+	switch command {
+	case "ping":
+		return n.handlePing(p, payload)
+	case "pong":
+		return n.handlePong(p, payload)
+	case "getPeerInfo":
+		return n.handleGetPeerInfo(p)
+	case "getaddr":
+		return n.handleGetAddr(p)
+	case "addr":
+		return n.handleAddr(p, payload)
+	case "listBanned":
+		return n.handleListBanned(p)
+	case "clearBanned":
+		return n.handleClearBanned(p, payload)
+	}
+
+	if n.hc != nil {
+		return n.handleLightMessage(p, command, payload)
+	}
+
+	return n.handleMessage(p, command, payload)
+}
+
+// writePeer 发送队列中的消息
+func (n *Node) writePeer(p *peer) {
+	defer n.handlers.Done()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case msg := <-p.send:
+			p.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+
+			err := writeMessage(p.conn, msg.command, msg.payload)
+			if err != nil {
+				fmt.Printf("Failed to send %s to %s: %s\n", msg.command, p.conn.RemoteAddr(), err)
+				p.close()
+				return
+			}
+		}
+	}
+}
+
+// disconnectPeer 关闭连接，主动连接在等待一段时间后重新连接
+func (n *Node) disconnectPeer(p *peer) {
+	p.close()
+	n.peers.remove(p)
+
+	// 被动连接的标识在每次连接时都不同，过滤器随连接一起删除
+	n.peerFiltersLock.Lock()
+	delete(n.peerFilters, p.addr)
+	n.peerFiltersLock.Unlock()
+
+	select {
+	case <-n.quit:
+		return
+	default:
+	}
+
+	if !p.inbound {
+		backoff := n.peers.failed(p.addr, time.Now())
+		fmt.Printf("Disconnected from %s, reconnecting in %s\n", p.addr, backoff)
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// ErrNotLocal 只有本机的客户端可以查询节点的连接
+var ErrNotLocal = errors.New("Only local clients may request peer info")
+
+// PeerInfo 一个已经完成握手的连接的状态
+type PeerInfo struct {
+	Address     string
+	Inbound     bool
+	Version     int
+	Services    uint64
+	UserAgent   string
+	StartHeight int // 握手时对方的高度
+	ConnectedAt time.Time
+	LastRecv    time.Time
+	Latency     time.Duration // 最近一次 ping 的往返时间，还没有收到 pong 时为 0
+}
+
+// ServiceNames 返回对方提供的服务的名称
+func (info PeerInfo) ServiceNames() string {
+	return servicesString(info.Services)
+}
+
+// PeerInfo 返回所有已经完成握手的连接的状态，按地址排序
+func (n *Node) PeerInfo() []PeerInfo {
+	return n.peers.info(nil)
+}
+
+// info 返回除了 except 之外所有已经完成握手的连接的状态，按地址排序
+func (pm *peerManager) info(except *peer) []PeerInfo {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	var infos []PeerInfo
+	for p := range pm.peers {
+		if !p.ready || p == except {
+			continue
+		}
+
+		p.lock.Lock()
+		infos = append(infos, PeerInfo{
+			Address:     p.address(),
+			Inbound:     p.inbound,
+			Version:     p.version.Version,
+			Services:    p.version.Services,
+			UserAgent:   p.version.UserAgent,
+			StartHeight: p.version.BestHeight,
+			ConnectedAt: p.connectedAt,
+			LastRecv:    p.lastRecv,
+			Latency:     p.latency,
+		})
+		p.lock.Unlock()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Address < infos[j].Address
+	})
+
+	return infos
+}
+
+// checkLocal 只有本机的客户端可以查询和修改节点的状态
+func checkLocal(p *peer) error {
+	host, _, err := net.SplitHostPort(p.conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%w: %s", ErrNotLocal, host)
+	}
+
+	return nil
+}
+
+// handleGetPeerInfo 向本机的客户端（例如命令行）回复节点的连接状态，不包括客户端自己的连接
+func (n *Node) handleGetPeerInfo(p *peer) error {
+	err := checkLocal(p)
+	if err != nil {
+		return err
+	}
+
+	p.queue("peerInfo", gobEncode(n.peers.info(p)))
+
+	return nil
+}
+
+// GetPeerInfo 在没有运行节点的进程中（例如命令行）查询 addr 上的节点的连接状态
+func GetPeerInfo(addr string) ([]PeerInfo, error) {
+	reply, err := clientRequest(addr, "getPeerInfo", nil, "peerInfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []PeerInfo
+	dec := gob.NewDecoder(bytes.NewReader(reply))
+	err = dec.Decode(&infos)
+	if err != nil && len(reply) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	return infos, nil
+}
+
+// clientRequest 以客户端连接 addr 上的节点，发送一条消息并等待对方回复 reply 命令，返回回复的 payload
+func clientRequest(addr, command string, payload []byte, reply string) ([]byte, error) {
+	conn, err := dialClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	err = writeMessage(conn, command, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		received, data, err := readMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		if received == reply {
+			return data, nil
+		}
+	}
+}
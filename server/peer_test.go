@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net"
+	"tchain/blockchain"
+	"testing"
+)
+
+// testConn 替换远端地址的连接，Conn 为 nil 时不能读写
+type testConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c testConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000}
+}
+
+func (c testConn) Close() error {
+	if c.Conn == nil {
+		return nil
+	}
+
+	return c.Conn.Close()
+}
+
+func newTestPeer(remote string, addr string, inbound bool) *peer {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", remote)
+	if err != nil {
+		panic(err)
+	}
+
+	conn := testConn{remote: tcpAddr}
+	if inbound {
+		addr = conn.RemoteAddr().String()
+	}
+
+	return newPeer(conn, addr, inbound)
+}
+
+func TestInboundPeerIsKeyedByRemoteAddress(t *testing.T) {
+	pm := newPeerManager()
+	p := newTestPeer("203.0.113.7:50123", "", true)
+	pm.add(p)
+	pm.setReady(p)
+
+	if p.addr != "203.0.113.7:50123" {
+		t.Fatalf("inbound peer is keyed by %s", p.addr)
+	}
+
+	// 对方声明的地址不能让它收到发给其他节点的消息
+	if pm.lookup("localhost:3001") != nil {
+		t.Fatal("inbound peer found by an address it did not connect from")
+	}
+	if pm.lookup("203.0.113.7:50123") != p {
+		t.Fatal("inbound peer not found by its remote address")
+	}
+}
+
+func TestBanAddress(t *testing.T) {
+	cases := []struct {
+		remote  string
+		addr    string
+		inbound bool
+		want    string
+	}{
+		{"203.0.113.7:50123", "", true, "203.0.113.7"},
+		{"203.0.113.7:3000", "203.0.113.7:3000", false, "203.0.113.7"},
+		{"127.0.0.1:50123", "", true, ""},
+		{"127.0.0.1:3001", "localhost:3001", false, "localhost:3001"},
+	}
+
+	for _, c := range cases {
+		if got := banAddress(newTestPeer(c.remote, c.addr, c.inbound)); got != c.want {
+			t.Errorf("banAddress(%s, inbound %v) = %q, want %q", c.remote, c.inbound, got, c.want)
+		}
+	}
+}
+
+func TestRelayTxSkipsSender(t *testing.T) {
+	n := &Node{address: "localhost:3000", peers: newPeerManager()}
+	sender := newTestPeer("203.0.113.7:50123", "", true)
+	other := newTestPeer("203.0.113.8:3000", "203.0.113.8:3000", false)
+	for _, p := range []*peer{sender, other} {
+		n.peers.add(p)
+		n.peers.setReady(p)
+	}
+
+	n.relayTx(sender, &blockchain.Transaction{ID: []byte("transaction")})
+
+	if len(sender.send) != 0 {
+		t.Fatal("transaction was announced back to its sender")
+	}
+	if len(other.send) != 1 {
+		t.Fatalf("%d messages queued for the other peer, want 1", len(other.send))
+	}
+	if msg := <-other.send; msg.command != "inv" {
+		t.Fatalf("other peer got %s, want inv", msg.command)
+	}
+}
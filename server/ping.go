@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"time"
+)
+
+// 握手完成后每隔 PING_INTERVAL 发送一次 ping，测量与对方之间的往返时间
+const PING_INTERVAL = 30 * time.Second
+
+// 超过 PING_TIMEOUT 没有收到 pong 时断开连接
+const PING_TIMEOUT = 60 * time.Second
+
+// 握手完成后超过 IDLE_TIMEOUT 没有收到任何消息时断开连接
+const IDLE_TIMEOUT = 90 * time.Second
+
+type ping struct {
+	Nonce uint64
+}
+
+type pong struct {
+	Nonce uint64
+}
+
+// pingPeer 定期向对方发送 ping，直到连接关闭
+func (n *Node) pingPeer(p *peer) {
+	defer n.handlers.Done()
+
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		if p.pingExpired(time.Now()) {
+			fmt.Printf("%s did not answer ping in %s, disconnecting\n", p.address(), PING_TIMEOUT)
+			p.close()
+			return
+		}
+
+		err := n.sendPing(p)
+		if err != nil {
+			fmt.Printf("Failed to send ping to %s: %s\n", p.address(), err)
+		}
+
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendPing 发送新的 ping，上一个 ping 还没有收到 pong 时不发送
+func (n *Node) sendPing(p *peer) error {
+	nonce, err := randomNonce()
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	if p.pingNonce != 0 {
+		p.lock.Unlock()
+		return nil
+	}
+	p.pingNonce = nonce
+	p.pingSent = time.Now()
+	p.lock.Unlock()
+
+	p.queue("ping", gobEncode(ping{nonce}))
+
+	return nil
+}
+
+func (n *Node) handlePing(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload ping
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	p.queue("pong", gobEncode(pong{payload.Nonce}))
+
+	return nil
+}
+
+// handlePong 收到与最近的 ping 相同的 nonce 时记录往返时间，其他的 pong 被忽略
+func (n *Node) handlePong(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload pong
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pingNonce == 0 || payload.Nonce != p.pingNonce {
+		return nil
+	}
+
+	p.latency = time.Since(p.pingSent)
+	p.pingNonce = 0
+
+	return nil
+}
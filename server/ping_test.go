@@ -0,0 +1,112 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPingPong(t *testing.T) {
+	n := &Node{}
+	p := newTestPeer("203.0.113.7:50123", "", true)
+
+	err := n.sendPing(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.send) != 1 {
+		t.Fatalf("%d messages queued, want one ping", len(p.send))
+	}
+	nonce := p.pingNonce
+
+	// 上一个 ping 没有收到 pong 时不发送新的 ping
+	err = n.sendPing(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.send) != 1 || p.pingNonce != nonce {
+		t.Fatal("a second ping was sent before the pong arrived")
+	}
+
+	// nonce 不同的 pong 被忽略
+	err = n.handlePong(p, gobEncode(pong{nonce + 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.pingNonce != nonce {
+		t.Fatal("pong with another nonce answered the ping")
+	}
+
+	p.pingSent = time.Now().Add(-time.Second)
+	err = n.handlePong(p, gobEncode(pong{nonce}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.pingNonce != 0 {
+		t.Fatal("matching pong did not answer the ping")
+	}
+	if p.latency < time.Second {
+		t.Fatalf("latency %s, want at least 1s", p.latency)
+	}
+}
+
+func TestHandlePingRepliesWithNonce(t *testing.T) {
+	n := &Node{}
+	p := newTestPeer("203.0.113.7:50123", "", true)
+
+	err := n.handlePing(p, gobEncode(ping{42}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := <-p.send
+	if msg.command != "pong" {
+		t.Fatalf("replied %s, want pong", msg.command)
+	}
+	if want := gobEncode(pong{42}); string(msg.payload) != string(want) {
+		t.Fatal("pong does not carry the ping nonce")
+	}
+}
+
+func TestPingExpires(t *testing.T) {
+	p := newTestPeer("203.0.113.7:50123", "", true)
+	now := time.Now()
+
+	if p.pingExpired(now.Add(2 * PING_TIMEOUT)) {
+		t.Fatal("ping expired without an outstanding ping")
+	}
+
+	p.pingNonce = 1
+	p.pingSent = now
+	if p.pingExpired(now.Add(PING_TIMEOUT)) {
+		t.Fatal("ping expired at the timeout")
+	}
+	if !p.pingExpired(now.Add(PING_TIMEOUT + time.Second)) {
+		t.Fatal("ping did not expire after the timeout")
+	}
+}
+
+func TestUnansweredPingDisconnects(t *testing.T) {
+	n := &Node{}
+	p := newTestPeer("203.0.113.7:50123", "", true)
+	p.pingNonce = 1
+	p.pingSent = time.Now().Add(-PING_TIMEOUT - time.Second)
+
+	n.handlers.Add(1)
+	done := make(chan struct{})
+	go func() {
+		n.pingPeer(p)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("pingPeer did not return after the ping expired")
+	}
+
+	select {
+	case <-p.quit:
+	default:
+		t.Fatal("peer was not disconnected")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+)
+
+// 请求的数据不存在或已被裁剪
+type notFound struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+func (n *Node) sendNotFound(address, kind string, id []byte) {
+	payload := gobEncode(notFound{n.address, kind, id})
+	n.sendData(address, "notFound", payload)
+}
+
+func (n *Node) handleNotFound(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload notFound
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	fmt.Printf("Peer %s cannot serve %s %x\n", p.addr, payload.Type, payload.ID)
+
+	// 跳过对方无法提供的区块，继续下载剩下的
+	if payload.Type == "block" {
+		n.requestNextBlock(p.addr)
+	}
+
+	return nil
+}
+
+// requestNextBlock 继续下载下一个区块，全部下载完后连接保存下来的区块
+func (n *Node) requestNextBlock(address string) {
+	if blockHash := n.nextBlockInTransit(); blockHash != nil {
+		n.sendGetData(address, "block", blockHash)
+	} else {
+		n.connectBestChain()
+	}
+}
+
+// connectBestChain 把同步时乱序收到的区块和更长的分支按顺序验证并连接到链上，并按配置裁剪旧区块
+// 发生链重组时先撤销旧分支上的区块，新分支上的区块无效时恢复原来的链
+func (n *Node) connectBestChain() {
+	err := n.bc.ConnectBestChain()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to connect the best chain: %s\n", err)
+		return
+	}
+
+	// 从快照启动的节点在后台使用下载的历史区块验证快照
+	base, err := n.bc.SnapshotBase()
+	if err != nil {
+		fmt.Printf("ERROR: %s\n", err)
+	} else if base != nil {
+		n.background(n.validateSnapshot)
+	}
+
+	n.pruneBlocks()
+}
+
+// pruneBlocks 按配置裁剪旧区块
+func (n *Node) pruneBlocks() {
+	pruned, err := n.bc.Prune()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to prune blocks: %s\n", err)
+		return
+	}
+
+	if pruned > 0 {
+		pruneHeight, err := n.bc.PruneHeight()
+		if err != nil {
+			fmt.Printf("ERROR: %s\n", err)
+			return
+		}
+
+		fmt.Printf("Pruned %d blocks, keeping blocks from height %d\n", pruned, pruneHeight)
+	}
+}
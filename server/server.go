@@ -2,34 +2,36 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"tchain/blockchain"
+	"tchain/merkle"
 )
 
 const PROTOCOL = "tcp"
-const NODE_VERSION = 1
-const COMMAND_LENGTH = 12
+const NODE_VERSION = 2
 
-var nodeAddress string
-var miningAddress string
-var KnownNodes = []string{"localhost:3000"}
-var blocksInTransit = [][]byte{}
-var mempool = make(map[string]blockchain.Transaction)
+// 单个 headers 消息中最多包含的区块头数量
+const MAX_HEADERS = 2000
 
-type addr struct {
-	AddrList []string
-}
+// ErrMalformedMessage 收到的消息无法解码，或者缺少必要的内容
+var ErrMalformedMessage = errors.New("Malformed message")
 
 type version struct {
-	Version    int
-	BestHeight int    // 区块链中节点的高
-	AddrFrom   string // 发送者的地址
+	Version     int
+	Services    uint64 // 节点提供的服务，SERVICE_* 的组合
+	UserAgent   string
+	Nonce       uint64 // 节点启动时随机生成，收到与自己相同的 Nonce 说明连接到了自己
+	BestHeight  int    // 区块链中节点的高
+	AddrFrom    string // 发送者的地址
+	PruneHeight int    // 节点保存了完整区块的最低高度，未裁剪时为 0
 }
 
 type block struct {
@@ -52,33 +54,36 @@ type getData struct {
 	ID       []byte
 }
 
-// 向其他节点展示当前节点的块和交易
-type inv struct {
+// 轻节点请求 Locator 之后的区块头
+type getHeaders struct {
 	AddrFrom string
-	Type     string
-	Items    [][]byte
+	Locator  []byte // 请求方最后一个区块头的哈希
 }
 
-func commandToBytes(command string) []byte {
-	var bytes [COMMAND_LENGTH]byte
-
-	for i, c := range command {
-		bytes[i] = byte(c)
-	}
-
-	return bytes[:]
+type headers struct {
+	AddrFrom string
+	Headers  [][]byte
 }
 
-func bytesToCommand(bytes []byte) string {
-	var command []byte
+// 轻节点请求区块中与其布隆过滤器匹配的交易
+type getMerkleBlock struct {
+	AddrFrom  string
+	BlockHash []byte
+}
 
-	for _, b := range bytes {
-		if b != 0x0 {
-			command = append(command, b)
-		}
-	}
+// 区块头、匹配的交易以及证明这些交易被打包的部分 Merkle 树
+type merkleBlock struct {
+	AddrFrom     string
+	Header       []byte
+	Tree         []byte
+	Transactions [][]byte
+}
 
-	return fmt.Sprintf("%s", command)
+// 向其他节点展示当前节点的块和交易
+type inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
 }
 
 func gobEncode(data interface{}) []byte {
@@ -93,385 +98,511 @@ func gobEncode(data interface{}) []byte {
 	return buff.Bytes()
 }
 
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial(PROTOCOL, addr)
-	if err != nil {
-		fmt.Printf("%s is not available\n", addr)
-		var updatedNodes []string
-
-		for _, node := range KnownNodes {
-			if node != addr {
-				updatedNodes = append(updatedNodes, node)
-			}
-		}
-
-		KnownNodes = updatedNodes
-
-		return
-	}
-	defer conn.Close()
-
-	_, err = io.Copy(conn, bytes.NewReader(data))
-	if err != nil {
-		log.Panic(err)
+// sendData 通过与 addr 之间的连接发送一条消息，没有连接时丢弃这条消息
+func (n *Node) sendData(addr, command string, payload []byte) {
+	p := n.peers.lookup(addr)
+	if p == nil || !p.queue(command, payload) {
+		fmt.Printf("Not connected to %s, dropped %s\n", addr, command)
 	}
 }
 
-func sendBlock(addr string, b *blockchain.Block) {
-	data := block{nodeAddress, b.Serialize()}
+func (n *Node) sendBlock(addr string, b *blockchain.Block) {
+	data := block{n.address, b.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
-
-	sendData(addr, request)
+	n.sendData(addr, "block", payload)
 }
 
-func sendGetData(address, kind string, id []byte) {
-	payload := gobEncode(getData{nodeAddress, kind, id})
-	request := append(commandToBytes("getData"), payload...)
+func (n *Node) sendGetData(address, kind string, id []byte) {
+	if p := n.peers.lookup(address); p != nil && kind == "block" {
+		p.request(id)
+	}
 
-	sendData(address, request)
+	payload := gobEncode(getData{n.address, kind, id})
+	n.sendData(address, "getData", payload)
 }
 
-func sendInv(address, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
+func (n *Node) sendInv(address, kind string, items [][]byte) {
+	inventory := inv{n.address, kind, items}
 	payload := gobEncode(inventory)
-	request := append(commandToBytes("inv"), payload...)
-
-	sendData(address, request)
+	n.sendData(address, "inv", payload)
 }
 
-func SendTx(addr string, tnx *blockchain.Transaction) {
-	data := tx{nodeAddress, tnx.Serialize()}
+func (n *Node) sendTx(addr string, tnx *blockchain.Transaction) {
+	data := tx{n.address, tnx.Serialize()}
 	payload := gobEncode(data)
-	request := append(commandToBytes("tx"), payload...)
-
-	sendData(addr, request)
+	n.sendData(addr, "tx", payload)
 }
 
-func sendGetBlocks(address string) {
-	payload := gobEncode(getBlocks{nodeAddress})
-	request := append(commandToBytes("getBlocks"), payload...)
+// SendTx 在没有运行节点的进程中（例如命令行）把交易发送给 addr
+func SendTx(addr string, tnx *blockchain.Transaction) error {
+	conn, err := dialClient(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	sendData(address, request)
+	return writeMessage(conn, "tx", gobEncode(tx{"", tnx.Serialize()}))
 }
 
-func requestBlocks() {
-	for _, node := range KnownNodes {
-		sendGetBlocks(node)
+func (n *Node) sendHeaders(addr string, blockHeaders []*blockchain.BlockHeader) {
+	var items [][]byte
+
+	for _, header := range blockHeaders {
+		items = append(items, header.Serialize())
 	}
+
+	payload := gobEncode(headers{n.address, items})
+	n.sendData(addr, "headers", payload)
 }
 
-func nodeIsKnown(addr string) bool {
-	for _, node := range KnownNodes {
-		if node == addr {
-			return true
-		}
+func (n *Node) sendMerkleBlock(addr string, header *blockchain.BlockHeader, tree *merkle.PartialMerkleTree, txs []*blockchain.Transaction) {
+	var items [][]byte
+
+	for _, tx := range txs {
+		items = append(items, tx.Serialize())
 	}
 
-	return false
+	payload := gobEncode(merkleBlock{n.address, header.Serialize(), tree.Serialize(), items})
+	n.sendData(addr, "merkleBlock", payload)
 }
 
-func handleVersion(request []byte, bc *blockchain.Blockchain) {
-	var buff bytes.Buffer
-	var payload version
+func (n *Node) sendGetBlocks(address string) {
+	payload := gobEncode(getBlocks{n.address})
+	n.sendData(address, "getBlocks", payload)
+}
 
-	buff.Write(request[COMMAND_LENGTH:])
-	dec := gob.NewDecoder(&buff)
-	err := dec.Decode(&payload)
-	if err != nil {
-		log.Panic(err)
+// startSync 握手完成后比较双方的高度，对方的区块链更长时请求区块
+func (n *Node) startSync(p *peer) error {
+	v := p.version
+
+	// 轻节点不能提供区块
+	if v.Services&(SERVICE_FULL|SERVICE_PRUNED) == 0 {
+		return nil
 	}
 
-	myBestHeight := bc.GetBestHeight()
-	foreignerBestHeight := payload.BestHeight
+	myBestHeight, err := n.bc.GetBestHeight()
+	if err != nil {
+		return err
+	}
 
-	// BestHeight 与自身进行比较
-	if myBestHeight < foreignerBestHeight {
+	if myBestHeight < v.BestHeight {
+		// 对方已经裁剪了我们缺少的区块，无法从它那里同步
+		if v.PruneHeight > myBestHeight+1 {
+			fmt.Printf("Peer %s is pruned below height %d, cannot sync from it\n", p.addr, v.PruneHeight)
+		} else {
+			n.sendGetBlocks(p.addr)
+		}
 
-		// 消息中的区块链更长发送 getBlocks 消息
-		sendGetBlocks(payload.AddrFrom)
-	} else if myBestHeight > foreignerBestHeight {
-		// 自身节点的区块链更长
-		// 回复 version 消息
-		sendVersion(payload.AddrFrom, bc)
+		return nil
 	}
 
-	// sendAddr(payload.AddrFrom)
-	if !nodeIsKnown(payload.AddrFrom) {
-		KnownNodes = append(KnownNodes, payload.AddrFrom)
+	// 从快照启动的节点缺少快照之前的区块，对方没有更长的链时也从保存了完整历史的节点下载，下载完后验证快照
+	base, err := n.bc.SnapshotBase()
+	if err != nil {
+		return err
+	}
+	if base != nil && v.Services&SERVICE_FULL != 0 && v.PruneHeight == 0 {
+		n.sendGetBlocks(p.addr)
 	}
+
+	return nil
 }
 
 // 当接收到一个新块时，我们把它放到区块链里面。
-func handleBlock(request []byte, bc *blockchain.Blockchain) {
+func (n *Node) handleBlock(p *peer, data []byte) error {
 	var buff bytes.Buffer
 	var payload block
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
 	blockData := payload.Block
-	block := blockchain.DeserializeBlock(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if !p.fulfill(block.Hash) {
+		return fmt.Errorf("%w: block %x was not requested", ErrUnsolicited, block.Hash)
+	}
 
 	fmt.Println("Received a new block!")
-	bc.AddBlock(block)
+
+	// 连接在 tip 上的区块经过验证后与 UTXO 集一起写入，
+	// 同步时先收到的较新区块和其他分支上的区块只保存下来，全部下载完后再由 connectBestChain 验证并连接
+	if bytes.Equal(block.PrevBlockHash, n.bc.Tip()) {
+		err = n.bc.ConnectBlock(block)
+		if err != nil {
+			n.requestNextBlock(p.addr)
+			return fmt.Errorf("Rejected block %x: %w", block.Hash, err)
+		}
+	} else {
+		err = n.bc.AddBlock(block)
+		if err != nil {
+			return err
+		}
+	}
 
 	fmt.Printf("Added block %x\n", block.Hash)
 
 	// 如果还有更多的区块需要下载，继续从上一个下载的块的那个节点继续请求
-	if len(blocksInTransit) > 0 {
-		blockHash := blocksInTransit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	// 当最后把所有块都下载完后，更新 UTXO 集
+	n.requestNextBlock(p.addr)
 
-		blocksInTransit = blocksInTransit[1:]
+	return nil
+}
 
-		// 当最后把所有块都下载完后，对 UTXO 集进行重新索引
-	} else {
-		UTXOSet := blockchain.UTXOSet{bc}
-		UTXOSet.Reindex()
+// relayTx 向除 from 以外的节点宣布交易，加载了布隆过滤器的轻节点只接收匹配的交易
+// from 按连接的标识比较，而不是对方在消息中声明的 AddFrom，否则交易会被发回给发送它的节点
+func (n *Node) relayTx(from *peer, tx *blockchain.Transaction) {
+	for _, node := range n.Peers() {
+		if node != n.address && node != from.addr && n.relayToPeer(node, tx) {
+			n.sendInv(node, "tx", [][]byte{tx.ID})
+		}
 	}
 }
 
-func handleTx(request []byte, bc *blockchain.Blockchain) {
+// handleTx 处理 p 发来的交易，接受后转发给除 p 以外的节点
+func (n *Node) handleTx(p *peer, data []byte) error {
 	var buff bytes.Buffer
 	var payload tx
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	mempool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DeserializeTransaction(txData)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	// coinbase 交易只能出现在区块中
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase %x outside a block", blockchain.ErrInvalidTransaction, tx.ID)
+	}
+	// 签名无效、花费不存在的输出或者与内存池冲突的交易不会进入内存池
+	mempoolSize, err := n.acceptTx(tx)
+	if err != nil {
+		return fmt.Errorf("Rejected transaction %x: %w", tx.ID, err)
+	}
 
 	// 将新交易放到内存池
-	if nodeAddress == KnownNodes[0] {
-		for _, node := range KnownNodes {
-			// 检查当前节点是否是中心节点
-			// 在这里中心节点并不会挖矿
-			// 它只会将新的交易推送给网络中的其他节点
-			if node != nodeAddress && node != payload.AddFrom {
-				sendInv(node, "tx", [][]byte{tx.ID})
-			}
-		}
+	if n.isCentralNode() {
+		// 检查当前节点是否是中心节点
+		// 在这里中心节点并不会挖矿
+		// 它只会将新的交易推送给网络中的其他节点
+		n.relayTx(p, &tx)
 	} else {
-		// miningAddress 只会在矿工节点上设置
+		// n.config.MinerAddress 只会在矿工节点上设置
 		// 如果当前节点（矿工）的内存池中有两笔或更多的交易，开始挖矿：
-		if len(mempool) >= 2 && len(miningAddress) > 0 {
+		if mempoolSize >= 2 && len(n.config.MinerAddress) > 0 {
 		MineTransactions:
-			var txs []*blockchain.Transaction
-
-			// 内存池中所有交易都是通过验证的
-			// 无效的交易会被忽略
-			for id := range mempool {
-				tx := mempool[id]
-				// 验证后的交易被放到一个块里
-				if bc.VerifyTransaction(&tx) {
-					txs = append(txs, &tx)
-				}
-			}
+			// 验证后的交易被放到一个块里
+			// 已经无效或者相互冲突的交易会从内存池中删除
+			txs := n.blockTemplate()
 
 			// 如果没有有效交易，则挖矿中断
 			if len(txs) == 0 {
 				fmt.Println("All transactions are invalid! Waiting for new ones...")
-				return
+				return nil
 			}
 
 			// 同时还有附带奖励的 coinbase 交易
-			cbTx := blockchain.NewCoinbaseTX(miningAddress, "")
+			cbTx := blockchain.NewCoinbaseTX(n.config.MinerAddress, "")
 			txs = append(txs, cbTx)
 
-			newBlock := bc.MineBlock(txs)
-			UTXOSet := blockchain.UTXOSet{bc}
-			// 当块被挖出来以后，UTXO 集会被重新索引
-			UTXOSet.Reindex()
+			// 挖出的区块和 UTXO 集的修改在同一个事务中写入
+			// 挖矿失败是本节点的问题，与发送交易的节点无关，只记录下来，不能作为处理消息的错误计入对方的不良行为分数
+			newBlock, err := n.bc.MineBlock(txs)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to mine a block: %s\n", err)
+				return nil
+			}
+			n.pruneBlocks()
 
 			fmt.Println("New block is mined!")
 
 			// 当一笔交易被挖出来以后就会被从内存池中移除
 			for _, tx := range txs {
 				txID := hex.EncodeToString(tx.ID)
-				delete(mempool, txID)
+				n.removeMempoolTx(txID)
 			}
 
 			// 当前节点所连接到的所有其他节点，接收带有新块哈希的 inv 消息
-			for _, node := range KnownNodes {
-				if node != nodeAddress {
+			for _, node := range n.Peers() {
+				if node != n.address {
 					// 在处理完消息后，它们可以对块进行请求。
-					sendInv(node, "block", [][]byte{newBlock.Hash})
+					n.sendInv(node, "block", [][]byte{newBlock.Hash})
 				}
 			}
 
-			if len(mempool) > 0 {
+			if len(n.Mempool()) > 0 {
 				goto MineTransactions
 			}
 		}
 	}
+
+	return nil
 }
 
-func handleGetBlocks(request []byte, bc *blockchain.Blockchain) {
+func (n *Node) handleGetBlocks(p *peer, data []byte) error {
 	var buff bytes.Buffer
 	var payload getBlocks
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
-	blocks := bc.GetBlockHashes()
-	sendInv(payload.AddrFrom, "block", blocks)
+	blocks, err := n.bc.GetBlockHashes()
+	if err != nil {
+		return err
+	}
+
+	n.sendInv(p.addr, "block", blocks)
+
+	return nil
 }
 
-func handleInv(request []byte, bc *blockchain.Blockchain) {
+func (n *Node) handleInv(p *peer, data []byte) error {
 	var buff bytes.Buffer
 	var payload inv
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if len(payload.Items) == 0 {
+		return fmt.Errorf("%w: inventory from %s is empty", ErrMalformedMessage, p.addr)
 	}
 
 	fmt.Printf("Received inventory with %d %s\n", len(payload.Items), payload.Type)
 
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
-
 		blockHash := payload.Items[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
+		n.sendGetData(p.addr, "block", blockHash)
 
 		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
+		for _, b := range payload.Items {
 			if bytes.Compare(b, blockHash) != 0 {
 				newInTransit = append(newInTransit, b)
 			}
 		}
-		blocksInTransit = newInTransit
+		n.setBlocksInTransit(newInTransit)
 	}
 
 	if payload.Type == "tx" {
 		txID := payload.Items[0]
 
-		if mempool[hex.EncodeToString(txID)].ID == nil {
-			sendGetData(payload.AddrFrom, "tx", txID)
+		if _, ok := n.getMempoolTx(hex.EncodeToString(txID)); !ok {
+			n.sendGetData(p.addr, "tx", txID)
 		}
 	}
+
+	return nil
 }
 
-func handleGetData(request []byte, bc *blockchain.Blockchain) {
+func (n *Node) handleGetHeaders(p *peer, data []byte) error {
 	var buff bytes.Buffer
-	var payload getData
+	var payload getHeaders
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
-	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
-		if err != nil {
-			return
-		}
-
-		sendBlock(payload.AddrFrom, &block)
+	blockHeaders, err := n.bc.GetHeadersAfter(payload.Locator, MAX_HEADERS)
+	if err != nil {
+		return err
+	}
+	if len(blockHeaders) == 0 {
+		return nil
 	}
 
-	if payload.Type == "tx" {
-		txID := hex.EncodeToString(payload.ID)
-		tx := mempool[txID]
+	n.sendHeaders(p.addr, blockHeaders)
 
-		SendTx(payload.AddrFrom, &tx)
-	}
+	return nil
 }
 
-func handleAddr(request []byte) {
+func (n *Node) handleGetMerkleBlock(p *peer, data []byte) error {
 	var buff bytes.Buffer
-	var payload addr
+	var payload getMerkleBlock
 
-	buff.Write(request[COMMAND_LENGTH:])
+	buff.Write(data)
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
 	}
 
-	KnownNodes = append(KnownNodes, payload.AddrList...)
-	fmt.Printf("There are %d known nodes now!\n", len(KnownNodes))
-	requestBlocks()
+	block, err := n.bc.GetBlock(payload.BlockHash)
+	if errors.Is(err, blockchain.ErrBlockPruned) {
+		n.sendNotFound(p.addr, "merkleBlock", payload.BlockHash)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// 只返回与轻节点的布隆过滤器匹配的交易，而不是完整的区块
+	tree, txs, ok := n.filterBlock(p.addr, &block)
+	if !ok {
+		fmt.Printf("%s requested a merkle block without loading a filter\n", p.addr)
+		return nil
+	}
+
+	n.sendMerkleBlock(p.addr, block.Header(), tree, txs)
+
+	return nil
 }
 
-func handleConnection(conn net.Conn, bc *blockchain.Blockchain) {
-	request, err := ioutil.ReadAll(conn)
+func (n *Node) handleGetData(p *peer, data []byte) error {
+	var buff bytes.Buffer
+	var payload getData
+
+	buff.Write(data)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+
+	if payload.Type == "block" {
+		block, err := n.bc.GetBlock([]byte(payload.ID))
+		if errors.Is(err, blockchain.ErrBlockPruned) {
+			n.sendNotFound(p.addr, payload.Type, payload.ID)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		n.sendBlock(p.addr, &block)
 	}
-	command := bytesToCommand(request[:COMMAND_LENGTH])
-	fmt.Printf("Received %s command\n", command)
+
+	if payload.Type == "tx" {
+		txID := hex.EncodeToString(payload.ID)
+		tx, ok := n.getMempoolTx(txID)
+		if !ok {
+			return nil
+		}
+
+		n.sendTx(p.addr, &tx)
+	}
+
+	return nil
+}
+
+// handleMessage 把全节点收到的消息交给对应的处理函数
+func (n *Node) handleMessage(p *peer, command string, payload []byte) error {
+	var err error
 
 	switch command {
-	case "addr":
-		handleAddr(request)
 	case "block":
-		handleBlock(request, bc)
+		err = n.handleBlock(p, payload)
 	case "inv":
-		handleInv(request, bc)
+		err = n.handleInv(p, payload)
 	case "getBlocks":
-		handleGetBlocks(request, bc)
+		err = n.handleGetBlocks(p, payload)
+	case "notFound":
+		err = n.handleNotFound(p, payload)
 	case "getData":
-		handleGetData(request, bc)
+		err = n.handleGetData(p, payload)
+	case "getHeaders":
+		err = n.handleGetHeaders(p, payload)
+	case "getMerkleBlock":
+		err = n.handleGetMerkleBlock(p, payload)
+	case "getCFilters":
+		err = n.handleGetCFilters(p, payload)
+	case "filterLoad":
+		err = n.handleFilterLoad(p, payload)
+	case "filterAdd":
+		err = n.handleFilterAdd(p, payload)
+	case "filterClear":
+		err = n.handleFilterClear(p, payload)
 	case "tx":
-		handleTx(request, bc)
-	case "version":
-		handleVersion(request, bc)
+		err = n.handleTx(p, payload)
 	default:
 		fmt.Println("Unknown command!")
 	}
 
-	conn.Close()
+	return err
 }
 
-// StartServer starts a node
-func StartServer(nodeID, minerAddress string) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
-	miningAddress = minerAddress
-	ln, err := net.Listen(PROTOCOL, nodeAddress)
+// ErrForcedExit 停止节点期间再次收到了中断信号，StartServer 不再等待节点停止，由调用者决定是否直接退出进程
+var ErrForcedExit = errors.New("Interrupted again while shutting down")
+
+// StartServer 根据配置启动节点并一直运行，直到进程被中断或者节点因为错误停止
+// 停止期间再次收到中断信号时立即返回 ErrForcedExit
+func StartServer(config Config) error {
+	node, err := NewNode(config)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
-	defer ln.Close()
-
-	bc := blockchain.NewBlockchain(nodeID)
 
-	if nodeAddress != KnownNodes[0] {
-		sendVersion(KnownNodes[0], bc)
+	err = node.Start(context.Background())
+	if err != nil {
+		node.Stop()
+		return err
 	}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Panic(err)
-		}
-		go handleConnection(conn, bc)
+	forced := stopOnSignal(node)
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- node.Wait()
+	}()
+
+	select {
+	case err = <-stopped:
+		return err
+	case <-forced:
+		return ErrForcedExit
 	}
 }
 
-func sendVersion(addr string, bc *blockchain.Blockchain) {
-	bestHeight := bc.GetBestHeight()
-	payload := gobEncode(version{NODE_VERSION, bestHeight, nodeAddress})
+// stopOnSignal 在收到 SIGINT 或 SIGTERM 时通过 Node.Stop 停止节点，
+// 返回的 channel 在停止期间再次收到信号时关闭
+func stopOnSignal(node *Node) <-chan struct{} {
+	forced := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("Received %s, shutting down...\n", sig)
+
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-signals:
+				close(forced)
+			case <-done:
+			}
+		}()
 
-	request := append(commandToBytes("version"), payload...)
+		err := node.Stop()
+		if err != nil {
+			fmt.Printf("Failed to stop the node: %s\n", err)
+		}
+		signal.Stop(signals)
+		close(done)
+	}()
 
-	sendData(addr, request)
+	return forced
 }
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"tchain/blockchain"
+)
+
+// validateSnapshot 在后台验证节点启动时加载的 UTXO 快照
+// 快照与历史区块不一致时 chainstate 已经被标记为无效，节点不能继续用它挖矿、验证交易或者提供数据，所以停止节点
+func (n *Node) validateSnapshot() {
+	if !n.snapshotValidationLock.TryLock() {
+		return
+	}
+	defer n.snapshotValidationLock.Unlock()
+
+	validated, err := n.bc.ValidateSnapshot()
+	if errors.Is(err, blockchain.ErrSnapshotInvalid) {
+		// 加载了错误的快照，需要重新加载正确的快照或者从头同步
+		fmt.Printf("ERROR: UTXO snapshot is invalid, stopping the node: %s\n", err)
+		n.err = err
+		go n.Stop()
+		return
+	}
+	if err != nil {
+		fmt.Printf("ERROR: Failed to validate the UTXO snapshot: %s\n", err)
+		return
+	}
+
+	if validated {
+		fmt.Println("UTXO snapshot is validated against the block history")
+	}
+}
@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"bytes"
+
+	"go.etcd.io/bbolt"
+)
+
+// boltDB 基于 bbolt 的实现，数据保存在单个文件中
+type boltDB struct {
+	db *bbolt.DB
+}
+
+// OpenBolt 打开 path 处的 bbolt 数据库，文件不存在时创建
+func OpenBolt(path string) (DB, error) {
+	db, err := bbolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltDB{db}, nil
+}
+
+func (d *boltDB) View(fn func(tx Tx) error) error {
+	return convertError(d.db.View(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	}))
+}
+
+func (d *boltDB) Update(fn func(tx Tx) error) error {
+	return convertError(d.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	}))
+}
+
+func (d *boltDB) Close() error {
+	return d.db.Close()
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t boltTx) Bucket(name []byte) Bucket {
+	b := t.tx.Bucket(name)
+	// 直接返回 nil 指针会得到一个不等于 nil 的接口
+	if b == nil {
+		return nil
+	}
+
+	return boltBucket{b}
+}
+
+func (t boltTx) CreateBucket(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucket(name)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	b, err := t.tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return boltBucket{b}, nil
+}
+
+func (t boltTx) DeleteBucket(name []byte) error {
+	return convertError(t.tx.DeleteBucket(name))
+}
+
+type boltBucket struct {
+	b *bbolt.Bucket
+}
+
+func (b boltBucket) Get(key []byte) []byte {
+	return b.b.Get(key)
+}
+
+func (b boltBucket) Put(key []byte, value []byte) error {
+	return convertError(b.b.Put(key, value))
+}
+
+func (b boltBucket) Delete(key []byte) error {
+	return convertError(b.b.Delete(key))
+}
+
+func (b boltBucket) Cursor() Cursor {
+	return &boltCursor{c: b.b.Cursor()}
+}
+
+// boltCursor bbolt 的游标在遍历过程中修改 bucket 后可能失效，
+// 这里记录当前的 key，每次移动时按 key 重新定位，保证遍历时修改 bucket 的行为与其他实现一致
+type boltCursor struct {
+	c   *bbolt.Cursor
+	key []byte
+}
+
+func (c *boltCursor) First() ([]byte, []byte) {
+	return c.moveTo(c.c.First())
+}
+
+func (c *boltCursor) Last() ([]byte, []byte) {
+	return c.moveTo(c.c.Last())
+}
+
+func (c *boltCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.moveTo(c.c.Seek(seek))
+}
+
+func (c *boltCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+
+	k, v := c.c.Seek(c.key)
+	if k != nil && bytes.Equal(k, c.key) {
+		k, v = c.c.Next()
+	}
+
+	return c.moveTo(k, v)
+}
+
+func (c *boltCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+
+	// Seek 停在第一个大于等于当前 key 的位置，它的前一个就是小于当前 key 的最后一个
+	k, _ := c.c.Seek(c.key)
+	if k == nil {
+		return c.moveTo(c.c.Last())
+	}
+
+	return c.moveTo(c.c.Prev())
+}
+
+func (c *boltCursor) moveTo(k, v []byte) ([]byte, []byte) {
+	c.key = append([]byte{}, k...)
+	if k == nil {
+		c.key = nil
+	}
+
+	return k, v
+}
+
+// convertError 把 bbolt 的错误转换为 storage 包中对应的错误
+func convertError(err error) error {
+	switch err {
+	case bbolt.ErrDatabaseNotOpen:
+		return ErrDatabaseClosed
+	case bbolt.ErrTxNotWritable:
+		return ErrTxNotWritable
+	case bbolt.ErrBucketNotFound:
+		return ErrBucketNotFound
+	case bbolt.ErrBucketExists:
+		return ErrBucketExists
+	case bbolt.ErrBucketNameRequired:
+		return ErrBucketNameEmpty
+	case bbolt.ErrKeyRequired:
+		return ErrKeyRequired
+	}
+
+	return err
+}
@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 每条记录以 4 字节的 magic 和 4 字节的长度开头，重建索引时依靠 magic 在文件中找到记录
+var FLAT_FILE_MAGIC = []byte{0x74, 0x63, 0x68, 0x6e}
+
+const RECORD_HEADER_SIZE = 8
+
+// ErrRecordNotFound 位置处没有有效的记录，例如文件已被删除或者位置损坏
+var ErrRecordNotFound = errors.New("record not found")
+
+// Location 记录在数据文件中的位置，Offset 指向记录头之后的数据
+type Location struct {
+	File   int
+	Offset int
+	Length int
+}
+
+// Serialize 把位置编码为 12 字节
+func (l Location) Serialize() []byte {
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:4], uint32(l.File))
+	binary.BigEndian.PutUint32(data[4:8], uint32(l.Offset))
+	binary.BigEndian.PutUint32(data[8:12], uint32(l.Length))
+
+	return data
+}
+
+// DeserializeLocation 解码位置
+func DeserializeLocation(data []byte) (Location, error) {
+	if len(data) != 12 {
+		return Location{}, fmt.Errorf("invalid location length %d", len(data))
+	}
+
+	return Location{
+		File:   int(binary.BigEndian.Uint32(data[0:4])),
+		Offset: int(binary.BigEndian.Uint32(data[4:8])),
+		Length: int(binary.BigEndian.Uint32(data[8:12])),
+	}, nil
+}
+
+// FlatFiles 只追加写入的数据文件，当前文件超过大小上限后切换到下一个编号的文件
+// 文件中的记录不会被修改，只能按文件整体删除
+type FlatFiles interface {
+	// Append 在当前文件末尾写入一条记录，返回之前数据已经写入存储
+	Append(data []byte) (Location, error)
+	Read(loc Location) ([]byte, error)
+	// Files 按编号从小到大返回现有的文件
+	Files() ([]int, error)
+	// Scan 按顺序遍历文件中的所有记录，跳过写入时中断而损坏的部分
+	Scan(file int, fn func(loc Location, data []byte) error) error
+	Remove(file int) error
+}
+
+func encodeRecord(data []byte) []byte {
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(data))
+	copy(record, FLAT_FILE_MAGIC)
+	binary.BigEndian.PutUint32(record[4:RECORD_HEADER_SIZE], uint32(len(data)))
+
+	return append(record, data...)
+}
+
+// checkRecord 检查 loc 之前的记录头是否与 loc 一致
+func checkRecord(header []byte, loc Location) error {
+	if !bytes.Equal(header[:4], FLAT_FILE_MAGIC) || int(binary.BigEndian.Uint32(header[4:RECORD_HEADER_SIZE])) != loc.Length {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// scanRecords 遍历文件内容中的记录，遇到无效的数据时向后查找下一个 magic
+func scanRecords(file int, content []byte, fn func(loc Location, data []byte) error) error {
+	offset := 0
+
+	for offset+RECORD_HEADER_SIZE <= len(content) {
+		header := content[offset : offset+RECORD_HEADER_SIZE]
+		length := int(binary.BigEndian.Uint32(header[4:]))
+		start := offset + RECORD_HEADER_SIZE
+
+		if !bytes.Equal(header[:4], FLAT_FILE_MAGIC) || start+length > len(content) {
+			next := bytes.Index(content[offset+1:], FLAT_FILE_MAGIC)
+			if next < 0 {
+				break
+			}
+			offset += next + 1
+			continue
+		}
+
+		err := fn(Location{File: file, Offset: start, Length: length}, content[start:start+length])
+		if err != nil {
+			return err
+		}
+		offset = start + length
+	}
+
+	return nil
+}
+
+// diskFlatFiles 保存在目录中的数据文件，文件名为 prefix 加上 5 位编号，例如 blk00000.dat
+type diskFlatFiles struct {
+	dir         string
+	prefix      string
+	maxFileSize int
+	current     int
+	lock        sync.Mutex
+}
+
+// OpenFlatFiles 打开 dir 中的数据文件，目录不存在时创建
+func OpenFlatFiles(dir, prefix string, maxFileSize int) (FlatFiles, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &diskFlatFiles{dir: dir, prefix: prefix, maxFileSize: maxFileSize}
+
+	files, err := f.Files()
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		f.current = files[len(files)-1]
+
+		err = f.truncatePartialRecord()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// truncatePartialRecord 截掉当前文件中最后一条完整记录之后的数据
+// 写入中断会在文件末尾留下不完整的记录，它的记录头中的长度会把之后追加的记录当作自己的一部分，扫描时这些记录就会丢失。
+// 不完整的记录在写入完成之前不会进入索引，所以可以直接删除
+func (f *diskFlatFiles) truncatePartialRecord() error {
+	content, err := os.ReadFile(f.path(f.current))
+	if err != nil {
+		return err
+	}
+
+	end := 0
+	err = scanRecords(f.current, content, func(loc Location, data []byte) error {
+		end = loc.Offset + loc.Length
+
+		return nil
+	})
+	if err != nil || end == len(content) {
+		return err
+	}
+
+	return os.Truncate(f.path(f.current), int64(end))
+}
+
+func (f *diskFlatFiles) path(file int) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%s%05d.dat", f.prefix, file))
+}
+
+func (f *diskFlatFiles) Append(data []byte) (Location, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	record := encodeRecord(data)
+
+	for {
+		file, err := os.OpenFile(f.path(f.current), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return Location{}, err
+		}
+
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return Location{}, err
+		}
+
+		// 当前文件写不下时切换到下一个文件，空文件总是可以写入
+		size := int(info.Size())
+		if size > 0 && size+len(record) > f.maxFileSize {
+			file.Close()
+			f.current++
+			continue
+		}
+
+		_, err = file.Write(record)
+		if err == nil {
+			err = file.Sync()
+		}
+		closeErr := file.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return Location{}, err
+		}
+
+		return Location{File: f.current, Offset: size + RECORD_HEADER_SIZE, Length: len(data)}, nil
+	}
+}
+
+func (f *diskFlatFiles) Read(loc Location) ([]byte, error) {
+	file, err := os.Open(f.path(loc.File))
+	if os.IsNotExist(err) {
+		return nil, ErrRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if loc.Offset < RECORD_HEADER_SIZE {
+		return nil, ErrRecordNotFound
+	}
+
+	record := make([]byte, RECORD_HEADER_SIZE+loc.Length)
+	_, err = file.ReadAt(record, int64(loc.Offset-RECORD_HEADER_SIZE))
+	if err == io.EOF {
+		return nil, ErrRecordNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkRecord(record, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return record[RECORD_HEADER_SIZE:], nil
+}
+
+func (f *diskFlatFiles) Files() ([]int, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, f.prefix) || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+
+		// 编号格式不一致的文件不是数据文件
+		file, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, f.prefix), ".dat"))
+		if err != nil || filepath.Base(f.path(file)) != name {
+			continue
+		}
+		files = append(files, file)
+	}
+	sort.Ints(files)
+
+	return files, nil
+}
+
+func (f *diskFlatFiles) Scan(file int, fn func(loc Location, data []byte) error) error {
+	content, err := os.ReadFile(f.path(file))
+	if err != nil {
+		return err
+	}
+
+	return scanRecords(file, content, fn)
+}
+
+func (f *diskFlatFiles) Remove(file int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	err := os.Remove(f.path(file))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// memoryFlatFiles 保存在内存中的数据文件，与 NewMemory 一起用于测试
+type memoryFlatFiles struct {
+	files       map[int][]byte
+	maxFileSize int
+	current     int
+	lock        sync.RWMutex
+}
+
+// NewMemoryFlatFiles 创建内存中的数据文件
+func NewMemoryFlatFiles(maxFileSize int) FlatFiles {
+	return &memoryFlatFiles{files: make(map[int][]byte), maxFileSize: maxFileSize}
+}
+
+func (f *memoryFlatFiles) Append(data []byte) (Location, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	record := encodeRecord(data)
+	size := len(f.files[f.current])
+	if size > 0 && size+len(record) > f.maxFileSize {
+		f.current++
+		size = len(f.files[f.current])
+	}
+
+	f.files[f.current] = append(f.files[f.current], record...)
+
+	return Location{File: f.current, Offset: size + RECORD_HEADER_SIZE, Length: len(data)}, nil
+}
+
+func (f *memoryFlatFiles) Read(loc Location) ([]byte, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	content, ok := f.files[loc.File]
+	if !ok || loc.Offset < RECORD_HEADER_SIZE || loc.Offset+loc.Length > len(content) {
+		return nil, ErrRecordNotFound
+	}
+
+	err := checkRecord(content[loc.Offset-RECORD_HEADER_SIZE:loc.Offset], loc)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, content[loc.Offset:loc.Offset+loc.Length]...), nil
+}
+
+func (f *memoryFlatFiles) Files() ([]int, error) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var files []int
+	for file := range f.files {
+		files = append(files, file)
+	}
+	sort.Ints(files)
+
+	return files, nil
+}
+
+func (f *memoryFlatFiles) Scan(file int, fn func(loc Location, data []byte) error) error {
+	f.lock.RLock()
+	content, ok := f.files[file]
+	f.lock.RUnlock()
+
+	if !ok {
+		return os.ErrNotExist
+	}
+
+	return scanRecords(file, content, fn)
+}
+
+func (f *memoryFlatFiles) Remove(file int) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.files, file)
+
+	return nil
+}
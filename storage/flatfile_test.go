@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// forEachFlatFiles 对内存中和磁盘上的数据文件运行同样的测试
+func forEachFlatFiles(t *testing.T, maxFileSize int, fn func(t *testing.T, f FlatFiles)) {
+	t.Run("memory", func(t *testing.T) {
+		fn(t, NewMemoryFlatFiles(maxFileSize))
+	})
+
+	t.Run("disk", func(t *testing.T) {
+		f, err := OpenFlatFiles(t.TempDir(), "blk", maxFileSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fn(t, f)
+	})
+}
+
+func appendAll(t *testing.T, f FlatFiles, records ...string) []Location {
+	var locs []Location
+	for _, record := range records {
+		loc, err := f.Append([]byte(record))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, loc)
+	}
+
+	return locs
+}
+
+// scanAll 按文件编号顺序扫描所有记录，与重建索引时的顺序相同
+func scanAll(t *testing.T, f FlatFiles) ([]Location, []string) {
+	files, err := f.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var locs []Location
+	var records []string
+	for _, file := range files {
+		err := f.Scan(file, func(loc Location, data []byte) error {
+			locs = append(locs, loc)
+			records = append(records, string(data))
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return locs, records
+}
+
+func TestFlatFilesWriteAndRead(t *testing.T) {
+	// 每个文件只能放下两条 10 字节的记录
+	forEachFlatFiles(t, 2*(RECORD_HEADER_SIZE+10), func(t *testing.T, f FlatFiles) {
+		records := []string{"record-000", "record-001", "record-002", "record-003", "record-004"}
+		locs := appendAll(t, f, records...)
+
+		for i, loc := range locs {
+			if loc.File != i/2 {
+				t.Fatalf("record %d is in file %d, want %d", i, loc.File, i/2)
+			}
+
+			data, err := f.Read(loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != records[i] {
+				t.Fatalf("read %q at %+v, want %q", data, loc, records[i])
+			}
+		}
+
+		files, err := f.Files()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 3 || files[0] != 0 || files[2] != 2 {
+			t.Fatalf("files %v, want [0 1 2]", files)
+		}
+
+		// 超过文件大小上限的记录单独写入一个新文件
+		large := bytes.Repeat([]byte("x"), 100)
+		loc, err := f.Append(large)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loc.File != 3 || loc.Offset != RECORD_HEADER_SIZE {
+			t.Fatalf("large record at %+v, want the start of file 3", loc)
+		}
+		data, err := f.Read(loc)
+		if err != nil || !bytes.Equal(data, large) {
+			t.Fatalf("read %d bytes of the large record, error %v", len(data), err)
+		}
+	})
+}
+
+func TestFlatFilesRejectBadLocations(t *testing.T) {
+	forEachFlatFiles(t, 1<<20, func(t *testing.T, f FlatFiles) {
+		locs := appendAll(t, f, "first", "second")
+
+		bad := []Location{
+			{File: 7, Offset: RECORD_HEADER_SIZE, Length: 5},                  // 文件不存在
+			{File: 0, Offset: locs[0].Offset + 1, Length: locs[0].Length},     // 不在记录的开头
+			{File: 0, Offset: locs[0].Offset, Length: locs[0].Length + 1},     // 长度与记录头不一致
+			{File: 0, Offset: locs[1].Offset, Length: 1000},                   // 超出文件末尾
+			{File: 0, Offset: RECORD_HEADER_SIZE - 1, Length: locs[0].Length}, // 在记录头之内
+		}
+		for _, loc := range bad {
+			if _, err := f.Read(loc); err != ErrRecordNotFound {
+				t.Errorf("reading %+v returned %v, want ErrRecordNotFound", loc, err)
+			}
+		}
+
+		// 删除文件后其中的记录无法读取
+		err := f.Remove(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Read(locs[0]); err != ErrRecordNotFound {
+			t.Fatalf("reading a removed file returned %v, want ErrRecordNotFound", err)
+		}
+		if err := f.Remove(0); err != nil {
+			t.Fatalf("removing a missing file returned %v", err)
+		}
+	})
+}
+
+func TestFlatFilesScanFindsAllRecords(t *testing.T) {
+	forEachFlatFiles(t, 2*(RECORD_HEADER_SIZE+10), func(t *testing.T, f FlatFiles) {
+		records := []string{"record-000", "record-001", "record-002"}
+		want := appendAll(t, f, records...)
+
+		locs, got := scanAll(t, f)
+		if !equalKeys(got, records) {
+			t.Fatalf("scanned %q, want %q", got, records)
+		}
+		for i := range want {
+			if locs[i] != want[i] {
+				t.Fatalf("scanned location %+v, want %+v", locs[i], want[i])
+			}
+		}
+	})
+}
+
+func TestScanSkipsDamagedRecords(t *testing.T) {
+	valid := func(data string) []byte {
+		return encodeRecord([]byte(data))
+	}
+
+	var content []byte
+	content = append(content, valid("first")...)
+	content = append(content, []byte("garbage")...)
+	// magic 之后的长度超过文件末尾
+	content = append(content, FLAT_FILE_MAGIC...)
+	content = append(content, 0xff, 0xff, 0xff, 0xff)
+	content = append(content, valid("second")...)
+	// 写入中断留下的不完整的记录
+	truncated := valid("truncated record")
+	content = append(content, truncated[:len(truncated)-4]...)
+
+	var records []string
+	err := scanRecords(0, content, func(loc Location, data []byte) error {
+		if !bytes.Equal(content[loc.Offset:loc.Offset+loc.Length], data) {
+			t.Fatalf("location %+v does not point at %q", loc, data)
+		}
+		records = append(records, string(data))
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"first", "second"}; !equalKeys(records, want) {
+		t.Fatalf("scanned %q, want %q", records, want)
+	}
+}
+
+func TestReopenedFlatFilesDropPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	maxFileSize := 4 * (RECORD_HEADER_SIZE + 10)
+
+	f, err := OpenFlatFiles(dir, "blk", maxFileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := appendAll(t, f, "record-000", "record-001", "record-002")
+
+	// 模拟写入中断：最后一个文件末尾留下了不完整的记录
+	file, err := os.OpenFile(filepath.Join(dir, "blk00000.dat"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file.Write(encodeRecord([]byte("lost"))[:RECORD_HEADER_SIZE+2])
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenFlatFiles(dir, "blk", maxFileSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 新的记录写在最后一条完整记录之后，而不是不完整的记录之后
+	second := appendAll(t, reopened, "record-003")
+	if second[0].File != first[2].File || second[0].Offset != first[2].Offset+first[2].Length+RECORD_HEADER_SIZE {
+		t.Fatalf("record appended at %+v after reopening, want right after %+v", second[0], first[2])
+	}
+
+	// 重建索引时能找到中断前后的所有完整记录
+	locs, records := scanAll(t, reopened)
+	if want := []string{"record-000", "record-001", "record-002", "record-003"}; !equalKeys(records, want) {
+		t.Fatalf("scanned %q, want %q", records, want)
+	}
+	for i, loc := range locs {
+		data, err := reopened.Read(loc)
+		if err != nil || string(data) != records[i] {
+			t.Fatalf("reading scanned location %+v returned %q, %v", loc, data, err)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// memoryDB 保存在内存中的实现，进程退出后数据丢失，用于测试以及不需要持久化的节点
+// 读事务之间可以并发，读写事务与其他事务互斥
+type memoryDB struct {
+	lock    sync.RWMutex
+	buckets map[string]*memoryBucket
+	closed  bool
+}
+
+// NewMemory 创建一个空的内存数据库
+func NewMemory() DB {
+	return &memoryDB{buckets: make(map[string]*memoryBucket)}
+}
+
+func (d *memoryDB) View(fn func(tx Tx) error) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+
+	return fn(&memoryTx{db: d})
+}
+
+func (d *memoryDB) Update(fn func(tx Tx) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return ErrDatabaseClosed
+	}
+
+	tx := &memoryTx{db: d, writable: true}
+	err := fn(tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+
+	return nil
+}
+
+func (d *memoryDB) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.closed = true
+	d.buckets = nil
+
+	return nil
+}
+
+// memoryBucket 的 key 保存在有序的切片中，用于游标遍历
+type memoryBucket struct {
+	keys   []string
+	values map[string][]byte
+}
+
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{values: make(map[string][]byte)}
+}
+
+// search 返回第一个大于等于 key 的位置
+func (b *memoryBucket) search(key string) int {
+	return sort.SearchStrings(b.keys, key)
+}
+
+func (b *memoryBucket) set(key string, value []byte) {
+	if _, ok := b.values[key]; !ok {
+		i := b.search(key)
+		b.keys = append(b.keys, "")
+		copy(b.keys[i+1:], b.keys[i:])
+		b.keys[i] = key
+	}
+
+	b.values[key] = value
+}
+
+func (b *memoryBucket) remove(key string) {
+	if _, ok := b.values[key]; !ok {
+		return
+	}
+
+	i := b.search(key)
+	b.keys = append(b.keys[:i], b.keys[i+1:]...)
+	delete(b.values, key)
+}
+
+// memoryTx 读写事务直接修改数据，同时记录撤销每个修改的操作，fn 返回错误时按相反的顺序撤销
+type memoryTx struct {
+	db       *memoryDB
+	writable bool
+	undo     []func()
+}
+
+func (t *memoryTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+}
+
+func (t *memoryTx) Bucket(name []byte) Bucket {
+	b, ok := t.db.buckets[string(name)]
+	if !ok {
+		return nil
+	}
+
+	return &memoryBucketView{tx: t, b: b}
+}
+
+func (t *memoryTx) CreateBucket(name []byte) (Bucket, error) {
+	if !t.writable {
+		return nil, ErrTxNotWritable
+	}
+	if len(name) == 0 {
+		return nil, ErrBucketNameEmpty
+	}
+
+	key := string(name)
+	if _, ok := t.db.buckets[key]; ok {
+		return nil, ErrBucketExists
+	}
+
+	b := newMemoryBucket()
+	t.db.buckets[key] = b
+	t.undo = append(t.undo, func() {
+		delete(t.db.buckets, key)
+	})
+
+	return &memoryBucketView{tx: t, b: b}, nil
+}
+
+func (t *memoryTx) CreateBucketIfNotExists(name []byte) (Bucket, error) {
+	if b := t.Bucket(name); b != nil {
+		return b, nil
+	}
+
+	return t.CreateBucket(name)
+}
+
+func (t *memoryTx) DeleteBucket(name []byte) error {
+	if !t.writable {
+		return ErrTxNotWritable
+	}
+
+	key := string(name)
+	b, ok := t.db.buckets[key]
+	if !ok {
+		return ErrBucketNotFound
+	}
+
+	delete(t.db.buckets, key)
+	t.undo = append(t.undo, func() {
+		t.db.buckets[key] = b
+	})
+
+	return nil
+}
+
+// memoryBucketView 事务中访问的 bucket
+type memoryBucketView struct {
+	tx *memoryTx
+	b  *memoryBucket
+}
+
+func (v *memoryBucketView) Get(key []byte) []byte {
+	return v.b.values[string(key)]
+}
+
+func (v *memoryBucketView) Put(key []byte, value []byte) error {
+	if !v.tx.writable {
+		return ErrTxNotWritable
+	}
+	if len(key) == 0 {
+		return ErrKeyRequired
+	}
+
+	v.recordUndo(string(key))
+	// 调用方可能在事务之后继续使用这两个切片，所以保存副本
+	v.b.set(string(key), append([]byte{}, value...))
+
+	return nil
+}
+
+func (v *memoryBucketView) Delete(key []byte) error {
+	if !v.tx.writable {
+		return ErrTxNotWritable
+	}
+
+	v.recordUndo(string(key))
+	v.b.remove(string(key))
+
+	return nil
+}
+
+// recordUndo 记录 key 修改之前的状态
+func (v *memoryBucketView) recordUndo(key string) {
+	b := v.b
+	old, existed := b.values[key]
+
+	v.tx.undo = append(v.tx.undo, func() {
+		if existed {
+			b.set(key, old)
+		} else {
+			b.remove(key)
+		}
+	})
+}
+
+func (v *memoryBucketView) Cursor() Cursor {
+	return &memoryCursor{b: v.b, pos: -1}
+}
+
+// memoryCursor 记录当前的 key 而不是位置，遍历时修改 bucket 不会影响后续的移动
+type memoryCursor struct {
+	b   *memoryBucket
+	key string
+	pos int // 为 -1 时游标没有停在任何 key 上
+}
+
+func (c *memoryCursor) First() ([]byte, []byte) {
+	return c.moveTo(0)
+}
+
+func (c *memoryCursor) Last() ([]byte, []byte) {
+	return c.moveTo(len(c.b.keys) - 1)
+}
+
+func (c *memoryCursor) Seek(seek []byte) ([]byte, []byte) {
+	return c.moveTo(c.b.search(string(seek)))
+}
+
+func (c *memoryCursor) Next() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+
+	i := c.b.search(c.key)
+	if i < len(c.b.keys) && c.b.keys[i] == c.key {
+		i++
+	}
+
+	return c.moveTo(i)
+}
+
+func (c *memoryCursor) Prev() ([]byte, []byte) {
+	if c.pos < 0 {
+		return nil, nil
+	}
+
+	return c.moveTo(c.b.search(c.key) - 1)
+}
+
+func (c *memoryCursor) moveTo(i int) ([]byte, []byte) {
+	if i < 0 || i >= len(c.b.keys) {
+		c.pos = -1
+		return nil, nil
+	}
+
+	c.pos = i
+	c.key = c.b.keys[i]
+
+	return []byte(c.key), c.b.values[c.key]
+}
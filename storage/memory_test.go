@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+var testBucket = []byte("test")
+
+// forEachBackend 对内存数据库和 bbolt 运行同样的测试，两种实现的行为需要一致
+func forEachBackend(t *testing.T, fn func(t *testing.T, db DB)) {
+	t.Run("memory", func(t *testing.T) {
+		db := NewMemory()
+		defer db.Close()
+
+		fn(t, db)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		db, err := OpenBolt(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		fn(t, db)
+	})
+}
+
+// put 在一个事务中写入键值对，bucket 不存在时创建
+func put(t *testing.T, db DB, pairs ...string) {
+	err := db.Update(func(tx Tx) error {
+		b, err := tx.CreateBucketIfNotExists(testBucket)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < len(pairs); i += 2 {
+			err = b.Put([]byte(pairs[i]), []byte(pairs[i+1]))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// get 在只读事务中读取 key，bucket 不存在时返回 nil
+func get(t *testing.T, db DB, key string) []byte {
+	var value []byte
+
+	err := db.View(func(tx Tx) error {
+		if b := tx.Bucket(testBucket); b != nil {
+			if v := b.Get([]byte(key)); v != nil {
+				value = append([]byte{}, v...)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestUpdateCommitsAndRollsBack(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "1", "b", "2")
+
+		// 返回错误时事务中的所有修改都被丢弃，包括新建的 bucket
+		failed := errors.New("failed")
+		err := db.Update(func(tx Tx) error {
+			b := tx.Bucket(testBucket)
+			if err := b.Put([]byte("a"), []byte("changed")); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte("b")); err != nil {
+				return err
+			}
+			if err := b.Put([]byte("c"), []byte("3")); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket([]byte("other")); err != nil {
+				return err
+			}
+
+			return failed
+		})
+		if err != failed {
+			t.Fatalf("Update returned %v, want the error from fn", err)
+		}
+
+		if got := get(t, db, "a"); string(got) != "1" {
+			t.Fatalf("a = %q after rollback, want 1", got)
+		}
+		if got := get(t, db, "b"); string(got) != "2" {
+			t.Fatalf("b = %q after rollback, want 2", got)
+		}
+		if got := get(t, db, "c"); got != nil {
+			t.Fatalf("c = %q after rollback, want nil", got)
+		}
+
+		err = db.View(func(tx Tx) error {
+			if tx.Bucket([]byte("other")) != nil {
+				t.Fatal("bucket created in a failed transaction exists")
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestDeleteBucketRollsBack(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "1")
+
+		failed := errors.New("failed")
+		err := db.Update(func(tx Tx) error {
+			err := tx.DeleteBucket(testBucket)
+			if err != nil {
+				return err
+			}
+
+			return failed
+		})
+		if err != failed {
+			t.Fatalf("Update returned %v, want the error from fn", err)
+		}
+		if got := get(t, db, "a"); string(got) != "1" {
+			t.Fatalf("a = %q after the deletion was rolled back, want 1", got)
+		}
+
+		err = db.Update(func(tx Tx) error {
+			return tx.DeleteBucket(testBucket)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := get(t, db, "a"); got != nil {
+			t.Fatalf("a = %q after deleting the bucket, want nil", got)
+		}
+	})
+}
+
+func TestViewIsReadOnly(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "1")
+
+		err := db.View(func(tx Tx) error {
+			if err := tx.Bucket(testBucket).Put([]byte("a"), []byte("2")); err != ErrTxNotWritable {
+				t.Errorf("Put in View returned %v, want ErrTxNotWritable", err)
+			}
+			if err := tx.Bucket(testBucket).Delete([]byte("a")); err != ErrTxNotWritable {
+				t.Errorf("Delete in View returned %v, want ErrTxNotWritable", err)
+			}
+			if _, err := tx.CreateBucket([]byte("other")); err != ErrTxNotWritable {
+				t.Errorf("CreateBucket in View returned %v, want ErrTxNotWritable", err)
+			}
+			if err := tx.DeleteBucket(testBucket); err != ErrTxNotWritable {
+				t.Errorf("DeleteBucket in View returned %v, want ErrTxNotWritable", err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := get(t, db, "a"); string(got) != "1" {
+			t.Fatalf("a = %q after View, want 1", got)
+		}
+	})
+}
+
+func TestBucketErrors(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		err := db.Update(func(tx Tx) error {
+			if tx.Bucket(testBucket) != nil {
+				t.Error("missing bucket is not nil")
+			}
+			if err := tx.DeleteBucket(testBucket); err != ErrBucketNotFound {
+				t.Errorf("deleting a missing bucket returned %v, want ErrBucketNotFound", err)
+			}
+			if _, err := tx.CreateBucket(nil); err != ErrBucketNameEmpty {
+				t.Errorf("creating a bucket without a name returned %v, want ErrBucketNameEmpty", err)
+			}
+
+			b, err := tx.CreateBucket(testBucket)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(testBucket); err != ErrBucketExists {
+				t.Errorf("creating an existing bucket returned %v, want ErrBucketExists", err)
+			}
+			if _, err := tx.CreateBucketIfNotExists(testBucket); err != nil {
+				t.Errorf("CreateBucketIfNotExists on an existing bucket returned %v", err)
+			}
+
+			if err := b.Put(nil, []byte("1")); err != ErrKeyRequired {
+				t.Errorf("Put without a key returned %v, want ErrKeyRequired", err)
+			}
+			if err := b.Delete([]byte("missing")); err != nil {
+				t.Errorf("deleting a missing key returned %v", err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPutCopiesValue(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		value := []byte("1")
+		err := db.Update(func(tx Tx) error {
+			b, err := tx.CreateBucket(testBucket)
+			if err != nil {
+				return err
+			}
+
+			return b.Put([]byte("a"), value)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value[0] = '2'
+		if got := get(t, db, "a"); string(got) != "1" {
+			t.Fatalf("a = %q after modifying the caller's slice, want 1", got)
+		}
+	})
+}
+
+func TestClosedDatabase(t *testing.T) {
+	db := NewMemory()
+	db.Close()
+
+	if err := db.View(func(tx Tx) error { return nil }); err != ErrDatabaseClosed {
+		t.Fatalf("View on a closed database returned %v, want ErrDatabaseClosed", err)
+	}
+	if err := db.Update(func(tx Tx) error { return nil }); err != ErrDatabaseClosed {
+		t.Fatalf("Update on a closed database returned %v, want ErrDatabaseClosed", err)
+	}
+}
+
+// keys 用游标从 first 开始按 move 移动，返回经过的所有 key
+func keys(first func() ([]byte, []byte), move func() ([]byte, []byte)) []string {
+	var result []string
+	for k, _ := first(); k != nil; k, _ = move() {
+		result = append(result, string(k))
+	}
+
+	return result
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestCursorOrder(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		// key 按字节序排列，而不是写入的顺序
+		put(t, db, "c", "3", "a", "1", "\x00b", "0", "b", "2")
+
+		err := db.View(func(tx Tx) error {
+			c := tx.Bucket(testBucket).Cursor()
+
+			if got, want := keys(c.First, c.Next), []string{"\x00b", "a", "b", "c"}; !equalKeys(got, want) {
+				t.Errorf("forward %q, want %q", got, want)
+			}
+			if got, want := keys(c.Last, c.Prev), []string{"c", "b", "a", "\x00b"}; !equalKeys(got, want) {
+				t.Errorf("backward %q, want %q", got, want)
+			}
+
+			if k, v := c.Seek([]byte("ab")); string(k) != "b" || string(v) != "2" {
+				t.Errorf("Seek(ab) = %q %q, want b 2", k, v)
+			}
+			if k, _ := c.Seek([]byte("a")); string(k) != "a" {
+				t.Errorf("Seek(a) = %q, want a", k)
+			}
+			if k, _ := c.Seek([]byte("d")); k != nil {
+				t.Errorf("Seek past the last key = %q, want nil", k)
+			}
+
+			// 移动到末尾之后游标不再移动
+			c.Last()
+			if k, _ := c.Next(); k != nil {
+				t.Errorf("Next after the last key = %q, want nil", k)
+			}
+			c.First()
+			if k, _ := c.Prev(); k != nil {
+				t.Errorf("Prev before the first key = %q, want nil", k)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCursorDeleteWhileIterating(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, db DB) {
+		put(t, db, "a", "1", "b", "2", "c", "3", "d", "4")
+
+		var visited []string
+		err := db.Update(func(tx Tx) error {
+			b := tx.Bucket(testBucket)
+			c := b.Cursor()
+
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				visited = append(visited, string(k))
+				if bytes.Equal(v, []byte("2")) || bytes.Equal(v, []byte("3")) {
+					err := b.Delete(k)
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := []string{"a", "b", "c", "d"}; !equalKeys(visited, want) {
+			t.Fatalf("visited %q while deleting, want %q", visited, want)
+		}
+
+		err = db.View(func(tx Tx) error {
+			c := tx.Bucket(testBucket).Cursor()
+			if got, want := keys(c.First, c.Next), []string{"a", "d"}; !equalKeys(got, want) {
+				t.Errorf("keys %q after deleting, want %q", got, want)
+			}
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
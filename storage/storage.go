@@ -0,0 +1,53 @@
+package storage
+
+import "errors"
+
+// 存储层的错误，各个实现返回相同的错误值，调用方不需要关心底层使用的是哪种存储引擎
+var (
+	ErrDatabaseClosed  = errors.New("database is closed")
+	ErrTxNotWritable   = errors.New("tx not writable")
+	ErrBucketNotFound  = errors.New("bucket not found")
+	ErrBucketExists    = errors.New("bucket already exists")
+	ErrBucketNameEmpty = errors.New("bucket name required")
+	ErrKeyRequired     = errors.New("key required")
+)
+
+// DB 键值数据库，数据按 bucket 分组，每个 bucket 中的 key 按字节序排列
+// 所有读写都在事务中进行，Update 中的修改在 fn 返回 nil 时一起提交，返回错误时全部丢弃，
+// 所以一个 Update 就是一个原子的批量写入
+type DB interface {
+	// View 在只读事务中执行 fn
+	View(fn func(tx Tx) error) error
+	// Update 在读写事务中执行 fn，同一时间只有一个读写事务
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Tx 数据库事务，事务中得到的 Bucket、Cursor 以及读取到的值只在事务结束前有效
+type Tx interface {
+	// Bucket 返回名称为 name 的 bucket，不存在时返回 nil
+	Bucket(name []byte) Bucket
+	CreateBucket(name []byte) (Bucket, error)
+	CreateBucketIfNotExists(name []byte) (Bucket, error)
+	DeleteBucket(name []byte) error
+}
+
+// Bucket 一组按 key 排序的键值对
+type Bucket interface {
+	// Get 返回 key 对应的值，不存在时返回 nil
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	Cursor() Cursor
+}
+
+// Cursor 按 key 的顺序遍历 bucket，移动到末尾之后返回的 key 为 nil
+// 遍历过程中可以修改 bucket，Next 和 Prev 总是移动到当前 key 之后或之前的下一个 key
+type Cursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	// Seek 移动到第一个大于等于 seek 的 key
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
@@ -6,7 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"log"
+	"errors"
 
 	"tchain/common"
 
@@ -16,39 +16,48 @@ import (
 const version = byte(0x00)
 const ADDRESS_CHECK_SUM_LEN = 4
 
+// ErrInvalidAddress is returned when an address fails the checksum check
+var ErrInvalidAddress = errors.New("Address is not valid")
+
 // Wallet stores private and public keys
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
 }
 
-func NewWallet() *Wallet {
-	private, public := newKeyPair()
+// NewWallet creates a wallet with a new key pair
+func NewWallet() (*Wallet, error) {
+	private, public, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
 	wallet := Wallet{private, public}
 
-	return &wallet
+	return &wallet, nil
 }
 
-func newKeyPair() (ecdsa.PrivateKey, []byte) {
+func newKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
-	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// Both coordinates are padded to the curve size so that the key can be split in half again
+	size := (curve.Params().BitSize + 7) / 8
+	pubKey := make([]byte, 2*size)
+	private.PublicKey.X.FillBytes(pubKey[:size])
+	private.PublicKey.Y.FillBytes(pubKey[size:])
 
-	return *private, pubKey
+	return *private, pubKey, nil
 }
 
 // HashPubKey hashes public key
 func HashPubKey(pubKey []byte) []byte {
 	publicSHA256 := sha256.Sum256(pubKey)
 
+	// hash.Hash never returns an error from Write
 	RIPEMD160Hasher := ripemd160.New()
-	_, err := RIPEMD160Hasher.Write(publicSHA256[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	RIPEMD160Hasher.Write(publicSHA256[:])
 	publicRIPEMD160 := RIPEMD160Hasher.Sum(nil)
 
 	return publicRIPEMD160
@@ -78,6 +87,9 @@ func checksum(payload []byte) []byte {
 // ValidateAddress check if address if valid
 func ValidateAddress(address string) bool {
 	pubKeyHash := common.Base58Decode([]byte(address))
+	if len(pubKeyHash) <= 1+ADDRESS_CHECK_SUM_LEN {
+		return false
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-ADDRESS_CHECK_SUM_LEN:]
 	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-ADDRESS_CHECK_SUM_LEN]
@@ -4,14 +4,17 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 )
 
 const WALLET_FILE = "wallet_%s.dat"
 
+// ErrWalletNotFound is returned when an address is not in the wallet file
+var ErrWalletNotFound = errors.New("Address not found in your wallet")
+
 // Wallets stores a collection of wallets
 type Wallets struct {
 	Wallets map[string]*Wallet
@@ -28,13 +31,16 @@ func NewWallets(nodeID string) (*Wallets, error) {
 }
 
 // CreateWallet adds a Wallet to Wallets
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+func (ws *Wallets) CreateWallet() (string, error) {
+	wallet, err := NewWallet()
+	if err != nil {
+		return "", err
+	}
 	address := string(wallet.GetAddress())
 
 	ws.Wallets[address] = wallet
 
-	return address
+	return address, nil
 }
 
 // GetAddresses returns an array of addresses stored in the wallet file
@@ -49,12 +55,12 @@ func (ws *Wallets) GetAddresses() []string {
 }
 
 // GetWallet returns a Wallet by its address
-func (ws Wallets) GetWallet(address string) Wallet {
+func (ws Wallets) GetWallet(address string) (Wallet, error) {
 	wallet := ws.Wallets[address]
 	if wallet == nil {
-		log.Panic("ERROR: Address not found in your wallet")
+		return Wallet{}, fmt.Errorf("%w: %s", ErrWalletNotFound, address)
 	}
-	return *wallet
+	return *wallet, nil
 }
 
 // LoadFromFile loads wallets from the file
@@ -66,7 +72,7 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 
 	fileContent, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	var wallets Wallets
@@ -74,7 +80,7 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("Failed to decode %s: %w", walletFile, err)
 	}
 
 	ws.Wallets = wallets.Wallets
@@ -83,7 +89,7 @@ func (ws *Wallets) LoadFromFile(nodeID string) error {
 }
 
 // SaveToFile saves wallets to a file
-func (ws Wallets) SaveToFile(nodeID string) {
+func (ws Wallets) SaveToFile(nodeID string) error {
 	var content bytes.Buffer
 	walletFile := fmt.Sprintf(WALLET_FILE, nodeID)
 
@@ -92,11 +98,8 @@ func (ws Wallets) SaveToFile(nodeID string) {
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
-	if err != nil {
-		log.Panic(err)
-	}
+	return ioutil.WriteFile(walletFile, content.Bytes(), 0644)
 }